@@ -27,30 +27,48 @@
 //  [hosts]
 //
 //  [hosts.localhost]
-//  type = 0 #HostTypeOS
+//  type = "os"
 //
 //
 //  [hosts.drihm]
-//  type = 1 #HostTypeSSH
+//  type = "ssh"
 //  host = "localhost"
 //  port = 2222
 //  user = "andrea.parodi"
 //  key = "/var/fixtures/private-key"
+//  known-hosts = "~/.ssh/known_hosts" # keys used to verify the server
+//  host-key-policy = "accept-new" # "strict" (the default), "accept-new" or "insecure"
+//  key-passphrase-env = "DRIHM_KEY_PASSPHRASE"
+//  certificate = "/var/fixtures/private-key-cert.pub"
+//  auth-methods = ["agent", "certificate", "key"]
+//  jump-hosts = ["bastion", "andrea.parodi@gateway.example.com:2222"]
+//  env = ["LANG=C", "OMP_NUM_THREADS=4"]
+//  detached-dir = "/home/andrea.parodi/.detached" # state of detached processes
 //
 //
 //  [hosts.withbackup]
-//  type = 1 #HostTypeSSH
+//  type = 1 # numeric types are still accepted: 0 is "os", 1 is "ssh"
 //  host = "example.com"
 //  backup-hosts = ["local", "drihm"]
 //  port = 22
 //  user = "andrea.parodi"
 //  key = "/var/fixtures/private-key"
 //
+//
+//  [hosts.hpc]
+//  type = "slurm" # or "pbs"
+//  # options specific to the host type
+//  transport = "drihm"
+//  jobs-dir = "/scratch/andrea.parodi/jobs"
+//  submit-args = ["--partition=short"]
+//  poll-interval = 10
+//
 // ```
 //
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -60,30 +78,112 @@ import (
 	"github.com/BurntSushi/toml"
 )
 
-// HostType is an enum that represents
-// all possible host type. An host type
-// indicates how and where the processes
-// is started. An HostType variable can
-// have following values:
-type HostType int
+// HostType is the name of the connection type
+// of an host. An host type indicates how and where
+// the processes are started. New types can be
+// registered with `connection.RegisterType`; the
+// builtin ones are:
+type HostType string
 
 const (
 	// HostTypeOS represents an host that
 	// run processes on the local machine
-	HostTypeOS HostType = iota
+	HostTypeOS HostType = "os"
 
 	// HostTypeSSH represents an host that
 	// run processes on a remote machine
 	// through an SSH connection.
-	HostTypeSSH
+	HostTypeSSH HostType = "ssh"
+
+	// HostTypeMemory represents an host that
+	// keeps files in memory and runs commands
+	// implemented in Go. It's used in tests
+	// and dry runs.
+	HostTypeMemory HostType = "memory"
+
+	// HostTypeSlurm represents an host that
+	// submits processes as jobs to a Slurm
+	// scheduler, through another host.
+	HostTypeSlurm HostType = "slurm"
+
+	// HostTypePBS represents an host that
+	// submits processes as jobs to a PBS
+	// scheduler, through another host.
+	HostTypePBS HostType = "pbs"
+)
+
+// numericHostTypes contains the host types
+// that older configuration files specify
+// by number, indexed by that number. Only
+// these types existed in those files.
+var numericHostTypes = []HostType{HostTypeOS, HostTypeSSH}
+
+// UnmarshalTOML reads an host type from
+// either its name or its number.
+func (hostType *HostType) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		*hostType = HostType(v)
+		return nil
+	case int64:
+		if v < 0 || v >= int64(len(numericHostTypes)) {
+			return fmt.Errorf("unknown host type %d", v)
+		}
+		*hostType = numericHostTypes[v]
+		return nil
+	}
+	return fmt.Errorf("host type must be a string or an integer, found `%v`", value)
+}
+
+// HostKeyPolicy indicates how the key presented
+// by an SSH server is verified. An HostKeyPolicy
+// variable can have following values:
+type HostKeyPolicy string
+
+const (
+	// HostKeyStrict accepts only servers whose
+	// key is present in the known_hosts file.
+	// It's the default policy.
+	HostKeyStrict HostKeyPolicy = "strict"
+
+	// HostKeyAcceptNew adds keys of unknown servers
+	// to the known_hosts file, but refuses servers whose
+	// key differs from the recorded one.
+	HostKeyAcceptNew HostKeyPolicy = "accept-new"
+
+	// HostKeyInsecure accepts any server key
+	// without verification.
+	HostKeyInsecure HostKeyPolicy = "insecure"
+)
+
+// AuthMethod is a way to authenticate
+// on SSH hosts. An AuthMethod variable can
+// have following values:
+type AuthMethod string
+
+const (
+	// AuthAgent authenticates using the keys
+	// of the agent listening on `SSH_AUTH_SOCK`.
+	AuthAgent AuthMethod = "agent"
+
+	// AuthKey authenticates using the
+	// private key file of the host.
+	AuthKey AuthMethod = "key"
+
+	// AuthCertificate authenticates using the
+	// OpenSSH certificate file of the host, signed
+	// for its private key.
+	AuthCertificate AuthMethod = "certificate"
 )
 
 // Host is struct that contains information
 // about a host on which to run processes
 type Host struct {
 	// Contains the type of the host.
-	// It can be either `HostTypeOS` or
-	// `HostTypeSSH`
+	// It can be `HostTypeOS`, `HostTypeSSH`,
+	// `HostTypeMemory` or the name of a type
+	// registered with `connection.RegisterType`.
+	// Defaults to `HostTypeOS`.
 	Type HostType
 	// Name of the host, written at
 	// runtime using the key of the
@@ -104,6 +204,44 @@ type Host struct {
 	// Local path of the private SSH
 	// key file.
 	Key string
+	// Name of the environment variable
+	// containing the passphrase of the
+	// private key.
+	KeyPassphraseEnv string `toml:"key-passphrase-env"`
+	// Local path of the OpenSSH certificate
+	// file for the private key.
+	Certificate string
+	// Authentication methods to try, in order.
+	// Defaults to certificate, key and agent, each
+	// one used only if available.
+	AuthMethods []AuthMethod `toml:"auth-methods"`
+	// Hosts through which the host is reached,
+	// in order. Each one can be the name of a
+	// configured host or a `[user@]host[:port]`
+	// specification.
+	JumpHosts []string `toml:"jump-hosts"`
+	// Maximum number of idle sftp clients
+	// kept open on the connection.
+	SFTPPoolSize int `toml:"sftp-pool-size"`
+	// Seconds between keepalive requests sent
+	// to the server. 0 means 30 seconds, a negative
+	// value disables keepalive.
+	KeepAlive int `toml:"keepalive-interval"`
+	// Local path of the known_hosts file used
+	// to verify the server key. Defaults to
+	// `~/.ssh/known_hosts`.
+	KnownHosts string `toml:"known-hosts"`
+	// Policy used to verify the server key.
+	// Defaults to `HostKeyStrict`.
+	HostKeyPolicy HostKeyPolicy `toml:"host-key-policy"`
+	// Env contains `NAME=value` environment
+	// variables set by default for processes
+	// run on the host.
+	Env []string
+	// Options contains all keys of the host
+	// section not listed above, that are
+	// specific to the type of the host.
+	Options map[string]interface{} `toml:"-"`
 }
 
 // Type is a structure which contains the
@@ -132,7 +270,7 @@ var Filename string
 // from the given file.
 func Init(configFile string) error {
 	var cfg Type
-	_, err := toml.DecodeFile(configFile, &cfg)
+	meta, err := toml.DecodeFile(configFile, &cfg)
 	if err != nil {
 		return err
 	}
@@ -141,6 +279,11 @@ func Init(configFile string) error {
 		cfg.Hosts = make(map[string]*Host)
 	}
 
+	err = readHostOptions(configFile, meta, cfg.Hosts)
+	if err != nil {
+		return err
+	}
+
 	if cfg.SSHConfigPath != "" {
 		cfg.Hosts["localhost"] = &Host{
 			Type: HostTypeOS,
@@ -149,6 +292,10 @@ func Init(configFile string) error {
 		if err != nil {
 			return err
 		}
+		options, err := parseSSHConfigOptions(cfg.SSHConfigPath)
+		if err != nil {
+			return err
+		}
 
 		for _, host := range hosts {
 			if strings.Contains(host.IdentityFile, "~") {
@@ -165,6 +312,13 @@ func Init(configFile string) error {
 				User:        host.User,
 				Key:         host.IdentityFile,
 			}
+			knownHosts := strings.Fields(options.get(sshHost.Name, "userknownhostsfile"))
+			if len(knownHosts) > 0 {
+				sshHost.KnownHosts = expandHome(knownHosts[0])
+			}
+			sshHost.HostKeyPolicy = strictHostKeyChecking(options.get(sshHost.Name, "stricthostkeychecking"))
+			sshHost.Certificate = expandHome(options.get(sshHost.Name, "certificatefile"))
+			sshHost.JumpHosts = proxyJump(options.get(sshHost.Name, "proxyjump"))
 			if sshHost.Name != "*" {
 				cfg.Hosts[sshHost.Name] = &sshHost
 			}
@@ -175,6 +329,29 @@ func Init(configFile string) error {
 
 	for name, host := range cfg.Hosts {
 		host.Name = name
+		if host.Type == "" {
+			host.Type = HostTypeOS
+		}
+		host.KnownHosts = expandHome(host.KnownHosts)
+		switch host.HostKeyPolicy {
+		case "", HostKeyStrict, HostKeyAcceptNew, HostKeyInsecure:
+		default:
+			return fmt.Errorf("wrong configuration file \"%s\": unknown host-key-policy `%s` for host `%s`", configFile, host.HostKeyPolicy, name)
+		}
+		for _, method := range host.AuthMethods {
+			switch method {
+			case AuthAgent, AuthKey, AuthCertificate:
+			default:
+				return fmt.Errorf("wrong configuration file \"%s\": unknown auth method `%s` for host `%s`", configFile, method, name)
+			}
+		}
+		for _, variable := range host.Env {
+			if !strings.Contains(variable, "=") {
+				return fmt.Errorf("wrong configuration file \"%s\": env variable `%s` of host `%s` must be in `NAME=value` form", configFile, variable, name)
+			}
+		}
+		host.Key = expandHome(host.Key)
+		host.Certificate = expandHome(host.Certificate)
 	}
 
 	wd, err := os.Getwd()
@@ -190,3 +367,32 @@ func Init(configFile string) error {
 	Hosts = cfg.Hosts
 	return nil
 }
+
+// readHostOptions fills the `Options` of `hosts`
+// with the keys of their sections that were not
+// decoded into other fields.
+func readHostOptions(configFile string, meta toml.MetaData, hosts map[string]*Host) error {
+	var raw struct {
+		Hosts map[string]map[string]interface{}
+	}
+	decoded := false
+
+	for _, key := range meta.Undecoded() {
+		if len(key) != 3 || key[0] != "hosts" {
+			continue
+		}
+		if !decoded {
+			_, err := toml.DecodeFile(configFile, &raw)
+			if err != nil {
+				return err
+			}
+			decoded = true
+		}
+		host := hosts[key[1]]
+		if host.Options == nil {
+			host.Options = map[string]interface{}{}
+		}
+		host.Options[key[2]] = raw.Hosts[key[1]][key[2]]
+	}
+	return nil
+}
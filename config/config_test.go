@@ -1,32 +1,154 @@
-package config
+package config_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/meteocima/virtual-server/config"
 	"github.com/meteocima/virtual-server/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestConfigSSHInit(t *testing.T) {
-	err := Init(testutil.FixtureDir("sshconfig-virt-serv.toml"))
+	err := config.Init(testutil.FixtureDir("sshconfig-virt-serv.toml"))
 	assert.NoError(t, err)
 
-	assert.Equal(t, 16, len(Hosts))
-	local, timoteo := Hosts["localhost"], Hosts["timoteo"]
+	assert.Equal(t, 16, len(config.Hosts))
+	local, timoteo := config.Hosts["localhost"], config.Hosts["timoteo"]
 	assert.Equal(t, "localhost", local.Name)
 	assert.Equal(t, "timoteo", timoteo.Name)
 
 }
 
 func TestInit(t *testing.T) {
-	err := Init(testutil.FixtureDir("virt-serv.toml"))
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
 	assert.NoError(t, err)
 
-	assert.Equal(t, 3, len(Hosts))
-	local, drihm, withBck := Hosts["localhost"], Hosts["drihm"], Hosts["withbackup"]
+	assert.Equal(t, 3, len(config.Hosts))
+	local, drihm, withBck := config.Hosts["localhost"], config.Hosts["drihm"], config.Hosts["withbackup"]
 	assert.Equal(t, "localhost", local.Name)
 
 	assert.Equal(t, "drihm", drihm.Name)
 	assert.Equal(t, "andrea.parodi", drihm.User)
 	assert.Equal(t, "withbackup", withBck.Name)
 }
+
+func TestConfigSSHHostKeyOptions(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("sshconfig-options.toml"))
+	assert.NoError(t, err)
+
+	home, err := os.UserHomeDir()
+	assert.NoError(t, err)
+
+	bastion, sandbox, cluster := config.Hosts["bastion"], config.Hosts["sandbox"], config.Hosts["cluster"]
+	assert.Equal(t, config.HostKeyAcceptNew, bastion.HostKeyPolicy)
+	assert.Equal(t, home+"/.ssh/bastion_hosts", bastion.KnownHosts)
+
+	assert.Equal(t, config.HostKeyInsecure, sandbox.HostKeyPolicy)
+	assert.Equal(t, "/etc/ssh/known_hosts", sandbox.KnownHosts)
+
+	assert.Equal(t, config.HostKeyStrict, cluster.HostKeyPolicy)
+	assert.Equal(t, "/etc/ssh/known_hosts", cluster.KnownHosts)
+
+	hpc := config.Hosts["hpc"]
+	assert.Equal(t, home+"/.ssh/id_ed25519", hpc.Key)
+	assert.Equal(t, home+"/.ssh/id_ed25519-cert.pub", hpc.Certificate)
+	assert.Equal(t, "", cluster.Certificate)
+
+	compute := config.Hosts["compute"]
+	assert.Equal(t, []string{"bastion", "admin@gateway.example.com:2222"}, compute.JumpHosts)
+	assert.Nil(t, cluster.JumpHosts)
+}
+
+func TestInitUnknownHostKeyPolicy(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "wrong.toml")
+	err := ioutil.WriteFile(cfgFile, []byte("[hosts.remote]\ntype = 1\nhost-key-policy = \"maybe\"\n"), 0644)
+	assert.NoError(t, err)
+
+	err = config.Init(cfgFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown host-key-policy `maybe` for host `remote`")
+}
+
+func TestInitAuthMethods(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "auth.toml")
+	err := ioutil.WriteFile(cfgFile, []byte("[hosts.remote]\ntype = 1\nkey-passphrase-env = \"REMOTE_PASS\"\nauth-methods = [\"agent\", \"key\"]\n"), 0644)
+	assert.NoError(t, err)
+
+	err = config.Init(cfgFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []config.AuthMethod{config.AuthAgent, config.AuthKey}, config.Hosts["remote"].AuthMethods)
+	assert.Equal(t, "REMOTE_PASS", config.Hosts["remote"].KeyPassphraseEnv)
+
+	err = ioutil.WriteFile(cfgFile, []byte("[hosts.remote]\ntype = 1\nauth-methods = [\"password\"]\n"), 0644)
+	assert.NoError(t, err)
+	err = config.Init(cfgFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown auth method `password` for host `remote`")
+}
+
+func TestInitHostTypes(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "types.toml")
+	err := ioutil.WriteFile(cfgFile, []byte(`
+[hosts.numeric]
+type = 1
+[hosts.named]
+type = "ssh"
+[hosts.default]
+[hosts.cluster]
+type = "slurm"
+transport = "named"
+partitions = ["short", "long"]
+max-jobs = 4
+[hosts.cluster.limits]
+walltime = "01:00:00"
+`), 0644)
+	assert.NoError(t, err)
+
+	err = config.Init(cfgFile)
+	assert.NoError(t, err)
+	assert.Equal(t, config.HostTypeSSH, config.Hosts["numeric"].Type)
+	assert.Equal(t, config.HostTypeSSH, config.Hosts["named"].Type)
+	assert.Equal(t, config.HostTypeOS, config.Hosts["default"].Type)
+	assert.Nil(t, config.Hosts["named"].Options)
+
+	cluster := config.Hosts["cluster"]
+	assert.Equal(t, config.HostType("slurm"), cluster.Type)
+	assert.Equal(t, map[string]interface{}{
+		"transport":  "named",
+		"partitions": []interface{}{"short", "long"},
+		"max-jobs":   int64(4),
+		"limits":     map[string]interface{}{"walltime": "01:00:00"},
+	}, cluster.Options)
+
+	err = ioutil.WriteFile(cfgFile, []byte("[hosts.remote]\ntype = 7\n"), 0644)
+	assert.NoError(t, err)
+	err = config.Init(cfgFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown host type 7")
+
+	err = ioutil.WriteFile(cfgFile, []byte("[hosts.remote]\ntype = 2\n"), 0644)
+	assert.NoError(t, err)
+	err = config.Init(cfgFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown host type 2")
+}
+
+func TestInitHostEnv(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "env.toml")
+	err := ioutil.WriteFile(cfgFile, []byte("[hosts.remote]\ntype = \"ssh\"\nenv = [\"LANG=C\", \"EMPTY=\"]\n"), 0644)
+	assert.NoError(t, err)
+
+	err = config.Init(cfgFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"LANG=C", "EMPTY="}, config.Hosts["remote"].Env)
+	assert.Nil(t, config.Hosts["remote"].Options)
+
+	err = ioutil.WriteFile(cfgFile, []byte("[hosts.remote]\ntype = \"ssh\"\nenv = [\"LANG\"]\n"), 0644)
+	assert.NoError(t, err)
+	err = config.Init(cfgFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "env variable `LANG` of host `remote` must be in `NAME=value` form")
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+// sshConfigBlock is a `Host` section
+// of an ssh config file.
+type sshConfigBlock struct {
+	patterns []string
+	options  map[string]string
+}
+
+// sshConfigOptions contains the sections of an ssh
+// config file, used to read the options not supported
+// by the `sshconfig` package.
+type sshConfigOptions []sshConfigBlock
+
+// parseSSHConfigOptions reads all options of
+// the ssh config file at `configPath`. Option names
+// are lowercased, since ssh treats them case insensitively.
+func parseSSHConfigOptions(configPath string) (sshConfigOptions, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// options that precede any `Host`
+	// line apply to every host.
+	current := sshConfigBlock{patterns: []string{"*"}, options: map[string]string{}}
+	result := sshConfigOptions{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value := splitSSHConfigLine(line)
+		switch key {
+		case "host":
+			result = append(result, current)
+			current = sshConfigBlock{patterns: strings.Fields(value), options: map[string]string{}}
+		case "match":
+			// `Match` conditions are not supported:
+			// their options are never applied.
+			result = append(result, current)
+			current = sshConfigBlock{options: map[string]string{}}
+		default:
+			if _, exists := current.options[key]; !exists {
+				current.options[key] = value
+			}
+		}
+	}
+	result = append(result, current)
+
+	return result, scanner.Err()
+}
+
+func splitSSHConfigLine(line string) (string, string) {
+	sep := strings.IndexAny(line, " \t=")
+	if sep == -1 {
+		return strings.ToLower(line), ""
+	}
+	key := strings.ToLower(line[:sep])
+	value := strings.TrimLeft(line[sep:], " \t")
+	value = strings.TrimPrefix(value, "=")
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+	return key, value
+}
+
+// matches returns whether the block
+// applies to host `name`.
+func (block sshConfigBlock) matches(name string) bool {
+	matched := false
+	for _, pattern := range block.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), name)
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// get returns the value of option `key` for host `name`.
+// As in ssh, the first value found is used.
+func (options sshConfigOptions) get(name string, key string) string {
+	for _, block := range options {
+		if !block.matches(name) {
+			continue
+		}
+		if value, ok := block.options[key]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// strictHostKeyChecking converts a `StrictHostKeyChecking`
+// ssh option to the corresponding HostKeyPolicy.
+func strictHostKeyChecking(value string) HostKeyPolicy {
+	switch strings.ToLower(value) {
+	case "accept-new":
+		return HostKeyAcceptNew
+	case "no", "off":
+		return HostKeyInsecure
+	default:
+		return HostKeyStrict
+	}
+}
+
+// proxyJump splits a `ProxyJump`
+// ssh option in its jump hosts.
+func proxyJump(value string) []string {
+	if value == "" || strings.ToLower(value) == "none" {
+		return nil
+	}
+	jumps := []string{}
+	for _, jump := range strings.Split(value, ",") {
+		jumps = append(jumps, strings.TrimSpace(jump))
+	}
+	return jumps
+}
+
+// expandHome replaces a leading `~`
+// with the user home directory.
+func expandHome(filePath string) string {
+	if filePath != "~" && !strings.HasPrefix(filePath, "~/") {
+		return filePath
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filePath
+	}
+	return home + strings.TrimPrefix(filePath, "~")
+}
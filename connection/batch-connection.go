@@ -0,0 +1,541 @@
+package connection
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// BatchConnection is a Connection that runs
+// processes as jobs of a batch scheduler, such
+// as Slurm or PBS. Files are accessed, and
+// scheduler commands are run, through the
+// connection of another host, the transport.
+//
+// The options of the host section are:
+//
+//   - `transport`: name of the host used to reach
+//     the scheduler. Defaults to `localhost`.
+//   - `jobs-dir`: directory on the transport where job
+//     scripts, outputs and exit codes are written.
+//     Defaults to `/tmp`.
+//   - `submit-command`, `status-command` and `cancel-command`:
+//     paths of the scheduler commands. Defaults to `sbatch`,
+//     `squeue` and `scancel` for Slurm, `qsub`, `qstat` and
+//     `qdel` for PBS.
+//   - `submit-args`: additional arguments of the
+//     submit command, such as the queue to use.
+//   - `poll-interval`: seconds between job state checks.
+//     Defaults to 5.
+type BatchConnection struct {
+	// Connection is the transport connection,
+	// set when the connection is opened.
+	Connection
+
+	name          string
+	transportName string
+	scheduler     *batchScheduler
+	submitCommand string
+	statusCommand string
+	cancelCommand string
+	submitArgs    []string
+	jobsDir       string
+	pollInterval  time.Duration
+	// default environment variables
+	// of jobs run on the host.
+	env []string
+}
+
+// batchScheduler contains the commands and
+// conventions of a batch scheduler.
+type batchScheduler struct {
+	submitCommand string
+	statusCommand string
+	cancelCommand string
+	submitArgs    []string
+	// directives returns the lines of the job
+	// script that configure the job.
+	directives func(name, stdout, stderr string) []string
+	// jobID parses the output of the submit command.
+	jobID func(output string) string
+	// statusArgs returns the arguments of the
+	// status command for job `id`.
+	statusArgs func(id string) []string
+	// active parses the output of the status
+	// command, and tells whether the job is
+	// still pending or running.
+	active func(output string) bool
+}
+
+var slurmScheduler = &batchScheduler{
+	submitCommand: "sbatch",
+	statusCommand: "squeue",
+	cancelCommand: "scancel",
+	submitArgs:    []string{"--parsable"},
+	directives: func(name, stdout, stderr string) []string {
+		return []string{
+			"#SBATCH --job-name=" + name,
+			"#SBATCH --output=" + stdout,
+			"#SBATCH --error=" + stderr,
+		}
+	},
+	jobID: func(output string) string {
+		// --parsable prints `jobid[;cluster]`
+		return strings.SplitN(strings.TrimSpace(output), ";", 2)[0]
+	},
+	statusArgs: func(id string) []string {
+		return []string{"--noheader", "--format=%T", "--jobs", id}
+	},
+	active: func(output string) bool {
+		switch strings.TrimSpace(output) {
+		case "", "COMPLETED", "FAILED", "CANCELLED", "TIMEOUT", "NODE_FAIL",
+			"OUT_OF_MEMORY", "PREEMPTED", "BOOT_FAIL", "DEADLINE":
+			return false
+		}
+		return true
+	},
+}
+
+var pbsScheduler = &batchScheduler{
+	submitCommand: "qsub",
+	statusCommand: "qstat",
+	cancelCommand: "qdel",
+	directives: func(name, stdout, stderr string) []string {
+		return []string{
+			"#PBS -N " + name,
+			"#PBS -o " + stdout,
+			"#PBS -e " + stderr,
+		}
+	},
+	jobID: strings.TrimSpace,
+	statusArgs: func(id string) []string {
+		return []string{"-f", id}
+	},
+	active: func(output string) bool {
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "job_state" {
+				// C: completed, F: finished
+				return fields[2] != "C" && fields[2] != "F"
+			}
+		}
+		return false
+	},
+}
+
+// newBatchConnection returns a factory of
+// connections that use `scheduler`.
+func newBatchConnection(scheduler *batchScheduler) Factory {
+	return func(host *config.Host) (Connection, error) {
+		conn := &BatchConnection{
+			name:      host.Name,
+			scheduler: scheduler,
+			env:       host.Env,
+		}
+		var err error
+		if conn.transportName, err = stringOption(host, "transport", "localhost"); err != nil {
+			return nil, err
+		}
+		if conn.transportName == host.Name {
+			return nil, fmt.Errorf("host `%s` cannot be the transport of itself", host.Name)
+		}
+		if conn.jobsDir, err = stringOption(host, "jobs-dir", "/tmp"); err != nil {
+			return nil, err
+		}
+		if conn.submitCommand, err = stringOption(host, "submit-command", scheduler.submitCommand); err != nil {
+			return nil, err
+		}
+		if conn.statusCommand, err = stringOption(host, "status-command", scheduler.statusCommand); err != nil {
+			return nil, err
+		}
+		if conn.cancelCommand, err = stringOption(host, "cancel-command", scheduler.cancelCommand); err != nil {
+			return nil, err
+		}
+		if conn.submitArgs, err = stringsOption(host, "submit-args"); err != nil {
+			return nil, err
+		}
+		if conn.pollInterval, err = secondsOption(host, "poll-interval", 5*time.Second); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func stringOption(host *config.Host, key string, defaultValue string) (string, error) {
+	value, ok := host.Options[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("option `%s` of host `%s` must be a string", key, host.Name)
+	}
+	return str, nil
+}
+
+func stringsOption(host *config.Host, key string) ([]string, error) {
+	value, ok := host.Options[key]
+	if !ok {
+		return nil, nil
+	}
+	values, ok := value.([]interface{})
+	result := make([]string, len(values))
+	for i, v := range values {
+		result[i], ok = v.(string)
+		if !ok {
+			break
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("option `%s` of host `%s` must be a list of strings", key, host.Name)
+	}
+	return result, nil
+}
+
+func secondsOption(host *config.Host, key string, defaultValue time.Duration) (time.Duration, error) {
+	switch value := host.Options[key].(type) {
+	case nil:
+		return defaultValue, nil
+	case int64:
+		return time.Duration(value) * time.Second, nil
+	case float64:
+		return time.Duration(value * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("option `%s` of host `%s` must be a number of seconds", key, host.Name)
+}
+
+// Name ...
+func (conn *BatchConnection) Name() string {
+	return conn.name
+}
+
+// Open opens the transport connection.
+func (conn *BatchConnection) Open() error {
+	transport, err := FindHost(conn.transportName)
+	if err != nil {
+		return fmt.Errorf("Open `%s`: FindHost: %w", conn.name, err)
+	}
+	conn.Connection = transport
+	return nil
+}
+
+// Close doesn't close the transport
+// connection, that could be used by others.
+func (conn *BatchConnection) Close() error { return nil }
+
+// runCommand runs a scheduler command on the transport,
+// and returns its exit code and standard output.
+func (conn *BatchConnection) runCommand(command string, args ...string) (int, string, error) {
+	var stdout, stderr bytes.Buffer
+	proc, err := conn.Connection.Run(NewPath(conn.Connection, command), args, RunOptions{
+		Stdin:  strings.NewReader(""),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	code, err := proc.Wait()
+	if err != nil {
+		return 0, "", err
+	}
+	if code != 0 {
+		return code, stdout.String(), fmt.Errorf("`%s` exited with code %d: %s", command, code, strings.TrimSpace(stderr.String()))
+	}
+	return code, stdout.String(), nil
+}
+
+// jobCounter makes job file names unique
+// when jobs are submitted in the same instant.
+var jobCounter int64
+
+// jobScript returns the content of the script
+// that runs `command` and writes its exit code.
+func (conn *BatchConnection) jobScript(name string, files batchJobFiles, command vpath.VirtualPath, args []string, options RunOptions) (string, error) {
+	lines := []string{"#!/bin/sh"}
+	lines = append(lines, conn.scheduler.directives(name, files.stdout, files.stderr)...)
+
+	commandLine, err := shellCommand(command.Path, args, options, conn.env)
+	if err != nil {
+		return "", err
+	}
+
+	// the command runs in a subshell, so that the
+	// exit code is written even when it cannot start.
+	lines = append(lines,
+		"(",
+		commandLine,
+		")",
+		"code=$?",
+		// written with a rename, so that it's
+		// never read partially written.
+		fmt.Sprintf("echo $code > %s", ShellQuote(files.exit+".tmp")),
+		fmt.Sprintf("mv %s %s", ShellQuote(files.exit+".tmp"), ShellQuote(files.exit)),
+		"exit $code",
+	)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// batchJobFiles contains the paths of
+// the files on the transport used by a job.
+type batchJobFiles struct {
+	script string
+	stdout string
+	stderr string
+	exit   string
+}
+
+// Run writes a script that runs `command` in the jobs
+// directory, submits it to the scheduler and returns a Process
+// that polls the job state. The inherited environment of
+// the job is the one the scheduler sets. The job output
+// files are copied to `options.Stdout` and `options.Stderr`,
+// together with the log files `options.OutFromLog` and
+// `options.ErrFromLog`, while `options.Stdin` is ignored.
+func (conn *BatchConnection) Run(command vpath.VirtualPath, args []string, options RunOptions) (Process, error) {
+	name := path.Base(command.Path)
+	base := path.Join(conn.jobsDir, fmt.Sprintf("%s-%d-%d", name, time.Now().UnixNano(), atomic.AddInt64(&jobCounter, 1)))
+	files := batchJobFiles{
+		script: base + ".sh",
+		stdout: base + ".out",
+		stderr: base + ".err",
+		exit:   base + ".exit",
+	}
+
+	stdout, stderr := options.Stdout, options.Stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	followers := []*fileFollower{
+		{conn: conn.Connection, file: NewPath(conn.Connection, files.stdout), w: stdout},
+		{conn: conn.Connection, file: NewPath(conn.Connection, files.stderr), w: stderr},
+	}
+	for _, log := range []struct {
+		file *vpath.VirtualPath
+		w    io.Writer
+	}{{options.OutFromLog, stdout}, {options.ErrFromLog, stderr}} {
+		if log.file == nil {
+			continue
+		}
+		follower, err := conn.logFollower(*log.file, log.w)
+		if err != nil {
+			return nil, fmt.Errorf("Run `%s`: %w", command.String(), err)
+		}
+		followers = append(followers, follower)
+	}
+
+	script, err := conn.jobScript(name, files, command, args, options)
+	if err != nil {
+		return nil, fmt.Errorf("Run `%s`: %w", command.String(), err)
+	}
+
+	writer, err := conn.Connection.OpenWriter(NewPath(conn.Connection, files.script))
+	if err != nil {
+		return nil, fmt.Errorf("Run `%s`: OpenWriter: %w", command.String(), err)
+	}
+	_, err = writer.Write([]byte(script))
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Run `%s`: write job script: %w", command.String(), err)
+	}
+
+	submitArgs := append(append(append([]string{}, conn.scheduler.submitArgs...), conn.submitArgs...), files.script)
+	_, output, err := conn.runCommand(conn.submitCommand, submitArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("Run `%s`: submit: %w", command.String(), err)
+	}
+	jobID := conn.scheduler.jobID(output)
+	if jobID == "" {
+		return nil, fmt.Errorf("Run `%s`: submit: no job id in output `%s`", command.String(), output)
+	}
+
+	process := &BatchProcess{
+		JobID:     jobID,
+		conn:      conn,
+		files:     files,
+		followers: followers,
+		completed: make(chan struct{}),
+		doneOnce:  &sync.Once{},
+	}
+	go process.poll()
+
+	return process, nil
+}
+
+// logFollower returns a follower that copies the log `file`
+// to `w`. Log files on the batch host are read
+// through the transport.
+func (conn *BatchConnection) logFollower(file vpath.VirtualPath, w io.Writer) (*fileFollower, error) {
+	if file.Host == conn.name {
+		return &fileFollower{conn: conn.Connection, file: file, w: w}, nil
+	}
+	logConn, err := FindHost(file.Host)
+	if err != nil {
+		return nil, fmt.Errorf("log file `%s`: FindHost: %w", file.String(), err)
+	}
+	return &fileFollower{conn: logConn, file: file, w: w}, nil
+}
+
+// BatchProcess is a job submitted
+// to a batch scheduler.
+type BatchProcess struct {
+	// JobID is the id assigned
+	// to the job by the scheduler.
+	JobID string
+
+	conn      *BatchConnection
+	files     batchJobFiles
+	followers []*fileFollower
+	killed    int32
+	completed chan struct{}
+	doneOnce  *sync.Once
+	state     int
+	err       error
+}
+
+// complete sets the exit code of the process,
+// unless it has already been set.
+func (proc *BatchProcess) complete(state int, err error) {
+	proc.doneOnce.Do(func() {
+		proc.state = state
+		proc.err = err
+		close(proc.completed)
+	})
+}
+
+// follow copies the output appended to the
+// job output files and to the log files.
+func (proc *BatchProcess) follow() {
+	for _, follower := range proc.followers {
+		follower.follow()
+	}
+}
+
+// exitCode reads the exit code written
+// by the job script, if it's completed.
+func (proc *BatchProcess) exitCode() (int, bool) {
+	transport := proc.conn.Connection
+	reader, err := transport.OpenReader(NewPath(transport, proc.files.exit))
+	if err != nil {
+		return 0, false
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, false
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// active asks the scheduler whether
+// the job is still pending or running.
+func (proc *BatchProcess) active() (bool, error) {
+	conn := proc.conn
+	code, output, err := conn.runCommand(conn.statusCommand, conn.scheduler.statusArgs(proc.JobID)...)
+	if err != nil && code == 0 {
+		// the command could not be run
+		return false, err
+	}
+	// schedulers fail when asked about
+	// jobs they already forgot.
+	return code == 0 && conn.scheduler.active(output), nil
+}
+
+// poll copies the job output and checks its state every
+// poll interval, until the job completes. Jobs that leave
+// the scheduler without writing their exit code have been
+// killed: their exit code is 143 (SIGTERM) when killed with
+// `Kill`, 137 (SIGKILL) otherwise.
+func (proc *BatchProcess) poll() {
+	ticker := time.NewTicker(proc.conn.pollInterval)
+	defer ticker.Stop()
+
+	finish := func(state int, err error) {
+		proc.follow()
+		proc.complete(state, err)
+	}
+
+	for {
+		select {
+		case <-proc.completed:
+			return
+		case <-ticker.C:
+		}
+
+		proc.follow()
+
+		if code, ok := proc.exitCode(); ok {
+			finish(code, nil)
+			return
+		}
+
+		active, err := proc.active()
+		if err != nil {
+			finish(-1, fmt.Errorf("Wait job `%s`: status: %w", proc.JobID, err))
+			return
+		}
+		if active {
+			continue
+		}
+
+		// the job could have written its exit code
+		// after the previous check.
+		if code, ok := proc.exitCode(); ok {
+			finish(code, nil)
+			return
+		}
+		if atomic.LoadInt32(&proc.killed) == 1 {
+			finish(128+int(syscall.SIGTERM), nil)
+		} else {
+			finish(128+int(syscall.SIGKILL), nil)
+		}
+		return
+	}
+}
+
+// Kill cancels the job and waits for it to leave the
+// scheduler. If it's still there after `killGracePeriod`
+// plus the poll interval, it's considered killed anyway. Killing an already
+// completed job is a no-op.
+func (proc *BatchProcess) Kill() error {
+	if awaitCompletion(proc.completed, 0) {
+		return nil
+	}
+	atomic.StoreInt32(&proc.killed, 1)
+	_, _, err := proc.conn.runCommand(proc.conn.cancelCommand, proc.JobID)
+	if err != nil {
+		return fmt.Errorf("Kill job `%s`: %w", proc.JobID, err)
+	}
+	if !awaitCompletion(proc.completed, killGracePeriod+proc.conn.pollInterval) {
+		proc.complete(128+int(syscall.SIGKILL), nil)
+	}
+	return nil
+}
+
+// Wait ...
+func (proc *BatchProcess) Wait() (int, error) {
+	<-proc.completed
+	return proc.state, proc.err
+}
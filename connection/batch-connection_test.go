@@ -0,0 +1,225 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSlurm contains scripts that emulate Slurm
+// commands, running jobs in the background
+// on the local machine.
+var fakeSlurm = map[string]string{
+	"sbatch": `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" > "$dir/sbatch-args"
+for script; do :; done
+out=$(sed -n 's/^#SBATCH --output=//p' "$script")
+err=$(sed -n 's/^#SBATCH --error=//p' "$script")
+setsid sh "$script" > "$out" 2> "$err" < /dev/null &
+echo "$!;fake"
+`,
+	"squeue": `#!/bin/sh
+dir=$(dirname "$0")
+for id; do :; done
+if [ ! -e "$dir/cancelled-$id" ] && kill -0 "$id" 2> /dev/null; then
+	echo RUNNING
+	exit 0
+fi
+echo "slurm_load_jobs error: Invalid job id specified" >&2
+exit 1
+`,
+	"scancel": `#!/bin/sh
+dir=$(dirname "$0")
+touch "$dir/cancelled-$1"
+kill -s TERM -- "-$1"
+`,
+	"sbatch-broken": `#!/bin/sh
+echo "sbatch: error: invalid partition specified" >&2
+exit 1
+`,
+}
+
+func useFakeSlurm(t *testing.T) (string, string) {
+	binDir := t.TempDir()
+	jobsDir := t.TempDir()
+	for name, content := range fakeSlurm {
+		err := ioutil.WriteFile(filepath.Join(binDir, name), []byte(content), os.FileMode(0755))
+		require.NoError(t, err)
+	}
+
+	if config.Hosts == nil {
+		config.Hosts = map[string]*config.Host{}
+	}
+	config.Hosts["localhost"] = &config.Host{Type: config.HostTypeOS}
+	config.Hosts["cluster"] = &config.Host{
+		Type: config.HostTypeSlurm,
+		Options: map[string]interface{}{
+			"jobs-dir":       jobsDir,
+			"submit-command": filepath.Join(binDir, "sbatch"),
+			"status-command": filepath.Join(binDir, "squeue"),
+			"cancel-command": filepath.Join(binDir, "scancel"),
+			"submit-args":    []interface{}{"--partition=short"},
+			"poll-interval":  0.05,
+		},
+	}
+	t.Cleanup(func() {
+		delete(config.Hosts, "cluster")
+		CloseAll()
+	})
+	return binDir, jobsDir
+}
+
+func TestBatchConnection(t *testing.T) {
+	binDir, jobsDir := useFakeSlurm(t)
+	conn, err := FindHost("cluster")
+	require.NoError(t, err)
+	assert.Equal(t, "cluster", conn.Name())
+
+	t.Run("files are read through the transport", func(t *testing.T) {
+		writeFile(t, conn, vpath.New("cluster", jobsDir).Join("file.txt"), "ciao")
+		content, err := ioutil.ReadFile(filepath.Join(jobsDir, "file.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "ciao", string(content))
+	})
+
+	t.Run("Run submits a job", func(t *testing.T) {
+		cwd := t.TempDir()
+		var stdout, stderr bytes.Buffer
+		process, err := conn.Run(vpath.New("cluster", "/bin/sh"), []string{"-c", `echo "$GREETING from $(pwd)"; echo failed >&2; exit 3`}, RunOptions{
+			Cwd:    vpath.New("cluster", cwd),
+			Env:    []string{"GREETING=it's me"},
+			Stdout: &stdout,
+			Stderr: &stderr,
+		})
+		require.NoError(t, err)
+		assert.NotEmpty(t, process.(*BatchProcess).JobID)
+
+		exitCode, err := process.Wait()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, exitCode)
+		assert.Equal(t, "it's me from "+cwd+"\n", stdout.String())
+		assert.Equal(t, "failed\n", stderr.String())
+
+		args, err := ioutil.ReadFile(filepath.Join(binDir, "sbatch-args"))
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(args), "--parsable --partition=short "+jobsDir+"/sh-"))
+	})
+
+	t.Run("Run copies the log files", func(t *testing.T) {
+		logDir := t.TempDir()
+		outLog := vpath.New("cluster", filepath.Join(logDir, "out.log"))
+		errLog := vpath.New("localhost", filepath.Join(logDir, "err.log"))
+		var stdout, stderr bytes.Buffer
+		process, err := conn.Run(vpath.New("cluster", "/bin/sh"), []string{"-c", "echo logged > out.log; echo failed > err.log"}, RunOptions{
+			Cwd:        vpath.New("cluster", logDir),
+			OutFromLog: &outLog,
+			ErrFromLog: &errLog,
+			Stdout:     &stdout,
+			Stderr:     &stderr,
+		})
+		require.NoError(t, err)
+
+		exitCode, err := process.Wait()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, exitCode)
+		assert.Equal(t, "logged\n", stdout.String())
+		assert.Equal(t, "failed\n", stderr.String())
+	})
+
+	t.Run("logs on the host are copied to other processes", func(t *testing.T) {
+		defaultInterval := copyLinesPollInterval
+		copyLinesPollInterval = 50 * time.Millisecond
+		defer func() { copyLinesPollInterval = defaultInterval }()
+
+		logFile := filepath.Join(t.TempDir(), "out.log")
+		outLog := vpath.New("cluster", logFile)
+		reader, writer := io.Pipe()
+		local, err := FindHost("localhost")
+		require.NoError(t, err)
+		process, err := local.Run(vpath.Local("/bin/sh"), []string{"-c", "echo logged > " + logFile}, RunOptions{
+			OutFromLog: &outLog,
+			Stdout:     writer,
+		})
+		require.NoError(t, err)
+
+		lines := make(chan string)
+		go func() {
+			line, _ := bufio.NewReader(reader).ReadString('\n')
+			lines <- line
+		}()
+		select {
+		case line := <-lines:
+			assert.Equal(t, "logged\n", line)
+		case <-time.After(10 * time.Second):
+			t.Fatal("log not copied")
+		}
+		exitCode, err := process.Wait()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, exitCode)
+	})
+
+	t.Run("A job that is killed", func(t *testing.T) {
+		process, err := conn.Run(vpath.New("cluster", "sleep"), []string{"30"}, RunOptions{})
+		require.NoError(t, err)
+
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, process.Kill())
+
+		exitCode, err := process.Wait()
+		assert.NoError(t, err)
+		assert.Equal(t, 128+int(syscall.SIGTERM), exitCode)
+
+		// killing a completed job is a no-op
+		assert.NoError(t, process.Kill())
+	})
+
+	t.Run("A job that cannot be submitted", func(t *testing.T) {
+		conn.(*BatchConnection).submitCommand = filepath.Join(binDir, "sbatch-broken")
+		process, err := conn.Run(vpath.New("cluster", "true"), nil, RunOptions{})
+		assert.Nil(t, process)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid partition specified")
+	})
+}
+
+func TestBatchOptions(t *testing.T) {
+	factory := newBatchConnection(pbsScheduler)
+
+	conn, err := factory(&config.Host{Name: "pbs", Options: map[string]interface{}{"transport": "hpc"}})
+	assert.NoError(t, err)
+	batch := conn.(*BatchConnection)
+	assert.Equal(t, "hpc", batch.transportName)
+	assert.Equal(t, "qsub", batch.submitCommand)
+	assert.Equal(t, "/tmp", batch.jobsDir)
+	assert.Equal(t, 5*time.Second, batch.pollInterval)
+
+	_, err = factory(&config.Host{Name: "pbs", Options: map[string]interface{}{"submit-args": []interface{}{"-q", int64(1)}}})
+	assert.EqualError(t, err, "option `submit-args` of host `pbs` must be a list of strings")
+
+	_, err = factory(&config.Host{Name: "pbs", Options: map[string]interface{}{"transport": "pbs"}})
+	assert.EqualError(t, err, "host `pbs` cannot be the transport of itself")
+}
+
+func TestBatchSchedulers(t *testing.T) {
+	assert.Equal(t, "1234", slurmScheduler.jobID("1234;cluster\n"))
+	assert.True(t, slurmScheduler.active("PENDING\n"))
+	assert.False(t, slurmScheduler.active("COMPLETED\n"))
+	assert.False(t, slurmScheduler.active(""))
+
+	assert.Equal(t, "1234.server", pbsScheduler.jobID("1234.server\n"))
+	assert.True(t, pbsScheduler.active("Job Id: 1234.server\n    job_state = R\n"))
+	assert.False(t, pbsScheduler.active("Job Id: 1234.server\n    job_state = F\n"))
+}
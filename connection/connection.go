@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/meteocima/virtual-server/config"
 	"github.com/meteocima/virtual-server/vpath"
@@ -48,7 +49,26 @@ type RunOptions struct {
 	// If nil, `os.Stderr` will be used.
 	Stderr io.Writer
 
+	// Env contains `NAME=value` environment
+	// variables set for the process, as
+	// indicated by EnvMode.
 	Env []string
+
+	// EnvMode indicates how the environment of
+	// the process is built. Defaults to `EnvMerge`.
+	EnvMode EnvMode
+
+	// UnsetEnv contains the names of environment
+	// variables removed from the environment of
+	// the process.
+	UnsetEnv []string
+
+	// Shell, if true, runs the command through
+	// a POSIX shell, that interprets the command and
+	// its arguments, joined with spaces. Otherwise,
+	// arguments are passed to the command unchanged.
+	// MemoryConnection ignores it.
+	Shell bool
 }
 
 /*
@@ -73,13 +93,18 @@ type Connection interface {
 
 	ReadDir(dir vpath.VirtualPath) (vpath.VirtualPathList, error)
 	Stat(paths ...vpath.VirtualPath) (chan *VirtualFileInfo, chan error)
+	Lstat(paths ...vpath.VirtualPath) (chan *VirtualFileInfo, chan error)
 	Glob(pattern vpath.VirtualPath) (vpath.VirtualPathList, error)
 
 	MkDir(dir vpath.VirtualPath) error
 	RmDir(dir vpath.VirtualPath) error
 	RmFile(file vpath.VirtualPath) error
 
+	Chmod(file vpath.VirtualPath, mode os.FileMode) error
+	Chtimes(file vpath.VirtualPath, atime time.Time, mtime time.Time) error
+
 	Link(source, target vpath.VirtualPath) error
+	ReadLink(link vpath.VirtualPath) (string, error)
 	Run(command vpath.VirtualPath, args []string, options RunOptions) (Process, error)
 
 	SSHPath(vpath.VirtualPath) string
@@ -112,6 +137,31 @@ func (reg *connectionRegistry) Add(name string, cn Connection) {
 	defer reg.connectionsSem.Unlock()
 	reg.connections[name] = cn
 }
+func (reg *connectionRegistry) RemoveAll() []Connection {
+	reg.connectionsSem.Lock()
+	defer reg.connectionsSem.Unlock()
+	all := make([]Connection, 0, len(reg.connections))
+	for _, cn := range reg.connections {
+		all = append(all, cn)
+	}
+	reg.connections = map[string]Connection{}
+	return all
+}
+
+// CloseAll closes all connections opened by
+// `FindHost`, so that subsequent calls open
+// new connections. It returns the first error
+// encountered.
+func CloseAll() error {
+	var firstErr error
+	for _, cn := range connections.RemoveAll() {
+		err := cn.Close()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Close `%s`: %w", cn.Name(), err)
+		}
+	}
+	return firstErr
+}
 
 // NewPath ...
 func NewPath(cn Connection, path string, pathArgs ...interface{}) vpath.VirtualPath {
@@ -126,6 +176,63 @@ type VirtualFileInfo struct {
 	OwnerGroup uint32
 }
 
+// Factory creates the connection to an host
+// of a registered type. The connection is
+// opened by `FindHost`.
+type Factory func(host *config.Host) (Connection, error)
+
+type typeRegistry struct {
+	factories    map[config.HostType]Factory
+	factoriesSem sync.Mutex
+}
+
+var types = typeRegistry{
+	factories:    map[config.HostType]Factory{},
+	factoriesSem: sync.Mutex{},
+}
+
+func (reg *typeRegistry) Get(name config.HostType) (Factory, bool) {
+	reg.factoriesSem.Lock()
+	defer reg.factoriesSem.Unlock()
+	factory, exists := reg.factories[name]
+	return factory, exists
+}
+func (reg *typeRegistry) Add(name config.HostType, factory Factory) {
+	reg.factoriesSem.Lock()
+	defer reg.factoriesSem.Unlock()
+	reg.factories[name] = factory
+}
+
+// RegisterType registers the factory used by
+// `FindHost` to create connections to hosts whose
+// `type` is `name`. Registering a name again
+// replaces its factory.
+func RegisterType(name string, factory Factory) {
+	types.Add(config.HostType(name), factory)
+}
+
+func init() {
+	RegisterType(string(config.HostTypeOS), func(host *config.Host) (Connection, error) {
+		return &LocalConnection{name: host.Name, env: host.Env}, nil
+	})
+	RegisterType(string(config.HostTypeSSH), func(host *config.Host) (Connection, error) {
+		sshConn := newSSHConnection(host.Name, host)
+		jump, err := jumpChain(host.Name, host, nil)
+		if err != nil {
+			return nil, err
+		}
+		sshConn.Jump = jump
+		return sshConn, nil
+	})
+	RegisterType(string(config.HostTypeMemory), func(host *config.Host) (Connection, error) {
+		conn := NewMemoryConnection(host.Name)
+		conn.env = host.Env
+		return conn, nil
+	})
+	RegisterType(string(config.HostTypeSlurm), newBatchConnection(slurmScheduler))
+	RegisterType(string(config.HostTypePBS), newBatchConnection(pbsScheduler))
+}
+
 // FindHost ...
 func FindHost(name string) (Connection, error) {
 
@@ -138,25 +245,25 @@ func FindHost(name string) (Connection, error) {
 		return nil, fmt.Errorf("wrong configuration file \"%s\": unknown host `%s`", config.Filename, name)
 	}
 
-	var cn Connection
+	hostType := host.Type
+	if hostType == "" {
+		hostType = config.HostTypeOS
+	}
+	factory, ok := types.Get(hostType)
+	if !ok {
+		return nil, fmt.Errorf("wrong configuration file \"%s\": unknown connection type `%s` for host `%s`", config.Filename, hostType, name)
+	}
 
-	if host.Type == config.HostTypeOS {
-		cn = &LocalConnection{
-			name: name,
-		}
-	} else if host.Type == config.HostTypeSSH {
-		cn = &SSHConnection{
-			name:    name,
-			Host:    host.Host,
-			Port:    host.Port,
-			User:    host.User,
-			KeyPath: host.Key,
-		}
-	} else {
-		return nil, fmt.Errorf("wrong configuration file \"%s\": unknown connection type %d for host `%s`", config.Filename, host.Type, name)
+	// factories use the name of the host,
+	// that hosts created at runtime could miss.
+	namedHost := *host
+	namedHost.Name = name
+	cn, err := factory(&namedHost)
+	if err != nil {
+		return nil, fmt.Errorf("wrong configuration file \"%s\": %w", config.Filename, err)
 	}
 
-	err := cn.Open()
+	err = cn.Open()
 	if err != nil {
 		return nil, fmt.Errorf("wrong configuration file \"%s\": cannot connect to host `%s`: %w", config.Filename, name, err)
 	}
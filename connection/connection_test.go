@@ -1,13 +1,23 @@
 package connection
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/testutil"
 	"github.com/meteocima/virtual-server/vpath"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
 )
 
 func exists(t *testing.T, conn Connection, file vpath.VirtualPath) bool {
@@ -22,9 +32,9 @@ func exists(t *testing.T, conn Connection, file vpath.VirtualPath) bool {
 	return true
 }
 
-func CheckMkDir(conn Connection) func(t *testing.T) {
+func CheckMkDir(conn Connection, root string) func(t *testing.T) {
 	return func(t *testing.T) {
-		dirPath := vpath.VirtualPath{Path: "/tmp/check-dir"}
+		dirPath := vpath.VirtualPath{Path: root}.Join("check-dir")
 		conn.RmDir(dirPath)
 		assert.False(t, exists(t, conn, dirPath))
 
@@ -38,9 +48,9 @@ func CheckMkDir(conn Connection) func(t *testing.T) {
 	}
 }
 
-func CheckRmDir(conn Connection) func(t *testing.T) {
+func CheckRmDir(conn Connection, root string) func(t *testing.T) {
 	return func(t *testing.T) {
-		dirPath := vpath.VirtualPath{Path: "/tmp/check-dir"}
+		dirPath := vpath.VirtualPath{Path: root}.Join("check-dir")
 		conn.MkDir(dirPath)
 		assert.True(t, exists(t, conn, dirPath))
 
@@ -50,14 +60,14 @@ func CheckRmDir(conn Connection) func(t *testing.T) {
 	}
 }
 
-func CheckStat(conn Connection) func(t *testing.T) {
+func CheckStat(conn Connection, root string) func(t *testing.T) {
 	return func(t *testing.T) {
-		infos, errs := conn.Stat(vpath.VirtualPath{Path: "/tmp"})
+		infos, errs := conn.Stat(vpath.VirtualPath{Path: root})
 		info := <-infos
 		err := <-errs
 
 		assert.NoError(t, err)
-		assert.Equal(t, "tmp", info.Name())
+		assert.Equal(t, filepath.Base(root), info.Name())
 
 		infos, errs = conn.Stat(vpath.VirtualPath{Path: "/timpa/tompa"})
 		info = <-infos
@@ -68,9 +78,38 @@ func CheckStat(conn Connection) func(t *testing.T) {
 	}
 }
 
-func CheckOpenReader(conn Connection) func(t *testing.T) {
+func CheckLink(conn Connection, root string) func(t *testing.T) {
 	return func(t *testing.T) {
-		reader, err := conn.OpenReader(vpath.VirtualPath{Path: "/var/fixtures/ciao.txt"})
+		link := vpath.VirtualPath{Path: root}.Join("check-link")
+		assert.NoError(t, conn.Link(vpath.VirtualPath{Path: "ciao.txt"}, link))
+		defer conn.RmFile(link)
+
+		target, err := conn.ReadLink(link)
+		assert.NoError(t, err)
+		assert.Equal(t, "ciao.txt", target)
+
+		infos, errs := conn.Lstat(link)
+		info := <-infos
+		assert.NoError(t, <-errs)
+		if assert.NotNil(t, info) {
+			assert.True(t, info.Mode()&os.ModeSymlink != 0)
+		}
+
+		infos, errs = conn.Stat(link)
+		info = <-infos
+		assert.NoError(t, <-errs)
+		if assert.NotNil(t, info) {
+			assert.True(t, info.Mode().IsRegular())
+		}
+
+		_, err = conn.ReadLink(vpath.VirtualPath{Path: root}.Join("ciao.txt"))
+		assert.Error(t, err)
+	}
+}
+
+func CheckOpenReader(conn Connection, root string) func(t *testing.T) {
+	return func(t *testing.T) {
+		reader, err := conn.OpenReader(vpath.VirtualPath{Path: root}.Join("ciao.txt"))
 		assert.NoError(t, err)
 		assert.NotNil(t, reader)
 
@@ -90,9 +129,9 @@ func writeFile(t *testing.T, conn Connection, file vpath.VirtualPath, value stri
 	writer.Close()
 }
 
-func CheckReadDir(conn Connection) func(t *testing.T) {
+func CheckReadDir(conn Connection, root string) func(t *testing.T) {
 	return func(t *testing.T) {
-		dir := vpath.VirtualPath{Path: "/var/fixtures/new-dir"}
+		dir := vpath.VirtualPath{Path: root}.Join("new-dir")
 		conn.RmDir(dir)
 		defer conn.RmDir(dir)
 		err := conn.MkDir(dir)
@@ -115,9 +154,9 @@ func CheckReadDir(conn Connection) func(t *testing.T) {
 	}
 }
 
-func CheckRmFile(conn Connection) func(t *testing.T) {
+func CheckRmFile(conn Connection, root string) func(t *testing.T) {
 	return func(t *testing.T) {
-		file := vpath.VirtualPath{Path: "/var/fixtures/somefile"}
+		file := vpath.VirtualPath{Path: root}.Join("somefile")
 		writeFile(t, conn, file, "a test line")
 
 		assert.True(t, exists(t, conn, file))
@@ -129,9 +168,9 @@ func CheckRmFile(conn Connection) func(t *testing.T) {
 	}
 }
 
-func CheckOpenWriter(conn Connection) func(t *testing.T) {
+func CheckOpenWriter(conn Connection, root string) func(t *testing.T) {
 	return func(t *testing.T) {
-		dir := vpath.VirtualPath{Path: "/var/fixtures/tmp"}
+		dir := vpath.VirtualPath{Path: root}.Join("tmp")
 		conn.RmDir(dir)
 		defer conn.RmDir(dir)
 		err := conn.MkDir(dir)
@@ -155,9 +194,9 @@ func CheckOpenWriter(conn Connection) func(t *testing.T) {
 	}
 }
 
-func CheckRun(conn Connection) func(t *testing.T) {
+func CheckRun(conn Connection, root string) func(t *testing.T) {
 	return func(t *testing.T) {
-		fixtures := NewPath(conn, "/var/fixtures/")
+		fixtures := NewPath(conn, root)
 		sOut := "THIS IS A TEST COMMAND\n"
 		sErr := "THIS IS AN ERROR COMMAND\n"
 		t.Run("CombinedOutput", func(t *testing.T) {
@@ -169,7 +208,7 @@ func CheckRun(conn Connection) func(t *testing.T) {
 			processStarted := make(chan int)
 			go func() {
 				var err error
-				process, err = conn.Run(fixtures.Join("testcmd"), []string{"/var/fixtures/"}, RunOptions{
+				process, err = conn.Run(fixtures.Join("testcmd"), []string{root}, RunOptions{
 					Stdout: writer,
 					Stderr: writer,
 				})
@@ -261,6 +300,69 @@ func CheckRun(conn Connection) func(t *testing.T) {
 
 			})
 		*/
+		t.Run("Arguments are passed unchanged", func(t *testing.T) {
+			cwd := fixtures.Join("dir with 'quotes' and $dollar")
+			assert.NoError(t, conn.MkDir(cwd))
+			defer conn.RmDir(cwd)
+
+			args := []string{"with space", "it's", "$HOME", `"double"`, `back\slash`, "*", "", "semi;colon", "new\nline", "$(echo injected)"}
+			var out bytes.Buffer
+			process, err := conn.Run(fixtures.Join("printargs"), args, RunOptions{
+				Cwd:    cwd,
+				Env:    []string{"VS_VALUE=a b'$c"},
+				Stdout: &out,
+			})
+			assert.NoError(t, err)
+			exitCode, err := process.Wait()
+			assert.NoError(t, err)
+			assert.Equal(t, 0, exitCode)
+
+			expected := "[" + cwd.Path + "]\n[a b'$c]\n"
+			for _, arg := range args {
+				expected += "[" + arg + "]\n"
+			}
+			assert.Equal(t, expected, out.String())
+		})
+
+		t.Run("Environment", func(t *testing.T) {
+			os.Setenv("VS_INHERITED", "yes")
+			defer os.Unsetenv("VS_INHERITED")
+
+			printEnv := func(options RunOptions) string {
+				var out bytes.Buffer
+				options.Stdout = &out
+				process, err := conn.Run(NewPath(conn, "/bin/sh"), []string{"-c", `printf '[%s]' "${VS_INHERITED-unset}" "${VS_SET-unset}" "${HOME:+home}"`}, options)
+				assert.NoError(t, err)
+				exitCode, err := process.Wait()
+				assert.NoError(t, err)
+				assert.Equal(t, 0, exitCode)
+				return out.String()
+			}
+
+			assert.Equal(t, "[yes][unset][home]", printEnv(RunOptions{}))
+			assert.Equal(t, "[yes][1][home]", printEnv(RunOptions{Env: []string{"VS_SET=1"}}))
+			assert.Equal(t, "[unset][1][home]", printEnv(RunOptions{Env: []string{"VS_SET=1"}, UnsetEnv: []string{"VS_INHERITED"}}))
+			assert.Equal(t, "[yes][unset][home]", printEnv(RunOptions{Env: []string{"VS_SET=1"}, EnvMode: EnvInherit}))
+			assert.Equal(t, "[unset][unset][home]", printEnv(RunOptions{EnvMode: EnvInherit, UnsetEnv: []string{"VS_INHERITED"}}))
+			assert.Equal(t, "[unset][1][]", printEnv(RunOptions{Env: []string{"VS_SET=1"}, EnvMode: EnvReplace}))
+
+			_, err := conn.Run(NewPath(conn, "/bin/sh"), nil, RunOptions{Env: []string{"NOT A NAME=1"}})
+			assert.Error(t, err)
+		})
+
+		t.Run("Shell interprets the command", func(t *testing.T) {
+			var out bytes.Buffer
+			process, err := conn.Run(NewPath(conn, "echo"), []string{"$((1+2))", "|", "tr", "3", "x"}, RunOptions{
+				Shell:  true,
+				Stdout: &out,
+			})
+			assert.NoError(t, err)
+			exitCode, err := process.Wait()
+			assert.NoError(t, err)
+			assert.Equal(t, 0, exitCode)
+			assert.Equal(t, "x\n", out.String())
+		})
+
 		t.Run("A command that fails", func(t *testing.T) {
 			process, err := conn.Run(NewPath(conn, "false"), nil, RunOptions{})
 			assert.NotNil(t, process)
@@ -270,39 +372,224 @@ func CheckRun(conn Connection) func(t *testing.T) {
 			assert.Equal(t, 1, exitCode)
 
 		})
+
+		t.Run("A command that is killed", func(t *testing.T) {
+			process, err := conn.Run(NewPath(conn, "sleep"), []string{"30"}, RunOptions{})
+			assert.NotNil(t, process)
+			assert.NoError(t, err)
+
+			time.Sleep(100 * time.Millisecond)
+			assert.NoError(t, process.Kill())
+
+			exitCode, err := process.Wait()
+			assert.NoError(t, err)
+			assert.Equal(t, 128+int(syscall.SIGTERM), exitCode)
+
+			// killing a completed process is a no-op
+			assert.NoError(t, process.Kill())
+		})
+
+		t.Run("A command that forks is killed with its children", func(t *testing.T) {
+			defaultGracePeriod := killGracePeriod
+			killGracePeriod = 200 * time.Millisecond
+			defer func() { killGracePeriod = defaultGracePeriod }()
+
+			// the output is copied until all
+			// processes that share it terminate.
+			var stdout bytes.Buffer
+			process, err := conn.Run(NewPath(conn, "/bin/sh"), []string{"-c", "sleep 30; echo done"}, RunOptions{
+				Stdout: &stdout,
+			})
+			assert.NotNil(t, process)
+			assert.NoError(t, err)
+
+			time.Sleep(100 * time.Millisecond)
+			start := time.Now()
+			assert.NoError(t, process.Kill())
+			assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+			_, err = process.Wait()
+			assert.NoError(t, err)
+			assert.Equal(t, "", stdout.String())
+		})
+
+		t.Run("A command that ignores SIGTERM", func(t *testing.T) {
+			defaultGracePeriod := killGracePeriod
+			killGracePeriod = 200 * time.Millisecond
+			defer func() { killGracePeriod = defaultGracePeriod }()
+
+			outReader, writer := io.Pipe()
+			process, err := conn.Run(fixtures.Join("ignoreterm"), nil, RunOptions{
+				Stdout: writer,
+			})
+			assert.NotNil(t, process)
+			assert.NoError(t, err)
+
+			// wait for the trap to be installed
+			line, err := bufio.NewReader(outReader).ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "ready\n", line)
+
+			assert.NoError(t, process.Kill())
+
+			exitCode, err := process.Wait()
+			assert.NoError(t, err)
+			assert.Equal(t, 128+int(syscall.SIGKILL), exitCode)
+		})
 	}
 }
 
-func DoAllChecks(t *testing.T, conn Connection) {
-	t.Run("CheckStat", CheckStat(conn))
-	t.Run("CheckMkDir", CheckMkDir(conn))
-	t.Run("CheckRmDir", CheckRmDir(conn))
-	t.Run("CheckOpenReader", CheckOpenReader(conn))
-	t.Run("CheckOpenWriter", CheckOpenWriter(conn))
-	t.Run("CheckRmFile", CheckRmFile(conn))
-	t.Run("CheckReadDir", CheckReadDir(conn))
-	t.Run("CheckRun", CheckRun(conn))
+func DoAllChecks(t *testing.T, conn Connection, root string) {
+	t.Run("CheckStat", CheckStat(conn, root))
+	t.Run("CheckMkDir", CheckMkDir(conn, root))
+	t.Run("CheckRmDir", CheckRmDir(conn, root))
+	t.Run("CheckOpenReader", CheckOpenReader(conn, root))
+	t.Run("CheckOpenWriter", CheckOpenWriter(conn, root))
+	t.Run("CheckRmFile", CheckRmFile(conn, root))
+	t.Run("CheckLink", CheckLink(conn, root))
+	t.Run("CheckReadDir", CheckReadDir(conn, root))
+	t.Run("CheckRun", CheckRun(conn, root))
 }
 
 func TestLocalHost(t *testing.T) {
+	root := t.TempDir()
+	testutil.CopyFixtures(t, root)
+
 	osConn := LocalConnection{}
 	err := osConn.Open()
 	assert.NoError(t, err)
-	DoAllChecks(t, &osConn)
-	t.Run("CheckStat", CheckStat(&osConn))
+	DoAllChecks(t, &osConn, root)
 	assert.NoError(t, osConn.Close())
 }
 
 func TestSSH(t *testing.T) {
-	conn := SSHConnection{
-		Host:    "localhost",
-		Port:    2222,
-		User:    "andrea.parodi",
-		KeyPath: "/var/fixtures/private-key",
+	srv := testutil.NewSSHServer(t)
+	testutil.CopyFixtures(t, srv.Dir)
+
+	conn := newSSHConnection("testserver", srv.Host("testserver"))
+	err := conn.Open()
+	if !assert.NoError(t, err) {
+		return
 	}
+	DoAllChecks(t, conn, srv.Dir)
 
+	t.Run("CheckReconnect", func(t *testing.T) {
+		dropped := conn.SSHClient()
+		// simulate a network failure
+		srv.DropConnections()
+
+		assert.True(t, exists(t, conn, vpath.VirtualPath{Path: srv.Dir}))
+		assert.NotSame(t, dropped, conn.SSHClient())
+
+		files, err := conn.ReadDir(vpath.VirtualPath{Path: srv.Dir})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, files)
+	})
+
+	t.Run("CheckReconnectDoesNotBlockClients", func(t *testing.T) {
+		// makes the next dial block until released.
+		dialing := make(chan struct{})
+		release := make(chan struct{})
+		hostKeyCallback := conn.config.HostKeyCallback
+		conn.config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			close(dialing)
+			<-release
+			return hostKeyCallback(hostname, remote, key)
+		}
+		defer func() { conn.config.HostKeyCallback = hostKeyCallback }()
+
+		dropped := conn.SSHClient()
+		srv.DropConnections()
+		reconnected := make(chan error, 1)
+		go func() { reconnected <- conn.reconnect(dropped) }()
+		<-dialing
+
+		clientReturned := make(chan *ssh.Client, 1)
+		go func() { clientReturned <- conn.SSHClient() }()
+		select {
+		case client := <-clientReturned:
+			assert.Same(t, dropped, client)
+		case <-time.After(5 * time.Second):
+			t.Error("SSHClient blocked while reconnecting")
+		}
+
+		close(release)
+		assert.NoError(t, <-reconnected)
+		assert.NotSame(t, dropped, conn.SSHClient())
+		assert.True(t, exists(t, conn, vpath.VirtualPath{Path: srv.Dir}))
+	})
+
+	t.Run("CheckSFTPPool", func(t *testing.T) {
+		stats := conn.SFTPPoolStats()
+		assert.Equal(t, 0, stats.InUse)
+		assert.LessOrEqual(t, stats.Idle, DefaultSFTPPoolSize)
+		assert.Greater(t, stats.Reused, stats.Created)
+	})
+
+	assert.NoError(t, conn.Close())
+}
+
+func TestSSHUnknownHostKey(t *testing.T) {
+	srv := testutil.NewSSHServer(t)
+	host := srv.Host("testserver")
+	host.KnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+	assert.NoError(t, ioutil.WriteFile(host.KnownHosts, nil, 0600))
+
+	conn := newSSHConnection("testserver", host)
 	err := conn.Open()
-	assert.NoError(t, err)
-	DoAllChecks(t, &conn)
+
+	var hostKeyErr *HostKeyError
+	if assert.True(t, errors.As(err, &hostKeyErr)) {
+		assert.Equal(t, "testserver", hostKeyErr.Host)
+		assert.False(t, hostKeyErr.Mismatch)
+	}
+}
+
+func TestSSHJumpHost(t *testing.T) {
+	bastion := testutil.NewSSHServer(t)
+	target := testutil.NewSSHServer(t)
+	testutil.CopyFixtures(t, target.Dir)
+
+	conn := newSSHConnection("target", target.Host("target"))
+	conn.Jump = newSSHConnection("bastion", bastion.Host("bastion"))
+	err := conn.Open()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, exists(t, conn, vpath.VirtualPath{Path: target.Dir}.Join("ciao.txt")))
+	t.Run("CheckRun", CheckRun(conn, target.Dir))
+
 	assert.NoError(t, conn.Close())
 }
+
+func TestRegisterType(t *testing.T) {
+	defer CloseAll()
+	defer delete(config.Hosts, "custom")
+	defer delete(config.Hosts, "unknown")
+
+	if config.Hosts == nil {
+		config.Hosts = map[string]*config.Host{}
+	}
+
+	var received *config.Host
+	RegisterType("custom", func(host *config.Host) (Connection, error) {
+		received = host
+		return NewMemoryConnection(host.Name), nil
+	})
+
+	config.Hosts["custom"] = &config.Host{
+		Type:    "custom",
+		Options: map[string]interface{}{"queue": "short"},
+	}
+	conn, err := FindHost("custom")
+	assert.NoError(t, err)
+	assert.IsType(t, &MemoryConnection{}, conn)
+	assert.Equal(t, "custom", conn.Name())
+	assert.Equal(t, "short", received.Options["queue"])
+
+	config.Hosts["unknown"] = &config.Host{Type: "teleport"}
+	_, err = FindHost("unknown")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown connection type `teleport` for host `unknown`")
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"time"
@@ -51,15 +52,15 @@ func copyLines(proc Process, w io.Writer, outLogFile vpath.VirtualPath) {
 
 	if c, ok := cn.(*SSHConnection); ok {
 
-		conn := c.client
+		conn := c.SSHClient()
 
 		cmd, err := conn.NewSession()
 		if err != nil {
-			panic(fmt.Errorf("copyLines to log from %s: conn.client.NewSession: %w", outLogFile.String(), err))
+			panic(fmt.Errorf("copyLines to log from %s: client.NewSession: %w", outLogFile.String(), err))
 		}
 		defer cmd.Close()
 
-		cmdStr := fmt.Sprintf("tail -F '%s'", outLogFile.Path)
+		cmdStr := "tail -F " + ShellQuote(outLogFile.Path)
 
 		out, err := cmd.StdoutPipe()
 		if err != nil {
@@ -74,14 +75,16 @@ func copyLines(proc Process, w io.Writer, outLogFile vpath.VirtualPath) {
 		go func() {
 			_, err := io.Copy(w, out)
 			if err != nil {
-				panic(fmt.Errorf("copyLines to log from %s: io.Copy: %w", outLogFile.String(), err))
+				fmt.Fprintf(os.Stderr, "WARNING: copyLines from `%s`: io.Copy: %s\n", outLogFile.String(), err.Error())
 			}
 		}()
 
 		go func() {
 			_, err := proc.Wait()
 			if err != nil {
-				panic(fmt.Errorf("copyLines to log from %s: proc.Wait: %w", outLogFile.String(), err))
+				// the process status is unknown, but
+				// the tail must be stopped anyway.
+				fmt.Fprintf(os.Stderr, "WARNING: copyLines from `%s`: proc.Wait: %s\n", outLogFile.String(), err.Error())
 			}
 			/*err =*/ cmd.Signal(ssh.SIGKILL)
 			/*if err != nil {
@@ -109,14 +112,16 @@ func copyLines(proc Process, w io.Writer, outLogFile vpath.VirtualPath) {
 		go func() {
 			_, err := io.Copy(w, out)
 			if err != nil {
-				panic(fmt.Errorf("copyLines to log from %s: io.Copy: %w", outLogFile.String(), err))
+				fmt.Fprintf(os.Stderr, "WARNING: copyLines from `%s`: io.Copy: %s\n", outLogFile.String(), err.Error())
 			}
 		}()
 
 		go func() {
 			_, err := proc.Wait()
 			if err != nil {
-				panic(fmt.Errorf("copyLines to log from %s: proc.Wait: %w", outLogFile.String(), err))
+				// the process status is unknown, but
+				// the tail must be stopped anyway.
+				fmt.Fprintf(os.Stderr, "WARNING: copyLines from `%s`: proc.Wait: %s\n", outLogFile.String(), err.Error())
 			}
 			/*err =*/ cmd.Process.Kill()
 			/*if err != nil {
@@ -127,6 +132,85 @@ func copyLines(proc Process, w io.Writer, outLogFile vpath.VirtualPath) {
 		return
 	}
 
-	panic("Unknown connection type")
+	if c, ok := cn.(*MemoryConnection); ok {
+		go c.tail(proc, w, outLogFile.Path)
+		return
+	}
+
+	// other connection types, such as batch schedulers
+	// or types added with `RegisterType`, are polled.
+	followLog(proc, cn, w, outLogFile)
+}
+
+// copyLinesPollInterval is the time between two reads
+// of a log file done by `followLog`.
+var copyLinesPollInterval = time.Second
+
+// followLog copies to `w` the content of `outLogFile`,
+// read through `cn`, until `proc` completes.
+func followLog(proc Process, cn Connection, w io.Writer, outLogFile vpath.VirtualPath) {
+	completed := make(chan struct{})
+	go func() {
+		proc.Wait()
+		close(completed)
+	}()
+
+	follower := &fileFollower{conn: cn, file: outLogFile, w: w}
+	for {
+		done := awaitCompletion(completed, copyLinesPollInterval)
+		// read once more after completion, to
+		// copy the last lines of the log.
+		err := follower.follow()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: copyLines from `%s`: %s\n", outLogFile.String(), err.Error())
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// fileFollower copies to a writer the content
+// appended to a file, reading it through any
+// connection type.
+type fileFollower struct {
+	conn   Connection
+	file   vpath.VirtualPath
+	w      io.Writer
+	offset int64
+}
 
+// follow copies the content appended to the file
+// since its previous call. A missing file is not an
+// error, since it could still have to be created.
+func (f *fileFollower) follow() error {
+	reader, err := f.conn.OpenReader(f.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("follow `%s`: OpenReader: %w", f.file.String(), err)
+	}
+	defer reader.Close()
+
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err = seeker.Seek(f.offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, reader, f.offset)
+	}
+	if err == io.EOF {
+		// the file was truncated
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("follow `%s`: seek: %w", f.file.String(), err)
+	}
+
+	n, err := io.Copy(f.w, reader)
+	f.offset += n
+	if err != nil {
+		return fmt.Errorf("follow `%s`: io.Copy: %w", f.file.String(), err)
+	}
+	return nil
 }
@@ -0,0 +1,356 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// DefaultDetachedDir is the directory where the state
+// of detached processes is kept, on hosts that don't
+// set the `detached-dir` option.
+var DefaultDetachedDir = "/tmp/virtual-server-detached"
+
+// detachedPollInterval is the time between
+// two checks of the state of a detached process.
+var detachedPollInterval = 2 * time.Second
+
+// DetachedProcess is a process that runs in its own
+// session on the host, so that it survives the connection
+// that started it. Its pid, output and exit code are
+// written to files in a directory named as its ID,
+// together with its start time, used to recognize its
+// pid when reused, and a `killed` marker written by `Kill`,
+// so that it can be attached again later, even by
+// another program.
+type DetachedProcess struct {
+	// ID identifies the process on its host.
+	ID string
+
+	conn    Connection
+	dir     string
+	pid     int
+	started string
+
+	pollOnce  *sync.Once
+	completed chan struct{}
+	state     int
+	err       error
+}
+
+// detachedDir returns the directory that contains
+// the state of detached processes of `conn`.
+func detachedDir(conn Connection) string {
+	if host, ok := config.Hosts[conn.Name()]; ok {
+		if dir, ok := host.Options["detached-dir"].(string); ok {
+			return dir
+		}
+	}
+	return DefaultDetachedDir
+}
+
+// detachedScript starts the command given as arguments
+// in a new session, writing its pid, start time, output and
+// exit code in the directory given as first argument, and
+// returns when the pid has been written. When the process
+// cannot be started, it fails printing its stderr.
+const detachedScript = `dir=$1
+shift
+mkdir -p "$dir" || exit 1
+nohup setsid /bin/sh -c '
+	ps -o lstart= -p $$ > "$0/started" 2> /dev/null
+	echo $$ > "$0/pid.tmp" && mv "$0/pid.tmp" "$0/pid"
+	"$@"
+	code=$?
+	echo $code > "$0/exit.tmp" && mv "$0/exit.tmp" "$0/exit"
+' "$dir" "$@" > "$dir/stdout" 2> "$dir/stderr" < /dev/null &
+job=$!
+while [ ! -e "$dir/pid" ]; do
+	if ! kill -0 $job 2> /dev/null && [ ! -e "$dir/pid" ]; then
+		cat "$dir/stderr" >&2
+		exit 1
+	fi
+	sleep 0.1
+done
+`
+
+// detachedCounter makes ids unique when
+// processes are started in the same instant.
+var detachedCounter int64
+
+// RunDetached starts `command` on its host as a
+// DetachedProcess. The work directory and environment
+// of the process are set as in `Run`, while its stdin,
+// stdout and stderr options are ignored: stdin is empty,
+// output is written to log files that `Tail` copies.
+func RunDetached(command vpath.VirtualPath, args []string, options RunOptions) (*DetachedProcess, error) {
+	conn, err := FindHost(command.Host)
+	if err != nil {
+		return nil, fmt.Errorf("RunDetached `%s`: FindHost: %w", command.String(), err)
+	}
+
+	id := fmt.Sprintf("%s-%d-%d-%d", path.Base(command.Path), time.Now().UnixNano(), os.Getpid(), atomic.AddInt64(&detachedCounter, 1))
+	dir := path.Join(detachedDir(conn), id)
+
+	var stderr bytes.Buffer
+	launcher, err := conn.Run(NewPath(conn, "/bin/sh"), append([]string{"-c", detachedScript, "sh", dir, command.Path}, args...), RunOptions{
+		Cwd:      options.Cwd,
+		Env:      options.Env,
+		EnvMode:  options.EnvMode,
+		UnsetEnv: options.UnsetEnv,
+		Stdin:    strings.NewReader(""),
+		Stdout:   ioutil.Discard,
+		Stderr:   &stderr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("RunDetached `%s`: %w", command.String(), err)
+	}
+	code, err := launcher.Wait()
+	if err == nil && code != 0 {
+		err = fmt.Errorf("launcher exited with code %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("RunDetached `%s`: %w", command.String(), err)
+	}
+
+	return Attach(conn, id)
+}
+
+// Attach returns the DetachedProcess with
+// the given `id` started on `conn`.
+func Attach(conn Connection, id string) (*DetachedProcess, error) {
+	proc := &DetachedProcess{
+		ID:        id,
+		conn:      conn,
+		dir:       path.Join(detachedDir(conn), id),
+		pollOnce:  &sync.Once{},
+		completed: make(chan struct{}),
+	}
+
+	content, err := proc.readFile("pid")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Attach `%s`: no detached process with this id on host `%s`", id, conn.Name())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Attach `%s`: %w", id, err)
+	}
+	proc.pid, err = strconv.Atoi(strings.TrimSpace(content))
+	if err != nil {
+		return nil, fmt.Errorf("Attach `%s`: wrong pid file: %w", id, err)
+	}
+	// the start time is missing when `ps`
+	// doesn't support it: only the pid is checked.
+	content, err = proc.readFile("started")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Attach `%s`: %w", id, err)
+	}
+	proc.started = strings.Join(strings.Fields(content), " ")
+	return proc, nil
+}
+
+// Pid returns the pid of the process on its host.
+func (proc *DetachedProcess) Pid() int {
+	return proc.pid
+}
+
+func (proc *DetachedProcess) file(name string) vpath.VirtualPath {
+	return NewPath(proc.conn, path.Join(proc.dir, name))
+}
+
+func (proc *DetachedProcess) readFile(name string) (string, error) {
+	reader, err := proc.conn.OpenReader(proc.file(name))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	return string(content), err
+}
+
+// exitCode reads the exit code
+// written when the process completes.
+func (proc *DetachedProcess) exitCode() (int, bool) {
+	content, err := proc.readFile("exit")
+	if err != nil {
+		return 0, false
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(content))
+	return code, err == nil
+}
+
+// runShell runs a shell command on the host of the
+// process, and returns its exit code and stdout.
+func (proc *DetachedProcess) runShell(script string) (int, string, error) {
+	var stdout bytes.Buffer
+	p, err := proc.conn.Run(NewPath(proc.conn, "/bin/sh"), []string{"-c", script}, RunOptions{
+		Stdin:  strings.NewReader(""),
+		Stdout: &stdout,
+		Stderr: ioutil.Discard,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	code, err := p.Wait()
+	return code, stdout.String(), err
+}
+
+// alive returns whether the process is still running.
+// Zombie processes are not running, even if they
+// haven't been reaped yet, and neither is a process
+// that reused the pid, started at another time.
+func (proc *DetachedProcess) alive() (bool, error) {
+	code, out, err := proc.runShell(fmt.Sprintf("ps -o state= -o lstart= -p %d", proc.pid))
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(out)
+	if code != 0 || len(fields) == 0 || strings.HasPrefix(fields[0], "Z") {
+		return false, nil
+	}
+	return proc.started == "" || strings.Join(fields[1:], " ") == proc.started, nil
+}
+
+// poll checks the state of the process every
+// `detachedPollInterval`, until it completes. A process that
+// terminated without writing its exit code has been killed:
+// its exit code is 143 (SIGTERM) when killed with `Kill`,
+// by any handle, 137 (SIGKILL) otherwise.
+func (proc *DetachedProcess) poll() {
+	complete := func(state int, err error) {
+		proc.state = state
+		proc.err = err
+		close(proc.completed)
+	}
+
+	for {
+		if code, ok := proc.exitCode(); ok {
+			complete(code, nil)
+			return
+		}
+
+		alive, err := proc.alive()
+		if err != nil {
+			complete(-1, fmt.Errorf("Wait `%s`: %w", proc.ID, err))
+			return
+		}
+		if !alive {
+			// the process could have written its
+			// exit code after the previous check.
+			if code, ok := proc.exitCode(); ok {
+				complete(code, nil)
+			} else if _, err := proc.readFile("killed"); err == nil {
+				complete(128+int(syscall.SIGTERM), nil)
+			} else {
+				complete(128+int(syscall.SIGKILL), nil)
+			}
+			return
+		}
+
+		time.Sleep(detachedPollInterval)
+	}
+}
+
+func (proc *DetachedProcess) startPolling() {
+	proc.pollOnce.Do(func() {
+		go proc.poll()
+	})
+}
+
+// Wait waits for the process to complete
+// and returns its exit code.
+func (proc *DetachedProcess) Wait() (int, error) {
+	proc.startPolling()
+	<-proc.completed
+	return proc.state, proc.err
+}
+
+// Kill sends a SIGTERM signal to the process group of
+// the process and, if it's still running after
+// `killGracePeriod`, a SIGKILL one. It returns when
+// the process terminated. Killing an already
+// completed process is a no-op.
+func (proc *DetachedProcess) Kill() error {
+	proc.startPolling()
+	if awaitCompletion(proc.completed, 0) {
+		return nil
+	}
+
+	_, _, err := proc.runShell(fmt.Sprintf("touch %s && kill -s TERM -- -%d", ShellQuote(path.Join(proc.dir, "killed")), proc.pid))
+	if err != nil {
+		return fmt.Errorf("Kill `%s`: %w", proc.ID, err)
+	}
+	if awaitCompletion(proc.completed, killGracePeriod+detachedPollInterval) {
+		return nil
+	}
+
+	_, _, err = proc.runShell(fmt.Sprintf("kill -s KILL -- -%d", proc.pid))
+	if err != nil {
+		return fmt.Errorf("Kill `%s`: %w", proc.ID, err)
+	}
+	<-proc.completed
+	return nil
+}
+
+// Tail copies to `stdout` and `stderr` the output of the
+// process, from its start, until the process completes.
+func (proc *DetachedProcess) Tail(stdout, stderr io.Writer) error {
+	proc.startPolling()
+	followers := []*fileFollower{
+		{conn: proc.conn, file: proc.file("stdout"), w: stdout},
+		{conn: proc.conn, file: proc.file("stderr"), w: stderr},
+	}
+	follow := func() error {
+		for _, follower := range followers {
+			err := follower.follow()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for !awaitCompletion(proc.completed, detachedPollInterval) {
+		err := follow()
+		if err != nil {
+			return err
+		}
+	}
+	return follow()
+}
+
+// Remove removes the files of a completed
+// process, that cannot be attached anymore.
+func (proc *DetachedProcess) Remove() error {
+	if !awaitCompletion(proc.completed, 0) {
+		return fmt.Errorf("Remove `%s`: the process is still running", proc.ID)
+	}
+	// RmDir is not recursive on all connections.
+	files, err := proc.conn.ReadDir(NewPath(proc.conn, proc.dir))
+	if err != nil {
+		return fmt.Errorf("Remove `%s`: %w", proc.ID, err)
+	}
+	for _, file := range files {
+		err := proc.conn.RmFile(file)
+		if err != nil {
+			return fmt.Errorf("Remove `%s`: %w", proc.ID, err)
+		}
+	}
+	err = proc.conn.RmDir(NewPath(proc.conn, proc.dir))
+	if err != nil {
+		return fmt.Errorf("Remove `%s`: %w", proc.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package connection
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/testutil"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func useFastDetachedPolling(t *testing.T) {
+	interval := detachedPollInterval
+	detachedPollInterval = 50 * time.Millisecond
+	t.Cleanup(func() { detachedPollInterval = interval })
+}
+
+// CheckDetached runs detached processes on `hostName`, and
+// attaches them again with the connections returned by `reconnect`.
+func CheckDetached(hostName string, reconnect func(t *testing.T) Connection) func(t *testing.T) {
+	return func(t *testing.T) {
+		sh := vpath.VirtualPath{Host: hostName, Path: "/bin/sh"}
+
+		t.Run("Wait returns the exit code", func(t *testing.T) {
+			proc, err := RunDetached(sh, []string{"-c", "echo out; echo err >&2; echo $VS_VALUE; exit 3"}, RunOptions{
+				Env: []string{"VS_VALUE=from env"},
+			})
+			require.NoError(t, err)
+			assert.Greater(t, proc.Pid(), 0)
+
+			attached, err := Attach(reconnect(t), proc.ID)
+			require.NoError(t, err)
+			assert.Equal(t, proc.Pid(), attached.Pid())
+
+			var stdout, stderr bytes.Buffer
+			assert.NoError(t, attached.Tail(&stdout, &stderr))
+			assert.Equal(t, "out\nfrom env\n", stdout.String())
+			assert.Equal(t, "err\n", stderr.String())
+
+			code, err := attached.Wait()
+			assert.NoError(t, err)
+			assert.Equal(t, 3, code)
+
+			assert.NoError(t, attached.Remove())
+			_, err = Attach(reconnect(t), proc.ID)
+			assert.Error(t, err)
+		})
+
+		t.Run("Kill terminates the process", func(t *testing.T) {
+			proc, err := RunDetached(sh, []string{"-c", "sleep 30"}, RunOptions{})
+			require.NoError(t, err)
+
+			attached, err := Attach(reconnect(t), proc.ID)
+			require.NoError(t, err)
+			assert.Error(t, attached.Remove())
+			assert.NoError(t, attached.Kill())
+
+			code, err := attached.Wait()
+			assert.NoError(t, err)
+			assert.Equal(t, 143, code)
+
+			// the original handle sees the process completed.
+			code, err = proc.Wait()
+			assert.NoError(t, err)
+			assert.Equal(t, 143, code)
+			assert.NoError(t, proc.Remove())
+		})
+
+		t.Run("a reused pid is not the process", func(t *testing.T) {
+			proc, err := RunDetached(sh, []string{"-c", "sleep 30"}, RunOptions{})
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, proc.Kill())
+				assert.NoError(t, proc.Remove())
+			}()
+
+			// another process started at another time
+			// with the same pid.
+			conn := reconnect(t)
+			w, err := conn.OpenWriter(NewPath(conn, path.Join(proc.dir, "started")))
+			require.NoError(t, err)
+			_, err = w.Write([]byte("Thu Jan  1 00:00:00 1970\n"))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			attached, err := Attach(conn, proc.ID)
+			require.NoError(t, err)
+			code, err := attached.Wait()
+			assert.NoError(t, err)
+			assert.Equal(t, 137, code)
+		})
+
+		t.Run("Attach fails with unknown ids", func(t *testing.T) {
+			_, err := Attach(reconnect(t), "unknown")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDetachedLocalHost(t *testing.T) {
+	useFastDetachedPolling(t)
+	if config.Hosts == nil {
+		config.Hosts = map[string]*config.Host{}
+	}
+	config.Hosts["localhost"] = &config.Host{
+		Type:    config.HostTypeOS,
+		Options: map[string]interface{}{"detached-dir": t.TempDir()},
+	}
+	t.Cleanup(func() {
+		config.Hosts["localhost"] = &config.Host{Type: config.HostTypeOS}
+		CloseAll()
+	})
+
+	CheckDetached("localhost", func(t *testing.T) Connection {
+		return &LocalConnection{name: "localhost"}
+	})(t)
+
+	t.Run("RunDetached fails when the process cannot start", func(t *testing.T) {
+		// a PATH with all commands used by the launcher but `setsid`.
+		bin := t.TempDir()
+		for _, name := range []string{"mkdir", "nohup", "sleep", "cat"} {
+			target, err := exec.LookPath(name)
+			require.NoError(t, err)
+			require.NoError(t, os.Symlink(target, filepath.Join(bin, name)))
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := RunDetached(vpath.Local("/bin/true"), nil, RunOptions{
+				Env: []string{"PATH=" + bin},
+			})
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "setsid")
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("RunDetached didn't return")
+		}
+	})
+}
+
+func TestDetachedSSH(t *testing.T) {
+	useFastDetachedPolling(t)
+	srv := testutil.NewSSHServer(t)
+	host := srv.Host("testserver")
+	host.Options = map[string]interface{}{"detached-dir": t.TempDir()}
+	if config.Hosts == nil {
+		config.Hosts = map[string]*config.Host{}
+	}
+	config.Hosts["testserver"] = host
+	t.Cleanup(func() {
+		delete(config.Hosts, "testserver")
+		CloseAll()
+	})
+
+	CheckDetached("testserver", func(t *testing.T) Connection {
+		// processes survive the connections
+		// that started or attached them.
+		srv.DropConnections()
+		conn := newSSHConnection("testserver", host)
+		require.NoError(t, conn.Open())
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	})(t)
+}
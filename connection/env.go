@@ -0,0 +1,172 @@
+package connection
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EnvMode indicates how the environment of a
+// process is built from the environment it
+// inherits, the default environment of the
+// host and `RunOptions.Env`.
+//
+// The inherited environment is the one of the
+// current process for local hosts, and the login
+// environment of the user for SSH hosts. Variables
+// in `RunOptions.UnsetEnv` are removed in all modes.
+type EnvMode int
+
+const (
+	// EnvMerge adds the default environment of the
+	// host, and then `RunOptions.Env`, to the inherited
+	// environment. It's the default mode.
+	EnvMerge EnvMode = iota
+
+	// EnvInherit uses the inherited environment
+	// unchanged, ignoring the default environment
+	// of the host and `RunOptions.Env`.
+	EnvInherit
+
+	// EnvReplace uses only the default environment
+	// of the host and `RunOptions.Env`, without
+	// inheriting any variable.
+	EnvReplace
+)
+
+// envName returns the name of
+// a `NAME=value` variable.
+func envName(variable string) string {
+	return strings.SplitN(variable, "=", 2)[0]
+}
+
+// checkEnv returns an error if `variables`
+// are not valid `NAME=value` variables.
+func checkEnv(variables []string) error {
+	for _, variable := range variables {
+		if !strings.Contains(variable, "=") || !isShellName(envName(variable)) {
+			return fmt.Errorf("invalid environment variable `%s`", variable)
+		}
+	}
+	return nil
+}
+
+// checkEnvNames returns an error if `names`
+// are not valid environment variable names.
+func checkEnvNames(names []string) error {
+	for _, name := range names {
+		if !isShellName(name) {
+			return fmt.Errorf("invalid environment variable name `%s`", name)
+		}
+	}
+	return nil
+}
+
+// envAssignments returns the variables that `options`
+// set on a host with default environment `hostEnv`, except
+// the unset ones. Later variables override earlier ones.
+func envAssignments(hostEnv []string, options RunOptions) ([]string, error) {
+	err := checkEnvNames(options.UnsetEnv)
+	if err != nil {
+		return nil, err
+	}
+	if options.EnvMode == EnvInherit {
+		return nil, nil
+	}
+	variables := append(append([]string{}, hostEnv...), options.Env...)
+	err = checkEnv(variables)
+	if err != nil {
+		return nil, err
+	}
+	return mergeEnv(nil, variables, options.UnsetEnv), nil
+}
+
+// mergeEnv returns `base` with `variables` added, and
+// `unset` removed. A variable replaces the one with
+// the same name, keeping its position.
+func mergeEnv(base []string, variables []string, unset []string) []string {
+	removed := map[string]bool{}
+	for _, name := range unset {
+		removed[name] = true
+	}
+
+	result := []string{}
+	positions := map[string]int{}
+	for _, variable := range append(append([]string{}, base...), variables...) {
+		name := envName(variable)
+		if removed[name] {
+			continue
+		}
+		if i, exists := positions[name]; exists {
+			result[i] = variable
+			continue
+		}
+		positions[name] = len(result)
+		result = append(result, variable)
+	}
+	return result
+}
+
+// environment returns the environment of a process
+// started with `options` on a host with default
+// environment `hostEnv`, that would otherwise
+// inherit the `inherited` environment.
+func environment(inherited []string, hostEnv []string, options RunOptions) ([]string, error) {
+	variables, err := envAssignments(hostEnv, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.EnvMode == EnvReplace {
+		return variables, nil
+	}
+	return mergeEnv(inherited, variables, options.UnsetEnv), nil
+}
+
+// shellCommand returns the shell command that runs
+// `command` with `args` in the work directory and
+// environment of `options`, on a host with default
+// environment `hostEnv`.
+func shellCommand(command string, args []string, options RunOptions, hostEnv []string) (string, error) {
+	variables, err := envAssignments(hostEnv, options)
+	if err != nil {
+		return "", err
+	}
+
+	commandLine := shellCommandLine(command, args, options.Shell)
+	if options.EnvMode == EnvReplace {
+		// `env -i` starts the command with only the
+		// given variables, so a shell command line
+		// is run by a new shell.
+		envArgs := []string{"-i"}
+		for _, variable := range variables {
+			envArgs = append(envArgs, ShellQuote(variable))
+		}
+		if options.Shell {
+			commandLine = fmt.Sprintf("env %s /bin/sh -c %s", strings.Join(envArgs, " "), ShellQuote(commandLine))
+		} else {
+			commandLine = fmt.Sprintf("env %s %s", strings.Join(envArgs, " "), commandLine)
+		}
+	}
+
+	// the command replaces the shell, unless it
+	// must be interpreted by the shell itself.
+	if !options.Shell || options.EnvMode == EnvReplace {
+		commandLine = "exec " + commandLine
+	}
+
+	statements := []string{}
+	if options.EnvMode != EnvReplace && len(options.UnsetEnv) > 0 {
+		statements = append(statements, "unset "+strings.Join(options.UnsetEnv, " "))
+	}
+	if options.EnvMode == EnvMerge && len(variables) > 0 {
+		export, err := shellExport(variables)
+		if err != nil {
+			return "", err
+		}
+		statements = append(statements, export)
+	}
+	if options.Cwd.Path != "" {
+		statements = append(statements, fmt.Sprintf("cd %s || exit 1", ShellQuote(options.Cwd.Path)))
+	}
+	statements = append(statements, commandLine)
+	return strings.Join(statements, "; "), nil
+}
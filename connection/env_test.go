@@ -0,0 +1,66 @@
+package connection
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironment(t *testing.T) {
+	inherited := []string{"HOME=/home/user", "LANG=C", "TMPDIR=/tmp"}
+	hostEnv := []string{"LANG=it_IT.UTF-8", "OMP_NUM_THREADS=4"}
+
+	env, err := environment(inherited, hostEnv, RunOptions{
+		Env:      []string{"OMP_NUM_THREADS=8", "RUN=1"},
+		UnsetEnv: []string{"TMPDIR"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"HOME=/home/user", "LANG=it_IT.UTF-8", "OMP_NUM_THREADS=8", "RUN=1"}, env)
+
+	env, err = environment(inherited, hostEnv, RunOptions{Env: []string{"RUN=1"}, EnvMode: EnvInherit})
+	assert.NoError(t, err)
+	assert.Equal(t, inherited, env)
+
+	env, err = environment(inherited, hostEnv, RunOptions{Env: []string{"RUN=1"}, EnvMode: EnvReplace})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"LANG=it_IT.UTF-8", "OMP_NUM_THREADS=4", "RUN=1"}, env)
+
+	_, err = environment(inherited, hostEnv, RunOptions{UnsetEnv: []string{"NOT-A-NAME"}})
+	assert.EqualError(t, err, "invalid environment variable name `NOT-A-NAME`")
+}
+
+func TestShellCommand(t *testing.T) {
+	hostEnv := []string{"LANG=C"}
+	cwd := vpath.New("remote", "/data/run 1")
+
+	cmd, err := shellCommand("wrf.exe", []string{"a b"}, RunOptions{Cwd: cwd, Env: []string{"RUN=1"}, UnsetEnv: []string{"TMPDIR"}}, hostEnv)
+	assert.NoError(t, err)
+	assert.Equal(t, "unset TMPDIR; export LANG=C RUN=1; cd '/data/run 1' || exit 1; exec wrf.exe 'a b'", cmd)
+
+	cmd, err = shellCommand("wrf.exe", nil, RunOptions{Env: []string{"RUN=1"}, EnvMode: EnvInherit}, hostEnv)
+	assert.NoError(t, err)
+	assert.Equal(t, "exec wrf.exe", cmd)
+
+	cmd, err = shellCommand("wrf.exe", nil, RunOptions{Env: []string{"RUN=1"}, EnvMode: EnvReplace}, hostEnv)
+	assert.NoError(t, err)
+	assert.Equal(t, "exec env -i 'LANG=C' 'RUN=1' wrf.exe", cmd)
+
+	cmd, err = shellCommand("echo", []string{"$HOME"}, RunOptions{EnvMode: EnvReplace, Shell: true}, hostEnv)
+	assert.NoError(t, err)
+	assert.Equal(t, "exec env -i 'LANG=C' /bin/sh -c 'echo $HOME'", cmd)
+}
+
+func TestLocalHostEnv(t *testing.T) {
+	conn := &LocalConnection{name: "localhost", env: []string{"VS_HOST=host", "VS_RUN=host"}}
+	var out bytes.Buffer
+	process, err := conn.Run(vpath.Local("/bin/sh"), []string{"-c", `printf '%s %s' "$VS_HOST" "$VS_RUN"`}, RunOptions{
+		Env:    []string{"VS_RUN=run"},
+		Stdout: &out,
+	})
+	assert.NoError(t, err)
+	_, err = process.Wait()
+	assert.NoError(t, err)
+	assert.Equal(t, "host run", out.String())
+}
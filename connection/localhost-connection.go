@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	"sort"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/meteocima/virtual-server/vpath"
 )
@@ -18,6 +20,9 @@ import (
 // LocalConnection ...
 type LocalConnection struct {
 	name string
+	// default environment variables
+	// of processes run on the host.
+	env []string
 }
 
 // Name ...
@@ -81,17 +86,20 @@ func (conn *LocalConnection) Open() error { return nil }
 // Close ...
 func (conn *LocalConnection) Close() error { return nil }
 
-func (conn *LocalConnection) statProcessor(allInputsDone *sync.WaitGroup, input chan vpath.VirtualPath, output chan *VirtualFileInfo, errors chan error) {
+func (conn *LocalConnection) statProcessor(stat func(string) (os.FileInfo, error), allInputsDone *sync.WaitGroup, input chan vpath.VirtualPath, output chan *VirtualFileInfo, errors chan error) {
 	defer allInputsDone.Done()
 	for path := range input {
-		info, err := os.Stat(path.Path)
+		info, err := stat(path.Path)
 		if err != nil {
 			select {
 			case errors <- err:
 			default:
 			}
 
-			return
+			// keep consuming the input, otherwise
+			// the goroutine that feeds it would block
+			// forever when all processors fail.
+			continue
 		}
 
 		sysStat := info.Sys().(*syscall.Stat_t)
@@ -108,7 +116,17 @@ func (conn *LocalConnection) statProcessor(allInputsDone *sync.WaitGroup, input
 // Stat ...
 func (conn *LocalConnection) Stat(paths ...vpath.VirtualPath) (chan *VirtualFileInfo, chan error) {
 	//fmt.Println("LocalConnection Stat")
+	return conn.statAll(os.Stat, paths)
+}
+
+// Lstat ...
+func (conn *LocalConnection) Lstat(paths ...vpath.VirtualPath) (chan *VirtualFileInfo, chan error) {
+	return conn.statAll(os.Lstat, paths)
+}
 
+// statAll returns the infos of `paths`,
+// read concurrently with `stat`.
+func (conn *LocalConnection) statAll(stat func(string) (os.FileInfo, error), paths []vpath.VirtualPath) (chan *VirtualFileInfo, chan error) {
 	input := make(chan vpath.VirtualPath)
 	output := make(chan *VirtualFileInfo)
 	errors := make(chan error, 1)
@@ -117,7 +135,7 @@ func (conn *LocalConnection) Stat(paths ...vpath.VirtualPath) (chan *VirtualFile
 	allInputsDone.Add(runtime.NumCPU())
 
 	for i := 0; i < runtime.NumCPU(); i++ {
-		go conn.statProcessor(&allInputsDone, input, output, errors)
+		go conn.statProcessor(stat, &allInputsDone, input, output, errors)
 	}
 	go func() {
 		for _, p := range paths {
@@ -138,6 +156,15 @@ func (conn *LocalConnection) Link(source, target vpath.VirtualPath) error {
 	return os.Symlink(source.Path, target.Path)
 }
 
+// ReadLink ...
+func (conn *LocalConnection) ReadLink(link vpath.VirtualPath) (string, error) {
+	target, err := os.Readlink(link.Path)
+	if err != nil {
+		return "", fmt.Errorf("ReadLink `%s`: os.Readlink: %w", link.String(), err)
+	}
+	return target, nil
+}
+
 // MkDir ...
 func (conn *LocalConnection) MkDir(dir vpath.VirtualPath) error {
 	err := os.MkdirAll(dir.Path, os.FileMode(0775))
@@ -165,6 +192,24 @@ func (conn *LocalConnection) RmFile(file vpath.VirtualPath) error {
 	return nil
 }
 
+// Chmod ...
+func (conn *LocalConnection) Chmod(file vpath.VirtualPath, mode os.FileMode) error {
+	err := os.Chmod(file.Path, mode)
+	if err != nil {
+		return fmt.Errorf("Chmod `%s`: os.Chmod: %w", file.String(), err)
+	}
+	return nil
+}
+
+// Chtimes ...
+func (conn *LocalConnection) Chtimes(file vpath.VirtualPath, atime time.Time, mtime time.Time) error {
+	err := os.Chtimes(file.Path, atime, mtime)
+	if err != nil {
+		return fmt.Errorf("Chtimes `%s`: os.Chtimes: %w", file.String(), err)
+	}
+	return nil
+}
+
 // LocalProcess ...
 type LocalProcess struct {
 	cmd       *exec.Cmd
@@ -172,8 +217,67 @@ type LocalProcess struct {
 	state     int
 }
 
-// Kill ...
+// killGracePeriod is the time a process is given
+// to terminate after a SIGTERM, before it's
+// forcibly killed with SIGKILL.
+var killGracePeriod = 5 * time.Second
+
+// awaitCompletion waits at most `timeout` for a process
+// to complete, and returns whether it completed.
+func awaitCompletion(completed chan struct{}, timeout time.Duration) bool {
+	// checked first, since select chooses randomly
+	// when the timeout is also expired.
+	select {
+	case <-completed:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-completed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// killGroup sends a signal to the process group
+// of the process, that `Run` starts as its leader,
+// so that children it forked are signalled too.
+func (proc *LocalProcess) killGroup(sig syscall.Signal) error {
+	err := syscall.Kill(-proc.cmd.Process.Pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		// all processes of the group already terminated.
+		return nil
+	}
+	return err
+}
+
+// Kill sends a SIGTERM signal to the process group
+// of the process and, if it's still running after
+// `killGracePeriod`, a SIGKILL one. It returns when
+// the process terminated. Killing an already
+// completed process is a no-op.
 func (proc *LocalProcess) Kill() error {
+	if awaitCompletion(proc.completed, 0) {
+		return nil
+	}
+
+	err := proc.killGroup(syscall.SIGTERM)
+	if err != nil {
+		return fmt.Errorf("Kill `%s`: kill(SIGTERM): %w", proc.cmd.Path, err)
+	}
+	if awaitCompletion(proc.completed, killGracePeriod) {
+		return nil
+	}
+
+	err = proc.killGroup(syscall.SIGKILL)
+	if err != nil {
+		return fmt.Errorf("Kill `%s`: kill(SIGKILL): %w", proc.cmd.Path, err)
+	}
+	<-proc.completed
 	return nil
 }
 
@@ -183,11 +287,34 @@ func (proc *LocalProcess) Wait() (int, error) {
 	return proc.state, nil
 }
 
+// exitCode returns the exit code of a process.
+// As shells do, a process terminated by a signal
+// has 128 plus the signal number as exit code.
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
 // Run ...
 func (conn *LocalConnection) Run(command vpath.VirtualPath, args []string, options RunOptions) (Process, error) {
 
-	cmd := exec.Command(command.Path, args...)
-	cmd.Env = options.Env
+	env, err := environment(os.Environ(), conn.env, options)
+	if err != nil {
+		return nil, fmt.Errorf("Run `%s`: %w", command, err)
+	}
+
+	var cmd *exec.Cmd
+	if options.Shell {
+		cmd = exec.Command("/bin/sh", "-c", shellCommandLine(command.Path, args, true))
+	} else {
+		cmd = exec.Command(command.Path, args...)
+	}
+	cmd.Env = env
+	// the process leads its own group, that
+	// `Kill` signals together with its children.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	process := &LocalProcess{
 		cmd:       cmd,
 		completed: make(chan struct{}),
@@ -221,17 +348,18 @@ func (conn *LocalConnection) Run(command vpath.VirtualPath, args []string, optio
 
 	cmd.Dir = options.Cwd.Path
 
-	err := cmd.Start()
+	err = cmd.Start()
 	if err != nil {
 		return nil, fmt.Errorf("Run `%s`: Start error: %w", command, err)
 	}
 
 	go func() {
-		state, err := cmd.Process.Wait()
-		if err != nil {
-			panic(err)
-		}
-		process.state = state.ExitCode()
+		// cmd.Wait also waits for the output to be
+		// copied to Stdout and Stderr writers. Its error
+		// is ignored, since the exit code is read from
+		// the process state.
+		cmd.Wait()
+		process.state = exitCode(cmd.ProcessState)
 		close(process.completed)
 	}()
 
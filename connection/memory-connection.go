@@ -0,0 +1,740 @@
+package connection
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// MemoryConnection is a Connection that keeps its
+// files in memory, and runs commands implemented
+// as Go functions. It's meant to be used in tests and
+// dry runs, where no file should be touched and no
+// process should be run.
+//
+// Relative paths are resolved from the root directory.
+type MemoryConnection struct {
+	name string
+	// default environment variables
+	// of commands run on the host.
+	env []string
+
+	// synchronizes `files`, `commands` and `runs` access
+	lock     *sync.Mutex
+	files    map[string]*memoryFile
+	commands map[string]MemoryCommand
+	runs     []MemoryRun
+}
+
+// memoryFile is a file, a directory
+// or a symlink of a MemoryConnection.
+type memoryFile struct {
+	mode    os.FileMode
+	modTime time.Time
+	content []byte
+	// target of symlinks
+	target string
+}
+
+// MemoryCommand is the implementation of a command run
+// on a MemoryConnection. It's called with the arguments
+// and options of the command, and returns its exit code.
+type MemoryCommand func(call *MemoryCall) int
+
+// MemoryCall contains the arguments, options
+// and streams of a command run on a MemoryConnection.
+type MemoryCall struct {
+	// Conn is the connection that runs the
+	// command, that can be used to read and
+	// write files.
+	Conn *MemoryConnection
+	// Command is the path of the command.
+	Command string
+	Args    []string
+	Cwd     string
+	Env     []string
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
+	// Killed is closed when the process is
+	// killed. Long running commands should
+	// return when it's closed.
+	Killed <-chan struct{}
+}
+
+// MemoryRun records a command run
+// on a MemoryConnection.
+type MemoryRun struct {
+	Command string
+	Args    []string
+	Cwd     string
+	Env     []string
+}
+
+// NewMemoryConnection returns an empty MemoryConnection,
+// that contains only the root directory.
+func NewMemoryConnection(name string) *MemoryConnection {
+	return &MemoryConnection{
+		name: name,
+		lock: &sync.Mutex{},
+		files: map[string]*memoryFile{
+			"/": {mode: os.ModeDir | os.FileMode(0755), modTime: time.Now()},
+		},
+		commands: map[string]MemoryCommand{},
+	}
+}
+
+// AddMemoryHost adds a host of type `config.HostTypeMemory`
+// named `name` to `config.Hosts`, and returns the connection
+// that `FindHost` will return for it.
+func AddMemoryHost(name string) *MemoryConnection {
+	if config.Hosts == nil {
+		config.Hosts = map[string]*config.Host{}
+	}
+	config.Hosts[name] = &config.Host{
+		Type: config.HostTypeMemory,
+		Name: name,
+	}
+	conn := NewMemoryConnection(name)
+	connections.Add(name, conn)
+	return conn
+}
+
+// AddCommand registers the implementation
+// of the command at path `command`.
+func (conn *MemoryConnection) AddCommand(command string, fn MemoryCommand) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.commands[cleanMemoryPath(command)] = fn
+}
+
+// Runs returns all commands run on
+// the connection, in order.
+func (conn *MemoryConnection) Runs() []MemoryRun {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return append([]MemoryRun{}, conn.runs...)
+}
+
+// WriteFile creates or replaces the file at `file`
+// with `content`, creating its parent directories.
+func (conn *MemoryConnection) WriteFile(file string, content string, mode os.FileMode) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	filePath := cleanMemoryPath(file)
+	err := conn.mkdirAll(path.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	conn.files[filePath] = &memoryFile{
+		mode:    mode.Perm(),
+		modTime: time.Now(),
+		content: []byte(content),
+	}
+	return nil
+}
+
+// ReadFile returns the content of the file at `file`.
+func (conn *MemoryConnection) ReadFile(file string) (string, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	_, f, err := conn.resolve("open", file)
+	if err != nil {
+		return "", err
+	}
+	if f.mode.IsDir() {
+		return "", &os.PathError{Op: "read", Path: file, Err: syscall.EISDIR}
+	}
+	return string(f.content), nil
+}
+
+func cleanMemoryPath(filePath string) string {
+	return path.Join("/", filePath)
+}
+
+// maxSymlinks is the maximum number of symlinks
+// followed while resolving a path, as in Linux.
+const maxSymlinks = 40
+
+// resolve returns the path and the file at `filePath`,
+// following symlinks. It must be called with lock held.
+func (conn *MemoryConnection) resolve(op string, filePath string) (string, *memoryFile, error) {
+	current := cleanMemoryPath(filePath)
+	for i := 0; i < maxSymlinks; i++ {
+		resolved, err := conn.resolveDir(op, filePath, path.Dir(current), i)
+		if err != nil {
+			return "", nil, err
+		}
+		current = path.Join(resolved, path.Base(current))
+
+		f, ok := conn.files[current]
+		if !ok {
+			return "", nil, &os.PathError{Op: op, Path: filePath, Err: os.ErrNotExist}
+		}
+		if f.mode&os.ModeSymlink == 0 {
+			return current, f, nil
+		}
+		current = path.Join(path.Dir(current), f.target)
+	}
+	return "", nil, &os.PathError{Op: op, Path: filePath, Err: syscall.ELOOP}
+}
+
+// resolveDir resolves symlinks in the directory
+// `dir`, that must exist. It must be called with lock held.
+func (conn *MemoryConnection) resolveDir(op string, filePath string, dir string, depth int) (string, error) {
+	if dir == "/" {
+		return dir, nil
+	}
+	if depth >= maxSymlinks {
+		return "", &os.PathError{Op: op, Path: filePath, Err: syscall.ELOOP}
+	}
+	parent, err := conn.resolveDir(op, filePath, path.Dir(dir), depth+1)
+	if err != nil {
+		return "", err
+	}
+	current := path.Join(parent, path.Base(dir))
+	f, ok := conn.files[current]
+	if !ok {
+		return "", &os.PathError{Op: op, Path: filePath, Err: os.ErrNotExist}
+	}
+	if f.mode&os.ModeSymlink != 0 {
+		return conn.resolveDir(op, filePath, path.Join(path.Dir(current), f.target), depth+1)
+	}
+	if !f.mode.IsDir() {
+		return "", &os.PathError{Op: op, Path: filePath, Err: syscall.ENOTDIR}
+	}
+	return current, nil
+}
+
+// parentDir returns the resolved path of the directory
+// that contains `filePath`. It must be called with lock held.
+func (conn *MemoryConnection) parentDir(op string, filePath string) (string, error) {
+	return conn.resolveDir(op, filePath, path.Dir(cleanMemoryPath(filePath)), 0)
+}
+
+// mkdirAll creates `dir` and all its missing
+// parents. It must be called with lock held.
+func (conn *MemoryConnection) mkdirAll(dir string) error {
+	dir = cleanMemoryPath(dir)
+	if dir == "/" {
+		return nil
+	}
+	err := conn.mkdirAll(path.Dir(dir))
+	if err != nil {
+		return err
+	}
+	parent, err := conn.parentDir("mkdir", dir)
+	if err != nil {
+		return err
+	}
+	dirPath := path.Join(parent, path.Base(dir))
+	if f, ok := conn.files[dirPath]; ok {
+		if f.mode&os.ModeSymlink != 0 {
+			_, f, err = conn.resolve("mkdir", dirPath)
+			if err != nil {
+				return err
+			}
+		}
+		if !f.mode.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	conn.files[dirPath] = &memoryFile{mode: os.ModeDir | os.FileMode(0775), modTime: time.Now()}
+	return nil
+}
+
+// children returns the sorted paths of the files
+// contained in `dir`. It must be called with lock held.
+func (conn *MemoryConnection) children(dir string) []string {
+	prefix := dir + "/"
+	if dir == "/" {
+		prefix = "/"
+	}
+	result := []string{}
+	for filePath := range conn.files {
+		if filePath != "/" && strings.HasPrefix(filePath, prefix) && !strings.Contains(filePath[len(prefix):], "/") {
+			result = append(result, filePath)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Name ...
+func (conn *MemoryConnection) Name() string {
+	return conn.name
+}
+
+// SSHPath ...
+func (conn *MemoryConnection) SSHPath(p vpath.VirtualPath) string {
+	return p.Path
+}
+
+// Open ...
+func (conn *MemoryConnection) Open() error { return nil }
+
+// Close ...
+func (conn *MemoryConnection) Close() error { return nil }
+
+// OpenReader ...
+func (conn *MemoryConnection) OpenReader(file vpath.VirtualPath) (io.ReadCloser, error) {
+	content, err := conn.ReadFile(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(strings.NewReader(content)), nil
+}
+
+// memoryWriter writes to a file of a MemoryConnection.
+// Written data is immediately visible to readers.
+type memoryWriter struct {
+	conn *MemoryConnection
+	file *memoryFile
+}
+
+func (w memoryWriter) Write(p []byte) (int, error) {
+	w.conn.lock.Lock()
+	defer w.conn.lock.Unlock()
+	w.file.content = append(w.file.content, p...)
+	w.file.modTime = time.Now()
+	return len(p), nil
+}
+
+func (w memoryWriter) Close() error {
+	return nil
+}
+
+func (conn *MemoryConnection) openWriter(file vpath.VirtualPath, truncate bool) (io.WriteCloser, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	_, f, err := conn.resolve("open", file.Path)
+	if os.IsNotExist(err) {
+		var parent string
+		parent, err = conn.parentDir("open", file.Path)
+		if err != nil {
+			return nil, err
+		}
+		f = &memoryFile{mode: os.FileMode(0664)}
+		conn.files[path.Join(parent, path.Base(file.Path))] = f
+	} else if err != nil {
+		return nil, err
+	} else if f.mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: file.Path, Err: syscall.EISDIR}
+	}
+
+	if truncate {
+		f.content = nil
+	}
+	f.modTime = time.Now()
+	return memoryWriter{conn, f}, nil
+}
+
+// OpenWriter ...
+func (conn *MemoryConnection) OpenWriter(file vpath.VirtualPath) (io.WriteCloser, error) {
+	return conn.openWriter(file, true)
+}
+
+// OpenAppendWriter ...
+func (conn *MemoryConnection) OpenAppendWriter(file vpath.VirtualPath) (io.WriteCloser, error) {
+	return conn.openWriter(file, false)
+}
+
+// ReadDir ...
+func (conn *MemoryConnection) ReadDir(dir vpath.VirtualPath) (vpath.VirtualPathList, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	resolved, f, err := conn.resolve("open", dir.Path)
+	if err == nil && !f.mode.IsDir() {
+		err = &os.PathError{Op: "open", Path: dir.Path, Err: syscall.ENOTDIR}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ReadDir `%s`: %w", dir.String(), err)
+	}
+
+	children := conn.children(resolved)
+	filenames := make(vpath.VirtualPathList, len(children))
+	for i, child := range children {
+		filenames[i] = dir.Join(path.Base(child))
+	}
+	sort.Sort(filenames)
+	return filenames, nil
+}
+
+// memoryFileInfo implements os.FileInfo
+// for files of a MemoryConnection.
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (info memoryFileInfo) Name() string       { return info.name }
+func (info memoryFileInfo) Size() int64        { return info.size }
+func (info memoryFileInfo) Mode() os.FileMode  { return info.mode }
+func (info memoryFileInfo) ModTime() time.Time { return info.modTime }
+func (info memoryFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info memoryFileInfo) Sys() interface{}   { return nil }
+
+// Stat ...
+func (conn *MemoryConnection) Stat(paths ...vpath.VirtualPath) (chan *VirtualFileInfo, chan error) {
+	return conn.statAll(func(filePath string) (*memoryFile, error) {
+		_, f, err := conn.resolve("stat", filePath)
+		return f, err
+	}, paths)
+}
+
+// Lstat ...
+func (conn *MemoryConnection) Lstat(paths ...vpath.VirtualPath) (chan *VirtualFileInfo, chan error) {
+	return conn.statAll(func(filePath string) (*memoryFile, error) {
+		return conn.lresolve("lstat", filePath)
+	}, paths)
+}
+
+// lresolve returns the file at `filePath`, without
+// resolving it when it's a symlink. It must
+// be called with lock held.
+func (conn *MemoryConnection) lresolve(op string, filePath string) (*memoryFile, error) {
+	parent, err := conn.parentDir(op, filePath)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := conn.files[path.Join(parent, path.Base(cleanMemoryPath(filePath)))]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: filePath, Err: os.ErrNotExist}
+	}
+	return f, nil
+}
+
+// statAll returns the infos of `paths`, read
+// with `stat`, that is called with lock held.
+func (conn *MemoryConnection) statAll(stat func(string) (*memoryFile, error), paths []vpath.VirtualPath) (chan *VirtualFileInfo, chan error) {
+	output := make(chan *VirtualFileInfo)
+	errors := make(chan error, 1)
+
+	go func() {
+		for _, p := range paths {
+			conn.lock.Lock()
+			f, err := stat(p.Path)
+			var info memoryFileInfo
+			if err == nil {
+				info = memoryFileInfo{
+					name:    path.Base(cleanMemoryPath(p.Path)),
+					size:    int64(len(f.content)),
+					mode:    f.mode,
+					modTime: f.modTime,
+				}
+			}
+			conn.lock.Unlock()
+
+			if err != nil {
+				select {
+				case errors <- err:
+				default:
+				}
+				continue
+			}
+
+			output <- &VirtualFileInfo{
+				FileInfo: info,
+				Path:     p,
+			}
+		}
+		close(output)
+		close(errors)
+	}()
+
+	return output, errors
+}
+
+// Glob ...
+func (conn *MemoryConnection) Glob(pattern vpath.VirtualPath) (vpath.VirtualPathList, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	cleanPattern := cleanMemoryPath(pattern.Path)
+	if _, err := path.Match(cleanPattern, ""); err != nil {
+		return nil, err
+	}
+
+	result := vpath.VirtualPathList{}
+	for filePath := range conn.files {
+		if matched, _ := path.Match(cleanPattern, filePath); matched {
+			result = append(result, vpath.New(pattern.Host, filePath))
+		}
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// MkDir ...
+func (conn *MemoryConnection) MkDir(dir vpath.VirtualPath) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	err := conn.mkdirAll(dir.Path)
+	if err != nil {
+		return fmt.Errorf("Error: MkDir `%s`: %w", dir.String(), err)
+	}
+	return nil
+}
+
+// RmDir ...
+func (conn *MemoryConnection) RmDir(dir vpath.VirtualPath) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	parent, err := conn.parentDir("unlinkat", dir.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("RmDir `%s`: %w", dir.String(), err)
+	}
+
+	dirPath := path.Join(parent, path.Base(dir.Path))
+	if dirPath == "/" {
+		return fmt.Errorf("RmDir `%s`: cannot remove root directory", dir.String())
+	}
+	for filePath := range conn.files {
+		if filePath == dirPath || strings.HasPrefix(filePath, dirPath+"/") {
+			delete(conn.files, filePath)
+		}
+	}
+	return nil
+}
+
+// RmFile ...
+func (conn *MemoryConnection) RmFile(file vpath.VirtualPath) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	parent, err := conn.parentDir("remove", file.Path)
+	if err != nil {
+		return fmt.Errorf("RmFile `%s`: %w", file.String(), err)
+	}
+	filePath := path.Join(parent, path.Base(file.Path))
+	f, ok := conn.files[filePath]
+	if !ok {
+		return fmt.Errorf("RmFile `%s`: %w", file.String(), &os.PathError{Op: "remove", Path: file.Path, Err: os.ErrNotExist})
+	}
+	if f.mode.IsDir() && len(conn.children(filePath)) > 0 {
+		return fmt.Errorf("RmFile `%s`: %w", file.String(), &os.PathError{Op: "remove", Path: file.Path, Err: syscall.ENOTEMPTY})
+	}
+	delete(conn.files, filePath)
+	return nil
+}
+
+// Chmod ...
+func (conn *MemoryConnection) Chmod(file vpath.VirtualPath, mode os.FileMode) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	_, f, err := conn.resolve("chmod", file.Path)
+	if err != nil {
+		return fmt.Errorf("Chmod `%s`: %w", file.String(), err)
+	}
+	f.mode = f.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+// Chtimes ...
+func (conn *MemoryConnection) Chtimes(file vpath.VirtualPath, atime time.Time, mtime time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	_, f, err := conn.resolve("chtimes", file.Path)
+	if err != nil {
+		return fmt.Errorf("Chtimes `%s`: %w", file.String(), err)
+	}
+	f.modTime = mtime
+	return nil
+}
+
+// Link ...
+func (conn *MemoryConnection) Link(source, target vpath.VirtualPath) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	parent, err := conn.parentDir("symlink", target.Path)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: source.Path, New: target.Path, Err: err}
+	}
+	linkPath := path.Join(parent, path.Base(target.Path))
+	if _, exists := conn.files[linkPath]; exists {
+		return &os.LinkError{Op: "symlink", Old: source.Path, New: target.Path, Err: os.ErrExist}
+	}
+	conn.files[linkPath] = &memoryFile{
+		mode:    os.ModeSymlink | os.FileMode(0777),
+		modTime: time.Now(),
+		target:  source.Path,
+	}
+	return nil
+}
+
+// ReadLink ...
+func (conn *MemoryConnection) ReadLink(link vpath.VirtualPath) (string, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	f, err := conn.lresolve("readlink", link.Path)
+	if err == nil && f.mode&os.ModeSymlink == 0 {
+		err = &os.PathError{Op: "readlink", Path: link.Path, Err: syscall.EINVAL}
+	}
+	if err != nil {
+		return "", fmt.Errorf("ReadLink `%s`: %w", link.String(), err)
+	}
+	return f.target, nil
+}
+
+// MemoryProcess is a command
+// run on a MemoryConnection.
+type MemoryProcess struct {
+	command   string
+	killed    chan struct{}
+	killOnce  *sync.Once
+	completed chan struct{}
+	doneOnce  *sync.Once
+	state     int
+}
+
+// complete sets the exit code of the process,
+// unless it has already been set.
+func (proc *MemoryProcess) complete(state int) {
+	proc.doneOnce.Do(func() {
+		proc.state = state
+		close(proc.completed)
+	})
+}
+
+// Kill closes the `Killed` channel of the command and,
+// if it's still running after `killGracePeriod`, considers
+// it killed anyway. Killed commands have exit code
+// 143 (SIGTERM) when they return in time, 137 (SIGKILL)
+// otherwise.
+func (proc *MemoryProcess) Kill() error {
+	if awaitCompletion(proc.completed, 0) {
+		return nil
+	}
+	proc.killOnce.Do(func() { close(proc.killed) })
+	if !awaitCompletion(proc.completed, killGracePeriod) {
+		proc.complete(128 + int(syscall.SIGKILL))
+	}
+	return nil
+}
+
+// Wait ...
+func (proc *MemoryProcess) Wait() (int, error) {
+	<-proc.completed
+	return proc.state, nil
+}
+
+// Run ...
+func (conn *MemoryConnection) Run(command vpath.VirtualPath, args []string, options RunOptions) (Process, error) {
+	// commands don't inherit any variable, since
+	// they don't run in a real environment.
+	env, err := environment(nil, conn.env, options)
+	if err != nil {
+		return nil, fmt.Errorf("Run `%s`: %w", command, err)
+	}
+
+	conn.lock.Lock()
+	fn, ok := conn.commands[cleanMemoryPath(command.Path)]
+	if ok {
+		conn.runs = append(conn.runs, MemoryRun{
+			Command: command.Path,
+			Args:    append([]string{}, args...),
+			Cwd:     options.Cwd.Path,
+			Env:     env,
+		})
+	}
+	conn.lock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Run `%s`: Start error: %w", command, &os.PathError{Op: "exec", Path: command.Path, Err: os.ErrNotExist})
+	}
+
+	process := &MemoryProcess{
+		command:   command.Path,
+		killed:    make(chan struct{}),
+		killOnce:  &sync.Once{},
+		completed: make(chan struct{}),
+		doneOnce:  &sync.Once{},
+	}
+
+	call := &MemoryCall{
+		Conn:    conn,
+		Command: command.Path,
+		Args:    args,
+		Cwd:     options.Cwd.Path,
+		Env:     env,
+		Stdin:   options.Stdin,
+		Stdout:  options.Stdout,
+		Stderr:  options.Stderr,
+		Killed:  process.killed,
+	}
+	if call.Stdin == nil {
+		call.Stdin = bytes.NewReader(nil)
+	}
+	if call.Stdout == nil {
+		call.Stdout = os.Stdout
+	}
+	if call.Stderr == nil {
+		call.Stderr = os.Stderr
+	}
+
+	if options.OutFromLog != nil {
+		go copyLines(process, call.Stdout, *options.OutFromLog)
+	}
+
+	if options.ErrFromLog != nil {
+		go copyLines(process, call.Stderr, *options.ErrFromLog)
+	}
+
+	go func() {
+		state := fn(call)
+		select {
+		case <-process.killed:
+			state = 128 + int(syscall.SIGTERM)
+		default:
+		}
+		process.complete(state)
+	}()
+
+	return process, nil
+}
+
+// tail copies to `w` the content written to `file`
+// while `proc` runs, as `tail -F` does.
+func (conn *MemoryConnection) tail(proc Process, w io.Writer, file string) {
+	follower := fileFollower{conn: conn, file: vpath.New(conn.name, file), w: w}
+
+	done := make(chan struct{})
+	go func() {
+		proc.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			follower.follow()
+			return
+		case <-ticker.C:
+			follower.follow()
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryConnection(t *testing.T) {
+	conn := NewMemoryConnection("memory")
+	require.NoError(t, conn.WriteFile("/var/fixtures/ciao.txt", "ciao\n", 0644))
+
+	t.Run("CheckStat", CheckStat(conn, "/var/fixtures"))
+	t.Run("CheckMkDir", CheckMkDir(conn, "/var/fixtures"))
+	t.Run("CheckRmDir", CheckRmDir(conn, "/var/fixtures"))
+	t.Run("CheckOpenReader", CheckOpenReader(conn, "/var/fixtures"))
+	t.Run("CheckOpenWriter", CheckOpenWriter(conn, "/var/fixtures"))
+	t.Run("CheckRmFile", CheckRmFile(conn, "/var/fixtures"))
+	t.Run("CheckReadDir", CheckReadDir(conn, "/var/fixtures"))
+
+	t.Run("Stat", func(t *testing.T) {
+		mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		file := vpath.New("memory", "/var/fixtures/ciao.txt")
+		require.NoError(t, conn.Chmod(file, 0600))
+		require.NoError(t, conn.Chtimes(file, mtime, mtime))
+
+		infos, errs := conn.Stat(file, vpath.New("memory", "/var"))
+		info := <-infos
+		assert.Equal(t, "ciao.txt", info.Name())
+		assert.Equal(t, int64(5), info.Size())
+		assert.Equal(t, os.FileMode(0600), info.Mode())
+		assert.Equal(t, mtime, info.ModTime())
+		assert.Equal(t, file, info.Path)
+
+		info = <-infos
+		assert.True(t, info.IsDir())
+		assert.Equal(t, os.ModeDir|os.FileMode(0775), info.Mode())
+		assert.NoError(t, <-errs)
+	})
+
+	t.Run("OpenAppendWriter", func(t *testing.T) {
+		file := vpath.New("memory", "/var/fixtures/appended")
+		writeFile(t, conn, file, "first\n")
+		writer, err := conn.OpenAppendWriter(file)
+		require.NoError(t, err)
+		writer.Write([]byte("second\n"))
+		writer.Close()
+
+		content, err := conn.ReadFile(file.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, "first\nsecond\n", content)
+
+		_, err = conn.OpenWriter(vpath.New("memory", "/missing/file"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Link", func(t *testing.T) {
+		require.NoError(t, conn.Link(vpath.New("memory", "fixtures"), vpath.New("memory", "/var/linked")))
+
+		reader, err := conn.OpenReader(vpath.New("memory", "/var/linked/ciao.txt"))
+		require.NoError(t, err)
+		buf, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "ciao\n", string(buf))
+
+		files, err := conn.ReadDir(vpath.New("memory", "/var"))
+		assert.NoError(t, err)
+		assert.Equal(t, vpath.VirtualPathList{
+			vpath.New("memory", "/var/fixtures"),
+			vpath.New("memory", "/var/linked"),
+		}, files)
+
+		err = conn.Link(vpath.New("memory", "fixtures"), vpath.New("memory", "/var/linked"))
+		assert.True(t, os.IsExist(err))
+
+		target, err := conn.ReadLink(vpath.New("memory", "/var/linked"))
+		assert.NoError(t, err)
+		assert.Equal(t, "fixtures", target)
+		infos, errs := conn.Lstat(vpath.New("memory", "/var/linked"))
+		info := <-infos
+		assert.NoError(t, <-errs)
+		assert.True(t, info.Mode()&os.ModeSymlink != 0)
+
+		require.NoError(t, conn.Link(vpath.New("memory", "loop"), vpath.New("memory", "/var/loop")))
+		_, err = conn.ReadFile("/var/loop")
+		assert.True(t, errors.Is(err, syscall.ELOOP))
+	})
+
+	t.Run("Glob", func(t *testing.T) {
+		require.NoError(t, conn.WriteFile("/data/a.nc", "", 0644))
+		require.NoError(t, conn.WriteFile("/data/b.nc", "", 0644))
+		require.NoError(t, conn.WriteFile("/data/c.txt", "", 0644))
+
+		files, err := conn.Glob(vpath.New("memory", "/data/*.nc"))
+		assert.NoError(t, err)
+		assert.Equal(t, vpath.VirtualPathList{
+			vpath.New("memory", "/data/a.nc"),
+			vpath.New("memory", "/data/b.nc"),
+		}, files)
+
+		_, err = conn.Glob(vpath.New("memory", "/data/["))
+		assert.Error(t, err)
+	})
+
+	t.Run("RmFile", func(t *testing.T) {
+		err := conn.RmFile(vpath.New("memory", "/data"))
+		assert.True(t, errors.Is(err, syscall.ENOTEMPTY))
+		err = conn.RmFile(vpath.New("memory", "/data/missing"))
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+}
+
+func TestMemoryConnectionRun(t *testing.T) {
+	conn := NewMemoryConnection("memory")
+	conn.AddCommand("/bin/greet", func(call *MemoryCall) int {
+		name, err := ioutil.ReadAll(call.Stdin)
+		if err != nil || len(name) == 0 {
+			fmt.Fprintln(call.Stderr, "nobody to greet")
+			return 1
+		}
+		fmt.Fprintf(call.Stdout, "%s %s\n", strings.Join(call.Args, " "), name)
+		return 0
+	})
+	conn.AddCommand("/bin/sleep", func(call *MemoryCall) int {
+		<-call.Killed
+		return 0
+	})
+
+	t.Run("Output and exit code", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		process, err := conn.Run(vpath.New("memory", "/bin/greet"), []string{"hello"}, RunOptions{
+			Stdin:  strings.NewReader("world"),
+			Stdout: &stdout,
+			Stderr: &stderr,
+			Cwd:    vpath.New("memory", "/tmp"),
+			Env:    []string{"A=1"},
+		})
+		require.NoError(t, err)
+		exitCode, err := process.Wait()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, exitCode)
+		assert.Equal(t, "hello world\n", stdout.String())
+
+		process, err = conn.Run(vpath.New("memory", "/bin/greet"), nil, RunOptions{Stderr: &stderr})
+		require.NoError(t, err)
+		exitCode, _ = process.Wait()
+		assert.Equal(t, 1, exitCode)
+		assert.Equal(t, "nobody to greet\n", stderr.String())
+
+		assert.Equal(t, []MemoryRun{
+			{Command: "/bin/greet", Args: []string{"hello"}, Cwd: "/tmp", Env: []string{"A=1"}},
+			{Command: "/bin/greet", Args: []string{}, Env: []string{}},
+		}, conn.Runs())
+	})
+
+	t.Run("Unknown command", func(t *testing.T) {
+		process, err := conn.Run(vpath.New("memory", "/bin/missing"), nil, RunOptions{})
+		assert.Nil(t, process)
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+
+	t.Run("A command that is killed", func(t *testing.T) {
+		process, err := conn.Run(vpath.New("memory", "/bin/sleep"), nil, RunOptions{})
+		require.NoError(t, err)
+		assert.NoError(t, process.Kill())
+
+		exitCode, err := process.Wait()
+		assert.NoError(t, err)
+		assert.Equal(t, 128+int(syscall.SIGTERM), exitCode)
+	})
+
+	t.Run("A command that ignores kill", func(t *testing.T) {
+		defaultGracePeriod := killGracePeriod
+		killGracePeriod = 100 * time.Millisecond
+		defer func() { killGracePeriod = defaultGracePeriod }()
+
+		release := make(chan struct{})
+		defer close(release)
+		conn.AddCommand("/bin/stubborn", func(call *MemoryCall) int {
+			<-release
+			return 0
+		})
+
+		process, err := conn.Run(vpath.New("memory", "/bin/stubborn"), nil, RunOptions{})
+		require.NoError(t, err)
+		assert.NoError(t, process.Kill())
+
+		exitCode, _ := process.Wait()
+		assert.Equal(t, 128+int(syscall.SIGKILL), exitCode)
+	})
+}
+
+func TestAddMemoryHost(t *testing.T) {
+	defer delete(config.Hosts, "memtest")
+	defer CloseAll()
+
+	conn := AddMemoryHost("memtest")
+	assert.Equal(t, config.HostTypeMemory, config.Hosts["memtest"].Type)
+
+	found, err := FindHost("memtest")
+	assert.NoError(t, err)
+	assert.Same(t, conn, found)
+}
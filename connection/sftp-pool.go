@@ -0,0 +1,144 @@
+package connection
+
+import (
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultSFTPPoolSize is the maximum number of idle
+// sftp clients kept by an `SSHConnection` when its
+// `SFTPPoolSize` field is 0.
+const DefaultSFTPPoolSize = 8
+
+// PoolStats contains metrics about the
+// sftp clients pool of an `SSHConnection`.
+type PoolStats struct {
+	// Created is the total number of sftp clients created.
+	Created int
+	// Reused is the total number of times an idle
+	// client has been reused.
+	Reused int
+	// Discarded is the total number of clients closed,
+	// because broken or exceeding the pool size.
+	Discarded int
+	// Idle is the number of clients currently
+	// waiting in the pool.
+	Idle int
+	// InUse is the number of clients currently in use.
+	InUse int
+}
+
+// pooledClient is an sftp client with
+// a channel that is closed when the client
+// connection shuts down.
+type pooledClient struct {
+	*sftp.Client
+	sshClient *ssh.Client
+	dead      chan struct{}
+}
+
+func (client *pooledClient) isDead() bool {
+	select {
+	case <-client.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// sftpPool is a concurrency-safe pool of sftp clients.
+// Clients are lazily created on first use, and are
+// discarded when their connection shuts down, or when the
+// ssh.Client they were created from is replaced.
+type sftpPool struct {
+	lock  sync.Mutex
+	size  int
+	idle  []*pooledClient
+	stats PoolStats
+}
+
+func newSFTPPool(size int) *sftpPool {
+	if size <= 0 {
+		size = DefaultSFTPPoolSize
+	}
+	return &sftpPool{size: size}
+}
+
+// get returns an sftp client of `sshClient`, reusing
+// an idle one when available.
+func (pool *sftpPool) get(sshClient *ssh.Client) (*pooledClient, error) {
+	pool.lock.Lock()
+	for len(pool.idle) > 0 {
+		last := len(pool.idle) - 1
+		client := pool.idle[last]
+		pool.idle = pool.idle[:last]
+		if client.isDead() || client.sshClient != sshClient {
+			client.Close()
+			pool.stats.Discarded++
+			continue
+		}
+		pool.stats.Reused++
+		pool.stats.InUse++
+		pool.lock.Unlock()
+		return client, nil
+	}
+	pool.lock.Unlock()
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &pooledClient{
+		Client:    sftpClient,
+		sshClient: sshClient,
+		dead:      make(chan struct{}),
+	}
+	go func() {
+		sftpClient.Wait()
+		close(client.dead)
+	}()
+
+	pool.lock.Lock()
+	pool.stats.Created++
+	pool.stats.InUse++
+	pool.lock.Unlock()
+
+	return client, nil
+}
+
+// put returns a client to the pool. The client
+// is closed if it's broken or if the pool is full.
+func (pool *sftpPool) put(client *pooledClient) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.stats.InUse--
+	if client.isDead() || len(pool.idle) >= pool.size {
+		client.Close()
+		pool.stats.Discarded++
+		return
+	}
+	pool.idle = append(pool.idle, client)
+}
+
+// close closes all idle clients.
+func (pool *sftpPool) close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for _, client := range pool.idle {
+		client.Close()
+		pool.stats.Discarded++
+	}
+	pool.idle = nil
+}
+
+// snapshot returns current metrics of the pool.
+func (pool *sftpPool) snapshot() PoolStats {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	stats := pool.stats
+	stats.Idle = len(pool.idle)
+	return stats
+}
@@ -0,0 +1,78 @@
+package connection
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isShellSafe returns whether `arg` contains only
+// characters that no POSIX shell interprets.
+func isShellSafe(arg string) bool {
+	if arg == "" {
+		return false
+	}
+	for _, c := range arg {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("@%+:,./_-", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ShellQuote quotes `arg` so that a POSIX shell reads
+// it as a single word, without expanding it. Words
+// that don't need quotes are returned unchanged.
+func ShellQuote(arg string) string {
+	if isShellSafe(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// shellCommandLine returns the command line that runs
+// `command` with `args`. When `shell` is true, they are
+// joined without quotes, so that the shell interprets them.
+func shellCommandLine(command string, args []string, shell bool) string {
+	words := append([]string{command}, args...)
+	if !shell {
+		for i, word := range words {
+			words[i] = ShellQuote(word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// isShellName returns whether `name` is
+// a valid environment variable name.
+func isShellName(name string) bool {
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// shellExport returns the shell command that exports
+// `env`, a list of `NAME=value` environment variables.
+// It returns an empty string when `env` is empty.
+func shellExport(env []string) (string, error) {
+	if len(env) == 0 {
+		return "", nil
+	}
+	assignments := make([]string, len(env))
+	for i, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || !isShellName(parts[0]) {
+			return "", fmt.Errorf("invalid environment variable `%s`", variable)
+		}
+		assignments[i] = parts[0] + "=" + ShellQuote(parts[1])
+	}
+	return "export " + strings.Join(assignments, " "), nil
+}
@@ -0,0 +1,37 @@
+package connection
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "/usr/bin/wrf.exe", ShellQuote("/usr/bin/wrf.exe"))
+	assert.Equal(t, "''", ShellQuote(""))
+	assert.Equal(t, "'a b'", ShellQuote("a b"))
+	assert.Equal(t, `'it'\''s'`, ShellQuote("it's"))
+	assert.Equal(t, "'A=1'", ShellQuote("A=1"))
+
+	for _, arg := range []string{"it's", "$HOME", "`id`", "a\nb", `\`, "*", "~", "!x", "#"} {
+		out, err := exec.Command("/bin/sh", "-c", "printf %s "+ShellQuote(arg)).Output()
+		assert.NoError(t, err)
+		assert.Equal(t, arg, string(out))
+	}
+}
+
+func TestShellExport(t *testing.T) {
+	export, err := shellExport(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", export)
+
+	export, err = shellExport([]string{"A=1", "B_2=a b", "C="})
+	assert.NoError(t, err)
+	assert.Equal(t, "export A=1 B_2='a b' C=''", export)
+
+	_, err = shellExport([]string{"2A=1"})
+	assert.EqualError(t, err, "invalid environment variable `2A=1`")
+	_, err = shellExport([]string{"A"})
+	assert.EqualError(t, err, "invalid environment variable `A`")
+}
@@ -0,0 +1,216 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/meteocima/virtual-server/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// PassphraseCallback, when not nil, is called to obtain
+// the passphrase of an encrypted private key, when the
+// passphrase is not available in the environment variable
+// configured with `KeyPassphraseEnv`.
+var PassphraseCallback func(host string, keyPath string) ([]byte, error)
+
+// defaultAuthMethods returns the authentication methods
+// used when `AuthMethods` is empty: certificate, key and
+// agent, each one used only if configured.
+func (conn *SSHConnection) defaultAuthMethods() []config.AuthMethod {
+	methods := []config.AuthMethod{}
+	if conn.CertificatePath != "" {
+		methods = append(methods, config.AuthCertificate)
+	}
+	if conn.KeyPath != "" {
+		methods = append(methods, config.AuthKey)
+	}
+	if os.Getenv("SSH_AUTH_SOCK") != "" {
+		methods = append(methods, config.AuthAgent)
+	}
+	return methods
+}
+
+// keyPassphrase returns the passphrase of the private
+// key, read from `KeyPassphraseEnv` or `PassphraseCallback`.
+func (conn *SSHConnection) keyPassphrase() ([]byte, error) {
+	if conn.KeyPassphraseEnv != "" {
+		if passphrase, ok := os.LookupEnv(conn.KeyPassphraseEnv); ok {
+			return []byte(passphrase), nil
+		}
+	}
+	if PassphraseCallback != nil {
+		return PassphraseCallback(conn.name, conn.KeyPath)
+	}
+	return nil, fmt.Errorf("key is encrypted, and no passphrase is available")
+}
+
+// privateSSHKey reads the private key of the
+// connection, decrypting it if needed.
+func (conn *SSHConnection) privateSSHKey() (ssh.Signer, error) {
+	privateKey, err := ioutil.ReadFile(conn.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) {
+		return signer, err
+	}
+
+	passphrase, err := conn.keyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(privateKey, passphrase)
+}
+
+// certificateSigner returns a signer that
+// authenticates `key` with the certificate
+// of the connection.
+func (conn *SSHConnection) certificateSigner(key ssh.Signer) (ssh.Signer, error) {
+	content, err := ioutil.ReadFile(conn.CertificatePath)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an OpenSSH certificate", conn.CertificatePath)
+	}
+	return ssh.NewCertSigner(cert, key)
+}
+
+// openAgent connects to the agent listening on `SSH_AUTH_SOCK`.
+// The connection is kept open until the SSHConnection is closed,
+// since agent signers are used again on reconnections.
+func (conn *SSHConnection) openAgent() (agent.ExtendedAgent, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+	if conn.agentConn != nil {
+		conn.agentConn.Close()
+	}
+	agentConn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	conn.agentConn = agentConn
+	return agent.NewClient(agentConn), nil
+}
+
+// authSigners returns a function that lists the keys of
+// all configured authentication methods, in order. Since the
+// ssh client tries each method type only once, all methods are
+// combined in a single public keys callback.
+//
+// Agent errors are returned only when the agent is explicitly
+// listed in `AuthMethods`. Otherwise the agent is used only if
+// it works, so that a stale `SSH_AUTH_SOCK` doesn't prevent
+// authentication with the other methods.
+func (conn *SSHConnection) authSigners() (func() ([]ssh.Signer, error), error) {
+	methods := conn.AuthMethods
+	agentRequired := true
+	if len(methods) == 0 {
+		methods = conn.defaultAuthMethods()
+		agentRequired = false
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no authentication method available: configure a key, a certificate or an agent")
+	}
+
+	var key ssh.Signer
+	loadKey := func() (ssh.Signer, error) {
+		if key != nil {
+			return key, nil
+		}
+		if conn.KeyPath == "" {
+			return nil, fmt.Errorf("no private key configured")
+		}
+		var err error
+		key, err = conn.privateSSHKey()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ssh key %s: %w", conn.KeyPath, err)
+		}
+		return key, nil
+	}
+
+	sources := []func() ([]ssh.Signer, error){}
+	for _, method := range methods {
+		switch method {
+		case config.AuthAgent:
+			agentClient, err := conn.openAgent()
+			if err != nil {
+				if agentRequired {
+					return nil, fmt.Errorf("cannot connect to ssh agent: %w", err)
+				}
+				continue
+			}
+			if agentRequired {
+				sources = append(sources, agentClient.Signers)
+			} else {
+				sources = append(sources, optionalSigners(agentClient.Signers))
+			}
+		case config.AuthKey:
+			signer, err := loadKey()
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, staticSigners(signer))
+		case config.AuthCertificate:
+			signer, err := loadKey()
+			if err != nil {
+				return nil, err
+			}
+			certSigner, err := conn.certificateSigner(signer)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read ssh certificate %s: %w", conn.CertificatePath, err)
+			}
+			sources = append(sources, staticSigners(certSigner))
+		default:
+			return nil, fmt.Errorf("unknown auth method `%s`", method)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no authentication method available: cannot connect to ssh agent")
+	}
+
+	return func() ([]ssh.Signer, error) {
+		signers := []ssh.Signer{}
+		for _, source := range sources {
+			sourceSigners, err := source()
+			if err != nil {
+				return nil, err
+			}
+			signers = append(signers, sourceSigners...)
+		}
+		return signers, nil
+	}, nil
+}
+
+// optionalSigners returns a source that
+// lists no keys when `source` fails.
+func optionalSigners(source func() ([]ssh.Signer, error)) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		signers, err := source()
+		if err != nil {
+			return nil, nil
+		}
+		return signers, nil
+	}
+}
+
+func staticSigners(signers ...ssh.Signer) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		return signers, nil
+	}
+}
@@ -0,0 +1,174 @@
+package connection
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// writeEncryptedKey writes a passphrase
+// protected rsa key in `dir`.
+func writeEncryptedKey(t *testing.T, dir string, passphrase string) (string, ssh.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte(passphrase), x509.PEMCipherAES256)
+	assert.NoError(t, err)
+
+	keyPath := filepath.Join(dir, "id_rsa")
+	assert.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600))
+
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	return keyPath, pub
+}
+
+// writeCertificate writes a user certificate
+// for `pub`, signed by a new CA, in `dir`.
+func writeCertificate(t *testing.T, dir string, pub ssh.PublicKey) string {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	assert.NoError(t, err)
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           "andrea.parodi",
+		ValidPrincipals: []string{"andrea.parodi"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+
+	certPath := filepath.Join(dir, "id_rsa-cert.pub")
+	assert.NoError(t, ioutil.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0644))
+	return certPath
+}
+
+// serveTestAgent starts an ssh agent holding
+// a new key, and points SSH_AUTH_SOCK to it.
+func serveTestAgent(t *testing.T, dir string) ssh.PublicKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	keyring := agent.NewKeyring()
+	assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	oldSocket, hadSocket := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	t.Cleanup(func() {
+		if hadSocket {
+			os.Setenv("SSH_AUTH_SOCK", oldSocket)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+	})
+
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+	return signer.PublicKey()
+}
+
+func TestAuthSigners(t *testing.T) {
+	dir := t.TempDir()
+	keyPath, keyPub := writeEncryptedKey(t, dir, "s3cret")
+	certPath := writeCertificate(t, dir, keyPub)
+	agentPub := serveTestAgent(t, dir)
+
+	os.Setenv("VS_TEST_KEY_PASSPHRASE", "s3cret")
+	defer os.Unsetenv("VS_TEST_KEY_PASSPHRASE")
+
+	t.Run("methods are tried in configured order", func(t *testing.T) {
+		conn := SSHConnection{
+			KeyPath:          keyPath,
+			KeyPassphraseEnv: "VS_TEST_KEY_PASSPHRASE",
+			CertificatePath:  certPath,
+			AuthMethods:      []config.AuthMethod{config.AuthAgent, config.AuthCertificate, config.AuthKey},
+		}
+		signers, err := conn.authSigners()
+		assert.NoError(t, err)
+		defer conn.agentConn.Close()
+
+		keys, err := signers()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(keys))
+		if len(keys) != 3 {
+			return
+		}
+		assert.Equal(t, agentPub.Marshal(), keys[0].PublicKey().Marshal())
+		cert, ok := keys[1].PublicKey().(*ssh.Certificate)
+		assert.True(t, ok)
+		if ok {
+			assert.Equal(t, keyPub.Marshal(), cert.Key.Marshal())
+		}
+		assert.Equal(t, keyPub.Marshal(), keys[2].PublicKey().Marshal())
+	})
+
+	t.Run("default methods", func(t *testing.T) {
+		conn := SSHConnection{KeyPath: keyPath, KeyPassphraseEnv: "VS_TEST_KEY_PASSPHRASE"}
+		assert.Equal(t, []config.AuthMethod{config.AuthKey, config.AuthAgent}, conn.defaultAuthMethods())
+	})
+
+	t.Run("stale agent socket", func(t *testing.T) {
+		os.Setenv("SSH_AUTH_SOCK", filepath.Join(dir, "stale.sock"))
+
+		conn := SSHConnection{KeyPath: keyPath, KeyPassphraseEnv: "VS_TEST_KEY_PASSPHRASE"}
+		signers, err := conn.authSigners()
+		assert.NoError(t, err)
+		keys, err := signers()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(keys))
+
+		conn.AuthMethods = []config.AuthMethod{config.AuthKey, config.AuthAgent}
+		_, err = conn.authSigners()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "cannot connect to ssh agent")
+	})
+
+	t.Run("passphrase from callback", func(t *testing.T) {
+		PassphraseCallback = func(host string, path string) ([]byte, error) {
+			assert.Equal(t, "remote", host)
+			assert.Equal(t, keyPath, path)
+			return []byte("s3cret"), nil
+		}
+		defer func() { PassphraseCallback = nil }()
+
+		conn := SSHConnection{name: "remote", KeyPath: keyPath, AuthMethods: []config.AuthMethod{config.AuthKey}}
+		signers, err := conn.authSigners()
+		assert.NoError(t, err)
+		keys, err := signers()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(keys))
+	})
+
+	t.Run("missing passphrase", func(t *testing.T) {
+		conn := SSHConnection{KeyPath: keyPath, AuthMethods: []config.AuthMethod{config.AuthKey}}
+		_, err := conn.authSigners()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "key is encrypted")
+	})
+}
@@ -1,15 +1,17 @@
 package connection
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net"
 	"os"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/meteocima/virtual-server/config"
 	"github.com/meteocima/virtual-server/vpath"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -24,9 +26,51 @@ type SSHConnection struct {
 	Port    int
 	User    string
 	KeyPath string
+	// KeyPassphraseEnv is the name of the environment
+	// variable containing the passphrase of the key.
+	KeyPassphraseEnv string
+	// CertificatePath is the OpenSSH certificate
+	// file for the key at `KeyPath`.
+	CertificatePath string
+	// AuthMethods are the authentication methods
+	// to try, in order. See `config.AuthMethod`.
+	AuthMethods []config.AuthMethod
+	// Jump is the connection through which
+	// the server is dialed, or nil to dial
+	// it directly.
+	Jump *SSHConnection
+	// SFTPPoolSize is the maximum number
+	// of idle sftp clients kept open on the
+	// connection. 0 means `DefaultSFTPPoolSize`.
+	SFTPPoolSize int
 	//hostName string
 	config *ssh.ClientConfig
-	client *ssh.Client
+	// KeepAliveInterval is the interval between
+	// keepalive requests sent to the server. 0 means
+	// `DefaultKeepAliveInterval`, a negative value
+	// disables keepalive.
+	KeepAliveInterval time.Duration
+	// KnownHostsPath is the known_hosts file used to
+	// verify the server key. Defaults to `~/.ssh/known_hosts`.
+	KnownHostsPath string
+	// HostKeyPolicy indicates how the server key is
+	// verified. Defaults to `config.HostKeyStrict`.
+	HostKeyPolicy config.HostKeyPolicy
+	// Env contains the default environment
+	// variables of processes run on the host.
+	Env []string
+
+	client    *ssh.Client
+	pool      *sftpPool
+	agentConn net.Conn
+	// synchronizes `client` access, since it's
+	// replaced when the connection is reestablished.
+	clientLock sync.Mutex
+	// serializes reconnections
+	reconnectLock sync.Mutex
+	// closed is closed when the connection
+	// is closed, to stop keepalive.
+	closed chan struct{}
 }
 
 // Name ...
@@ -34,24 +78,27 @@ func (conn *SSHConnection) Name() string {
 	return conn.name
 }
 
-func privateSSHKey(path string) (ssh.AuthMethod, error) {
-	privateKey, err := ioutil.ReadFile(path)
-
+// withSFTP calls `fn` with an sftp client
+// taken from the connection pool, and returns
+// the client to the pool afterwards.
+func (conn *SSHConnection) withSFTP(fn func(client *sftp.Client) error) error {
+	client, err := conn.pool.get(conn.SSHClient())
 	if err != nil {
-		return nil, err
-	}
-
-	signer, err := ssh.ParsePrivateKey(privateKey)
-
-	if err != nil {
-		return nil, err
+		return fmt.Errorf("sftp.NewClient: %w", err)
 	}
+	defer conn.pool.put(client)
+	return fn(client.Client)
+}
 
-	return ssh.PublicKeys(signer), nil
+// SFTPPoolStats returns metrics about the
+// pool of sftp clients of the connection.
+func (conn *SSHConnection) SFTPPoolStats() PoolStats {
+	return conn.pool.snapshot()
 }
 
 type sshReader struct {
-	client *sftp.Client
+	pool   *sftpPool
+	client *pooledClient
 	reader io.ReadCloser
 }
 
@@ -60,50 +107,101 @@ func (r sshReader) Read(p []byte) (n int, err error) {
 }
 
 func (r sshReader) Close() error {
-	err := r.reader.Close()
-	if err != nil {
-		r.client.Close()
-		return err
-	}
-
-	return r.client.Close()
+	defer r.pool.put(r.client)
+	return r.reader.Close()
 }
 
 // OpenReader ...
 func (conn *SSHConnection) OpenReader(file vpath.VirtualPath) (io.ReadCloser, error) {
-	client, err := sftp.NewClient(conn.client)
-	if err != nil {
-		return nil, err
-	}
+	var result io.ReadCloser
+	err := conn.retryOnce(func() error {
+		client, err := conn.pool.get(conn.SSHClient())
+		if err != nil {
+			return err
+		}
 
-	reader, err := client.Open(file.Path)
-	if err != nil {
-		return nil, err
-	}
-	return sshReader{client, reader}, nil
+		reader, err := client.Open(file.Path)
+		if err != nil {
+			conn.pool.put(client)
+			return err
+		}
+		result = sshReader{conn.pool, client, reader}
+		return nil
+	})
+	return result, err
 }
 
 const maxRetries = 5
 
 // Open ...
 func (conn *SSHConnection) Open() error {
+	if conn.pool == nil {
+		conn.pool = newSFTPPool(conn.SFTPPoolSize)
+	}
+
+	hostKeyCallback, err := conn.hostKeyCallback()
+	if err != nil {
+		return fmt.Errorf("Open error: %w", err)
+	}
+
 	conn.config = &ssh.ClientConfig{
 		User:            conn.User,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
 		Timeout:         time.Second * 5,
 	}
 
-	key, err := privateSSHKey(conn.KeyPath)
+	signers, err := conn.authSigners()
 	if err != nil {
-		return fmt.Errorf("Open error: cannot read ssh key %s: %w", conn.KeyPath, err)
+		return fmt.Errorf("Open error: %w", err)
 	}
-	conn.config.Auth = []ssh.AuthMethod{key}
+	conn.config.Auth = []ssh.AuthMethod{ssh.PublicKeysCallback(signers)}
+
+	client, err := conn.dial()
+	if err != nil {
+		conn.closeJump()
+		return err
+	}
+
+	conn.clientLock.Lock()
+	conn.client = client
+	conn.closed = make(chan struct{})
+	conn.clientLock.Unlock()
+
+	go conn.keepAlive()
+
+	return nil
+}
 
+// dial connects to the server, retrying up to `maxRetries`
+// times on failure. When `BackupHosts` are configured,
+// each retry uses the next host in the list.
+// Host key verification failures are not retried, and
+// are returned as `*HostKeyError`.
+func (conn *SSHConnection) dial() (*ssh.Client, error) {
+	var err error
 	retryCount := 0
-	failed := true
 
-	for failed && retryCount < maxRetries {
-		client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", conn.Host, conn.Port), conn.config)
+	for retryCount < maxRetries {
+		// ssh.Dial doesn't wrap the error returned by
+		// HostKeyCallback, so it's captured here.
+		var hostKeyErr *HostKeyError
+		cfg := *conn.config
+		cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := conn.config.HostKeyCallback(hostname, remote, key)
+			errors.As(err, &hostKeyErr)
+			return err
+		}
+
+		var client *ssh.Client
+		address := fmt.Sprintf("%s:%d", conn.Host, conn.Port)
+		if conn.Jump != nil {
+			client, err = conn.dialJump(address, &cfg)
+		} else {
+			client, err = ssh.Dial("tcp", address, &cfg)
+		}
+		if hostKeyErr != nil {
+			return nil, hostKeyErr
+		}
 		/*if err == nil && retryCount > 0 && len(conn.BackupHosts) > 0 {
 			fmt.Printf(
 				"VPE: successfully connected to server `%s` using hostname %s. Subsequents requests will use hostname %s\n",
@@ -111,48 +209,49 @@ func (conn *SSHConnection) Open() error {
 				conn.Host,
 				conn.Host,
 			)
+		}*/
+		if err == nil {
+			return client, nil
+		}
+
+		retryHost := conn.Host
+		failedHost := conn.Host
+		if len(conn.BackupHosts) > 0 {
+			retryHost = conn.BackupHosts[0]
+			conn.Host = conn.BackupHosts[0]
+			conn.BackupHosts = append(conn.BackupHosts[1:], failedHost)
 		}
 		fmt.Printf(
-			"VPE: successfully connected to server `%s` using hostname %s. Subsequents requests will use hostname %s\n",
+			"VPE: cannot connect to server `%s` using hostname %s: %v\nThe operation will be retried in 10 seconds on %s\n",
 			conn.Name(),
-			conn.Host,
-			conn.Host,
-		)*/
-		if failed = err != nil; failed {
-			retryHost := conn.Host
-			failedHost := conn.Host
-			if conn.BackupHosts != nil {
-				retryHost = conn.BackupHosts[0]
-				conn.Host = conn.BackupHosts[0]
-				conn.BackupHosts = append(conn.BackupHosts[1:], failedHost)
-			}
-			fmt.Printf(
-				"VPE: cannot connect to server `%s` using hostname %s: %v\nThe operation will be retried in 10 seconds on %s\n",
-				conn.Name(),
-				failedHost,
-				err,
-				retryHost,
-			)
-			time.Sleep(10 * time.Second)
-			retryCount++
-		}
-
-		conn.client = client
+			failedHost,
+			err,
+			retryHost,
+		)
+		time.Sleep(10 * time.Second)
+		retryCount++
 	}
 
-	if err != nil {
-		return fmt.Errorf("cannot dial ssh server %s: %w", conn.Host, err)
-	}
-	return nil
+	return nil, fmt.Errorf("cannot dial ssh server %s: %w", conn.Host, err)
 }
 
 // Close ...
 func (conn *SSHConnection) Close() error {
-	return conn.client.Close()
+	conn.clientLock.Lock()
+	defer conn.clientLock.Unlock()
+	close(conn.closed)
+	conn.pool.close()
+	if conn.agentConn != nil {
+		conn.agentConn.Close()
+	}
+	err := conn.client.Close()
+	conn.closeJump()
+	return err
 }
 
 type sshWriter struct {
-	client *sftp.Client
+	pool   *sftpPool
+	client *pooledClient
 	writer io.WriteCloser
 }
 
@@ -161,50 +260,49 @@ func (r sshWriter) Write(p []byte) (n int, err error) {
 }
 
 func (r sshWriter) Close() error {
-	err := r.writer.Close()
-	if err != nil {
-		r.client.Close()
-		return err
-	}
-
-	return r.client.Close()
+	defer r.pool.put(r.client)
+	return r.writer.Close()
 }
 
-// OpenWriter ...
-func (conn *SSHConnection) OpenWriter(file vpath.VirtualPath) (io.WriteCloser, error) {
-	client, err := sftp.NewClient(conn.client)
+func (conn *SSHConnection) openWriter(file vpath.VirtualPath, flags int) (io.WriteCloser, error) {
+	client, err := conn.pool.get(conn.SSHClient())
 	if err != nil {
 		return nil, err
 	}
 
-	writer, err := client.OpenFile(file.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	writer, err := client.OpenFile(file.Path, flags)
 	if err != nil {
+		conn.pool.put(client)
 		return nil, err
 	}
-	return sshWriter{client, writer}, nil
+	return sshWriter{conn.pool, client, writer}, nil
+}
+
+// OpenWriter ...
+func (conn *SSHConnection) OpenWriter(file vpath.VirtualPath) (io.WriteCloser, error) {
+	return conn.openWriter(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
 }
 
 // OpenAppendWriter ...
 func (conn *SSHConnection) OpenAppendWriter(file vpath.VirtualPath) (io.WriteCloser, error) {
-	client, err := sftp.NewClient(conn.client)
-	if err != nil {
-		return nil, err
-	}
-	writer, err := client.OpenFile(file.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
-	return sshWriter{client, writer}, nil
+	return conn.openWriter(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
 }
 
 // ReadDir ...
 func (conn *SSHConnection) ReadDir(dir vpath.VirtualPath) (vpath.VirtualPathList, error) {
-	client, err := sftp.NewClient(conn.client)
-	if err != nil {
-		return nil, err
-	}
-	defer client.Close()
-
-	files, err := client.ReadDir(dir.Path)
+	var files []os.FileInfo
+	err := conn.retryOnce(func() error {
+		return conn.withSFTP(func(client *sftp.Client) error {
+			var err error
+			files, err = client.ReadDir(dir.Path)
+			if err != nil {
+				return fmt.Errorf("sftp.ReadDir: %w", err)
+			}
+			return nil
+		})
+	})
 	if err != nil {
-		return nil, fmt.Errorf("ReadDir `%s`: sftp.ReadDir: %w", dir.String(), err)
+		return nil, fmt.Errorf("ReadDir `%s`: %w", dir.String(), err)
 	}
 	filenames := make(vpath.VirtualPathList, len(files))
 	for i, f := range files {
@@ -214,22 +312,19 @@ func (conn *SSHConnection) ReadDir(dir vpath.VirtualPath) (vpath.VirtualPathList
 	return filenames, nil
 }
 
-func (conn *SSHConnection) statProcessor(allInputsDone *sync.WaitGroup, input chan vpath.VirtualPath, output chan *VirtualFileInfo, errors chan error) {
+func (conn *SSHConnection) statProcessor(stat func(*sftp.Client, string) (os.FileInfo, error), allInputsDone *sync.WaitGroup, input chan vpath.VirtualPath, output chan *VirtualFileInfo, errors chan error) {
 	defer allInputsDone.Done()
-	client, err := sftp.NewClient(conn.client)
-	if err != nil {
-		err = fmt.Errorf("cannot create new sftp client: %w", err)
-		select {
-		case errors <- err:
-		default:
-		}
-		return
-	}
-	defer client.Close()
 
 	for path := range input {
 		//fmt.Println("READ", path.Path)
-		info, err := client.Stat(path.Path)
+		var info os.FileInfo
+		err := conn.retryOnce(func() error {
+			return conn.withSFTP(func(client *sftp.Client) error {
+				var err error
+				info, err = stat(client, path.Path)
+				return err
+			})
+		})
 		if err != nil {
 			//fmt.Println("ERR", err)
 			select {
@@ -237,7 +332,10 @@ func (conn *SSHConnection) statProcessor(allInputsDone *sync.WaitGroup, input ch
 			default:
 			}
 
-			return
+			// keep consuming the input, otherwise
+			// the goroutine that feeds it would block
+			// forever when all processors fail.
+			continue
 		}
 		output <- &VirtualFileInfo{
 			FileInfo: info,
@@ -248,12 +346,25 @@ func (conn *SSHConnection) statProcessor(allInputsDone *sync.WaitGroup, input ch
 
 // SSHClient ...
 func (conn *SSHConnection) SSHClient() *ssh.Client {
+	conn.clientLock.Lock()
+	defer conn.clientLock.Unlock()
 	return conn.client
 }
 
 // Stat ...
 func (conn *SSHConnection) Stat(paths ...vpath.VirtualPath) (chan *VirtualFileInfo, chan error) {
 	//fmt.Println("STAZT", len(paths))
+	return conn.statAll((*sftp.Client).Stat, paths)
+}
+
+// Lstat ...
+func (conn *SSHConnection) Lstat(paths ...vpath.VirtualPath) (chan *VirtualFileInfo, chan error) {
+	return conn.statAll((*sftp.Client).Lstat, paths)
+}
+
+// statAll returns the infos of `paths`,
+// read concurrently with `stat`.
+func (conn *SSHConnection) statAll(stat func(*sftp.Client, string) (os.FileInfo, error), paths []vpath.VirtualPath) (chan *VirtualFileInfo, chan error) {
 	input := make(chan vpath.VirtualPath)
 	output := make(chan *VirtualFileInfo)
 	errors := make(chan error, 1)
@@ -262,7 +373,7 @@ func (conn *SSHConnection) Stat(paths ...vpath.VirtualPath) (chan *VirtualFileIn
 	allInputsDone.Add(2)
 
 	for i := 0; i < 2; i++ {
-		go conn.statProcessor(&allInputsDone, input, output, errors)
+		go conn.statProcessor(stat, &allInputsDone, input, output, errors)
 	}
 
 	go func() {
@@ -282,13 +393,14 @@ func (conn *SSHConnection) Stat(paths ...vpath.VirtualPath) (chan *VirtualFileIn
 
 // Glob ...
 func (conn *SSHConnection) Glob(pattern vpath.VirtualPath) (vpath.VirtualPathList, error) {
-	client, err := sftp.NewClient(conn.client)
-	if err != nil {
-		return nil, err
-	}
-	defer client.Close()
-
-	files, err := client.Glob(pattern.Path)
+	var files []string
+	err := conn.retryOnce(func() error {
+		return conn.withSFTP(func(client *sftp.Client) error {
+			var err error
+			files, err = client.Glob(pattern.Path)
+			return err
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -301,13 +413,25 @@ func (conn *SSHConnection) Glob(pattern vpath.VirtualPath) (vpath.VirtualPathLis
 
 // Link ...
 func (conn *SSHConnection) Link(source, target vpath.VirtualPath) error {
-	client, err := sftp.NewClient(conn.client)
+	return conn.withSFTP(func(client *sftp.Client) error {
+		return client.Symlink(source.Path, target.Path)
+	})
+}
+
+// ReadLink ...
+func (conn *SSHConnection) ReadLink(link vpath.VirtualPath) (string, error) {
+	var target string
+	err := conn.retryOnce(func() error {
+		return conn.withSFTP(func(client *sftp.Client) error {
+			var err error
+			target, err = client.ReadLink(link.Path)
+			return err
+		})
+	})
 	if err != nil {
-		return err
+		return "", fmt.Errorf("ReadLink `%s`: sftp.ReadLink: %w", link.String(), err)
 	}
-	defer client.Close()
-
-	return client.Symlink(source.Path, target.Path)
+	return target, nil
 }
 
 func (conn *SSHConnection) SSHPath(p vpath.VirtualPath) string {
@@ -316,46 +440,77 @@ func (conn *SSHConnection) SSHPath(p vpath.VirtualPath) string {
 
 // MkDir ...
 func (conn *SSHConnection) MkDir(dir vpath.VirtualPath) error {
-	client, err := sftp.NewClient(conn.client)
-	if err != nil {
-		return fmt.Errorf("MkDir `%s`: sftp.NewClient: %w", dir.String(), err)
-	}
-	defer client.Close()
-
-	err = client.MkdirAll(dir.Path)
+	err := conn.retryOnce(func() error {
+		return conn.withSFTP(func(client *sftp.Client) error {
+			err := client.MkdirAll(dir.Path)
+			if err != nil {
+				return fmt.Errorf("sftp.MkdirAll: %w", err)
+			}
+			return nil
+		})
+	})
 	if err != nil {
-		return fmt.Errorf("MkDir `%s`: sftp.MkdirAll: %w", dir.String(), err)
+		return fmt.Errorf("MkDir `%s`: %w", dir.String(), err)
 	}
-
 	return nil
 }
 
 // RmDir ...
 func (conn *SSHConnection) RmDir(dir vpath.VirtualPath) error {
-	client, err := sftp.NewClient(conn.client)
+	err := conn.withSFTP(func(client *sftp.Client) error {
+		err := client.RemoveDirectory(dir.Path)
+		if err != nil {
+			return fmt.Errorf("sftp.RemoveDirectory: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("RmDir `%s`: sftp.NewClient: %w", dir.String(), err)
+		return fmt.Errorf("RmDir `%s`: %w", dir.String(), err)
 	}
-	defer client.Close()
+	return nil
+}
 
-	err = client.RemoveDirectory(dir.Path)
+// RmFile ...
+func (conn *SSHConnection) RmFile(file vpath.VirtualPath) error {
+	err := conn.withSFTP(func(client *sftp.Client) error {
+		err := client.Remove(file.Path)
+		if err != nil {
+			return fmt.Errorf("sftp.Remove: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("RmDir `%s`: sftp.RemoveDirectory: %w", dir.String(), err)
+		return fmt.Errorf("RmFile `%s`: %w", file.String(), err)
 	}
-
 	return nil
 }
 
-// RmFile ...
-func (conn *SSHConnection) RmFile(file vpath.VirtualPath) error {
-	client, err := sftp.NewClient(conn.client)
+// Chmod ...
+func (conn *SSHConnection) Chmod(file vpath.VirtualPath, mode os.FileMode) error {
+	err := conn.withSFTP(func(client *sftp.Client) error {
+		err := client.Chmod(file.Path, mode)
+		if err != nil {
+			return fmt.Errorf("sftp.Chmod: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("RmFile `%s`: sftp.NewClient: %w", file.String(), err)
+		return fmt.Errorf("Chmod `%s`: %w", file.String(), err)
 	}
-	defer client.Close()
-	err = client.Remove(file.Path)
+	return nil
+}
+
+// Chtimes ...
+func (conn *SSHConnection) Chtimes(file vpath.VirtualPath, atime time.Time, mtime time.Time) error {
+	err := conn.withSFTP(func(client *sftp.Client) error {
+		err := client.Chtimes(file.Path, atime, mtime)
+		if err != nil {
+			return fmt.Errorf("sftp.Chtimes: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("RmFile `%s`: sftp.Remove: %w", file.String(), err)
+		return fmt.Errorf("Chtimes `%s`: %w", file.String(), err)
 	}
 	return nil
 }
@@ -375,13 +530,12 @@ func (w *singleWriter) Write(p []byte) (int, error) {
 
 // Run ...
 func (conn *SSHConnection) Run(command vpath.VirtualPath, args []string, options RunOptions) (Process, error) {
-	client, err := sftp.NewClient(conn.client)
+	cmdStr, err := shellCommand(command.Path, args, options, conn.Env)
 	if err != nil {
-		return nil, fmt.Errorf("Run `%s`: sftp.NewClient: %w", command.String(), err)
+		return nil, fmt.Errorf("Run `%s`: %w", command.String(), err)
 	}
-	defer client.Close()
 
-	cmd, err := conn.client.NewSession()
+	cmd, err := conn.newSession()
 	if err != nil {
 		return nil, fmt.Errorf("Run `%s`: client.NewSession: %w", command.String(), err)
 	}
@@ -404,8 +558,15 @@ func (conn *SSHConnection) Run(command vpath.VirtualPath, args []string, options
 		cmd.Stdin = options.Stdin
 	}
 
+	pidFile, err := newPidFilePath()
+	if err != nil {
+		return nil, fmt.Errorf("Run `%s`: newPidFilePath: %w", command.String(), err)
+	}
+
 	process := &SSHProcess{
 		cmd:       cmd,
+		conn:      conn,
+		pidFile:   pidFile,
 		completed: make(chan struct{}),
 	}
 
@@ -417,18 +578,10 @@ func (conn *SSHConnection) Run(command vpath.VirtualPath, args []string, options
 		go copyLines(process, cmd.Stderr, *options.ErrFromLog)
 	}
 
-	cmdStr := command.Path
-	cmdStr = fmt.Sprintf("%s %s", cmdStr, strings.Join(args, " "))
-
-	if options.Env != nil {
-		for _, str := range options.Env {
-			cmdStr = fmt.Sprintf("%s %s", str, cmdStr)
-		}
-	}
-
-	if options.Cwd.Path != "" {
-		cmdStr = fmt.Sprintf("cd %s && %s", options.Cwd.Path, cmdStr)
-	}
+	// the shell writes its pid before replacing itself
+	// with the command, so that the process group
+	// can be killed when the server ignores signals.
+	cmdStr = fmt.Sprintf("echo $$ > %s; %s", pidFile, cmdStr)
 
 	err = cmd.Start(cmdStr)
 
@@ -445,10 +598,14 @@ func (conn *SSHConnection) Run(command vpath.VirtualPath, args []string, options
 			if exerr, ok := err.(*ssh.ExitError); ok {
 				process.state = exerr.ExitStatus()
 			} else {
-				panic(err)
+				// the connection dropped before
+				// the exit status was received.
+				process.state = -1
+				process.err = fmt.Errorf("Run `%s`: session.Wait: %w", command, err)
 			}
 		}
 		close(process.completed)
+		conn.RmFile(vpath.New(conn.name, pidFile))
 	}()
 
 	return process, nil
@@ -457,18 +614,83 @@ func (conn *SSHConnection) Run(command vpath.VirtualPath, args []string, options
 // SSHProcess ...
 type SSHProcess struct {
 	cmd       *ssh.Session
+	conn      *SSHConnection
+	pidFile   string
 	completed chan struct{}
 	state     int
+	// err is set when the process
+	// status cannot be known.
+	err error
+}
+
+// newPidFilePath returns a unique path on the
+// remote host where to store the pid of a process.
+func newPidFilePath() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/tmp/virtual-server-%x.pid", id), nil
+}
+
+// killGroup sends a signal to the process group
+// of the remote process, using a new session.
+func (proc *SSHProcess) killGroup(sig ssh.Signal) error {
+	session, err := proc.conn.SSHClient().NewSession()
+	if err != nil {
+		return fmt.Errorf("client.NewSession: %w", err)
+	}
+	defer session.Close()
+
+	out, err := session.CombinedOutput(fmt.Sprintf("kill -s %s -- -$(cat %s)", sig, proc.pidFile))
+	// the process may have completed meanwhile,
+	// making the pid file disappear.
+	if err != nil && !awaitCompletion(proc.completed, killGracePeriod) {
+		return fmt.Errorf("kill -%s: %w: %s", sig, err, out)
+	}
+	return nil
 }
 
-// Kill ...
+// Kill sends a SIGTERM signal to the remote process
+// and, if it's still running after `killGracePeriod`,
+// a SIGKILL one. Since some SSH servers ignore
+// signal requests, when the process doesn't terminate
+// the signals are sent to the whole remote process group
+// using the `kill` command. It returns when the process
+// terminated. Killing an already completed process is a no-op.
 func (proc *SSHProcess) Kill() error {
+	if awaitCompletion(proc.completed, 0) {
+		return nil
+	}
+
+	proc.cmd.Signal(ssh.SIGTERM)
+	if awaitCompletion(proc.completed, killGracePeriod) {
+		return nil
+	}
+
+	err := proc.killGroup(ssh.SIGTERM)
+	if err != nil {
+		return fmt.Errorf("Kill: %w", err)
+	}
+	if awaitCompletion(proc.completed, killGracePeriod) {
+		return nil
+	}
+
+	proc.cmd.Signal(ssh.SIGKILL)
+	err = proc.killGroup(ssh.SIGKILL)
+	if err != nil {
+		return fmt.Errorf("Kill: %w", err)
+	}
+	if !awaitCompletion(proc.completed, killGracePeriod) {
+		return fmt.Errorf("Kill: process still running after SIGKILL")
+	}
 	return nil
 }
 
 // Wait ...
 func (proc *SSHProcess) Wait() (int, error) {
 	<-proc.completed
-	return proc.state, nil
+	return proc.state, proc.err
 
 }
@@ -0,0 +1,136 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/meteocima/virtual-server/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyError is returned when the key presented by
+// an SSH server is not known, or doesn't match the one
+// recorded in the known_hosts file.
+type HostKeyError struct {
+	// Host is the name of the host in configuration.
+	Host string
+	// Address is the address of the server, as dialed.
+	Address string
+	// KeyType is the type of the key presented by the server.
+	KeyType string
+	// Fingerprint is the SHA256 fingerprint of the
+	// key presented by the server.
+	Fingerprint string
+	// KnownHosts is the path of the known_hosts file used.
+	KnownHosts string
+	// Mismatch is true when the known_hosts file contains
+	// a different key for the server, false when the server
+	// is not present in the file.
+	Mismatch bool
+}
+
+func (err *HostKeyError) Error() string {
+	if err.Mismatch {
+		return fmt.Sprintf(
+			"host key mismatch for host `%s` (%s): server presented %s key %s, which differs from the one in %s",
+			err.Host, err.Address, err.KeyType, err.Fingerprint, err.KnownHosts,
+		)
+	}
+	return fmt.Sprintf(
+		"unknown host key for host `%s` (%s): server presented %s key %s, which is not in %s",
+		err.Host, err.Address, err.KeyType, err.Fingerprint, err.KnownHosts,
+	)
+}
+
+// knownHostsPath returns the path of the known_hosts
+// file to use, defaulting to `~/.ssh/known_hosts`.
+func (conn *SSHConnection) knownHostsPath() (string, error) {
+	if conn.KnownHostsPath != "" {
+		return conn.KnownHostsPath, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// appendKnownHost adds a line for `address` to
+// the known_hosts file, creating it if needed.
+func appendKnownHost(path string, address string, key ssh.PublicKey) error {
+	err := os.MkdirAll(filepath.Dir(path), os.FileMode(0700))
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(file, knownhosts.Line([]string{knownhosts.Normalize(address)}, key))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// hostKeyCallback returns the function used to verify
+// the server host key, according to the `HostKeyPolicy` of
+// the connection.
+func (conn *SSHConnection) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	switch conn.HostKeyPolicy {
+	case config.HostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case config.HostKeyStrict, config.HostKeyAcceptNew, "":
+	default:
+		return nil, fmt.Errorf("unknown host key policy `%s`", conn.HostKeyPolicy)
+	}
+
+	path, err := conn.knownHostsPath()
+	if err != nil {
+		return nil, fmt.Errorf("cannot find known_hosts file: %w", err)
+	}
+
+	acceptNew := conn.HostKeyPolicy == config.HostKeyAcceptNew
+	if _, err := os.Stat(path); err != nil && !(acceptNew && os.IsNotExist(err)) {
+		return nil, fmt.Errorf("cannot read known_hosts file: %w", err)
+	}
+
+	return func(address string, remote net.Addr, key ssh.PublicKey) error {
+		// the file is read on every check, so that keys
+		// added by accept-new are seen on reconnections.
+		var check ssh.HostKeyCallback
+		var err error
+		if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+			check, err = knownhosts.New(os.DevNull)
+		} else {
+			check, err = knownhosts.New(path)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read known_hosts file %s: %w", path, err)
+		}
+
+		err = check(address, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		if len(keyErr.Want) == 0 && acceptNew {
+			return appendKnownHost(path, address, key)
+		}
+
+		return &HostKeyError{
+			Host:        conn.name,
+			Address:     address,
+			KeyType:     key.Type(),
+			Fingerprint: ssh.FingerprintSHA256(key),
+			KnownHosts:  path,
+			Mismatch:    len(keyErr.Want) > 0,
+		}
+	}, nil
+}
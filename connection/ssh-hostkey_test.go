@@ -0,0 +1,84 @@
+package connection
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.NoError(t, err)
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+	key, otherKey := newTestHostKey(t), newTestHostKey(t)
+
+	t.Run("strict fails when known_hosts doesn't exist", func(t *testing.T) {
+		conn := SSHConnection{name: "remote", KnownHostsPath: knownHosts}
+		_, err := conn.hostKeyCallback()
+		assert.Error(t, err)
+	})
+
+	t.Run("accept-new adds unknown keys", func(t *testing.T) {
+		conn := SSHConnection{name: "remote", KnownHostsPath: knownHosts, HostKeyPolicy: config.HostKeyAcceptNew}
+		check, err := conn.hostKeyCallback()
+		assert.NoError(t, err)
+		assert.NoError(t, check("localhost:2222", remote, key))
+		assert.NoError(t, check("localhost:2222", remote, key))
+	})
+
+	t.Run("strict accepts known keys", func(t *testing.T) {
+		conn := SSHConnection{name: "remote", KnownHostsPath: knownHosts}
+		check, err := conn.hostKeyCallback()
+		assert.NoError(t, err)
+		assert.NoError(t, check("localhost:2222", remote, key))
+	})
+
+	t.Run("strict refuses unknown hosts", func(t *testing.T) {
+		conn := SSHConnection{name: "other", KnownHostsPath: knownHosts, HostKeyPolicy: config.HostKeyStrict}
+		check, err := conn.hostKeyCallback()
+		assert.NoError(t, err)
+
+		var hostKeyErr *HostKeyError
+		err = check("example.com:22", remote, key)
+		assert.True(t, errors.As(err, &hostKeyErr))
+		assert.Equal(t, "other", hostKeyErr.Host)
+		assert.Equal(t, "example.com:22", hostKeyErr.Address)
+		assert.False(t, hostKeyErr.Mismatch)
+	})
+
+	t.Run("mismatching keys are refused", func(t *testing.T) {
+		conn := SSHConnection{name: "remote", KnownHostsPath: knownHosts, HostKeyPolicy: config.HostKeyAcceptNew}
+		check, err := conn.hostKeyCallback()
+		assert.NoError(t, err)
+
+		var hostKeyErr *HostKeyError
+		err = check("localhost:2222", remote, otherKey)
+		assert.True(t, errors.As(err, &hostKeyErr))
+		assert.Equal(t, "remote", hostKeyErr.Host)
+		assert.Equal(t, ssh.FingerprintSHA256(otherKey), hostKeyErr.Fingerprint)
+		assert.Equal(t, knownHosts, hostKeyErr.KnownHosts)
+		assert.True(t, hostKeyErr.Mismatch)
+		assert.Contains(t, err.Error(), "host key mismatch for host `remote`")
+	})
+
+	t.Run("insecure accepts any key", func(t *testing.T) {
+		conn := SSHConnection{name: "remote", KnownHostsPath: knownHosts, HostKeyPolicy: config.HostKeyInsecure}
+		check, err := conn.hostKeyCallback()
+		assert.NoError(t, err)
+		assert.NoError(t, check("localhost:2222", remote, otherKey))
+	})
+}
@@ -0,0 +1,152 @@
+package connection
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meteocima/virtual-server/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHConnection returns a connection to
+// `host`, without dialing it.
+func newSSHConnection(name string, host *config.Host) *SSHConnection {
+	return &SSHConnection{
+		BackupHosts: append([]string{}, host.BackupHosts...),
+
+		name:    name,
+		Host:    host.Host,
+		Port:    host.Port,
+		User:    host.User,
+		KeyPath: host.Key,
+
+		KeyPassphraseEnv: host.KeyPassphraseEnv,
+		CertificatePath:  host.Certificate,
+		AuthMethods:      append([]config.AuthMethod{}, host.AuthMethods...),
+
+		SFTPPoolSize:      host.SFTPPoolSize,
+		KeepAliveInterval: time.Duration(host.KeepAlive) * time.Second,
+		KnownHostsPath:    host.KnownHosts,
+		HostKeyPolicy:     host.HostKeyPolicy,
+		Env:               append([]string{}, host.Env...),
+	}
+}
+
+// parseJumpHost parses a jump host in the
+// `[user@]host[:port]` form used by ssh `ProxyJump`.
+// Empty user and port are returned when not specified.
+func parseJumpHost(spec string) (user string, host string, port int, err error) {
+	host = strings.TrimPrefix(spec, "ssh://")
+	if at := strings.LastIndex(host, "@"); at != -1 {
+		user, host = host[:at], host[at+1:]
+	}
+
+	if hostname, portStr, splitErr := net.SplitHostPort(host); splitErr == nil {
+		port, err = strconv.Atoi(portStr)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("wrong port in jump host `%s`: %w", spec, err)
+		}
+		host = hostname
+	}
+
+	if host == "" {
+		return "", "", 0, fmt.Errorf("wrong jump host `%s`: empty hostname", spec)
+	}
+	return user, host, port, nil
+}
+
+// jumpChain returns the last connection of the chain of jump
+// hosts of `host`, each one dialed through the previous one.
+// Jump hosts can be names of configured hosts, whose settings
+// are used to connect, or `[user@]host[:port]` specifications,
+// that use the settings of `host`. Jump hosts of a configured jump
+// host are used only when it's the first one in the chain.
+func jumpChain(name string, host *config.Host, visiting []string) (*SSHConnection, error) {
+	visiting = append(visiting, name)
+
+	var previous *SSHConnection
+	for i, spec := range host.JumpHosts {
+		var jump *SSHConnection
+
+		if jumpHost, ok := config.Hosts[spec]; ok {
+			if jumpHost.Type != config.HostTypeSSH {
+				return nil, fmt.Errorf("jump host `%s` of host `%s` is not an SSH host", spec, name)
+			}
+			for _, visited := range visiting {
+				if visited == spec {
+					return nil, fmt.Errorf("jump hosts of host `%s` form a cycle: %s -> %s", name, strings.Join(visiting, " -> "), spec)
+				}
+			}
+			jump = newSSHConnection(spec, jumpHost)
+			if i == 0 {
+				var err error
+				jump.Jump, err = jumpChain(spec, jumpHost, visiting)
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			user, hostname, port, err := parseJumpHost(spec)
+			if err != nil {
+				return nil, err
+			}
+			jump = newSSHConnection(spec, host)
+			jump.BackupHosts = []string{}
+			jump.Host = hostname
+			jump.Port = 22
+			if port != 0 {
+				jump.Port = port
+			}
+			if user != "" {
+				jump.User = user
+			}
+		}
+
+		if previous != nil {
+			jump.Jump = previous
+		}
+		previous = jump
+	}
+
+	return previous, nil
+}
+
+// dialJump opens a connection to `address` through
+// the jump host of the connection, opening the jump
+// host if needed.
+func (conn *SSHConnection) dialJump(address string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	if conn.Jump.SSHClient() == nil {
+		err := conn.Jump.Open()
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to jump host `%s`: %w", conn.Jump.Name(), err)
+		}
+	}
+
+	var tunnel net.Conn
+	err := conn.Jump.retryOnce(func() error {
+		var err error
+		tunnel, err = conn.Jump.SSHClient().Dial("tcp", address)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s through jump host `%s`: %w", address, conn.Jump.Name(), err)
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(tunnel, address, cfg)
+	if err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+// closeJump closes the jump host
+// of the connection, if it's open.
+func (conn *SSHConnection) closeJump() {
+	if conn.Jump != nil && conn.Jump.SSHClient() != nil {
+		conn.Jump.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package connection
+
+import (
+	"testing"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJumpHost(t *testing.T) {
+	user, host, port, err := parseJumpHost("admin@gateway.example.com:2222")
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", user)
+	assert.Equal(t, "gateway.example.com", host)
+	assert.Equal(t, 2222, port)
+
+	user, host, port, err = parseJumpHost("gateway.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "", user)
+	assert.Equal(t, "gateway.example.com", host)
+	assert.Equal(t, 0, port)
+
+	_, host, port, err = parseJumpHost("ssh://[::1]:2200")
+	assert.NoError(t, err)
+	assert.Equal(t, "::1", host)
+	assert.Equal(t, 2200, port)
+
+	_, _, _, err = parseJumpHost("admin@gateway:ssh")
+	assert.Error(t, err)
+}
+
+func TestJumpChain(t *testing.T) {
+	oldHosts := config.Hosts
+	defer func() { config.Hosts = oldHosts }()
+
+	config.Hosts = map[string]*config.Host{
+		"outer": {
+			Type: config.HostTypeSSH,
+			Host: "outer.example.com",
+			Port: 22,
+			User: "outer-user",
+			Key:  "/keys/outer",
+		},
+		"bastion": {
+			Type:      config.HostTypeSSH,
+			Host:      "bastion.example.com",
+			Port:      2200,
+			User:      "bastion-user",
+			Key:       "/keys/bastion",
+			JumpHosts: []string{"outer"},
+		},
+		"compute": {
+			Type:      config.HostTypeSSH,
+			Host:      "compute.example.com",
+			Port:      22,
+			User:      "andrea.parodi",
+			Key:       "/keys/compute",
+			JumpHosts: []string{"bastion", "gateway.example.com:2222"},
+		},
+		"loop": {
+			Type:      config.HostTypeSSH,
+			Host:      "loop.example.com",
+			JumpHosts: []string{"loop2"},
+		},
+		"loop2": {
+			Type:      config.HostTypeSSH,
+			Host:      "loop2.example.com",
+			JumpHosts: []string{"loop"},
+		},
+		"local": {
+			Type: config.HostTypeOS,
+		},
+	}
+
+	jump, err := jumpChain("compute", config.Hosts["compute"], nil)
+	assert.NoError(t, err)
+
+	// gateway is reached through bastion, using compute credentials
+	assert.Equal(t, "gateway.example.com", jump.Host)
+	assert.Equal(t, 2222, jump.Port)
+	assert.Equal(t, "andrea.parodi", jump.User)
+	assert.Equal(t, "/keys/compute", jump.KeyPath)
+
+	// bastion uses its own settings, and its own jump host
+	bastion := jump.Jump
+	assert.Equal(t, "bastion", bastion.Name())
+	assert.Equal(t, 2200, bastion.Port)
+	assert.Equal(t, "bastion-user", bastion.User)
+	assert.Equal(t, "outer", bastion.Jump.Name())
+	assert.Nil(t, bastion.Jump.Jump)
+
+	jump, err = jumpChain("outer", config.Hosts["outer"], nil)
+	assert.NoError(t, err)
+	assert.Nil(t, jump)
+
+	_, err = jumpChain("loop", config.Hosts["loop"], nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "form a cycle: loop -> loop2 -> loop")
+
+	config.Hosts["compute"].JumpHosts = []string{"local"}
+	_, err = jumpChain("compute", config.Hosts["compute"], nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not an SSH host")
+}
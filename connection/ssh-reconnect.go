@@ -0,0 +1,166 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultKeepAliveInterval is the interval between
+// keepalive requests used when `SSHConnection.KeepAliveInterval`
+// is 0.
+const DefaultKeepAliveInterval = 30 * time.Second
+
+// connectionCheckTimeout is the maximum time
+// to wait for a server to reply to a keepalive
+// request sent after an operation failed.
+const connectionCheckTimeout = 10 * time.Second
+
+const keepAliveRequest = "keepalive@openssh.com"
+
+// isAlive sends a keepalive request on `client`, and
+// returns whether the server replied within `timeout`.
+// Servers that don't recognize the request reply with
+// a failure, that still proves the connection is alive.
+func isAlive(client *ssh.Client, timeout time.Duration) bool {
+	replied := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(keepAliveRequest, true, nil)
+		replied <- err
+	}()
+
+	select {
+	case err := <-replied:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// keepAlive periodically checks that the connection
+// is alive, and reestablishes it when it's not.
+// It returns when the connection is closed.
+func (conn *SSHConnection) keepAlive() {
+	interval := conn.KeepAliveInterval
+	if interval == 0 {
+		interval = DefaultKeepAliveInterval
+	}
+	if interval < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case <-ticker.C:
+			client := conn.SSHClient()
+			if isAlive(client, interval) {
+				continue
+			}
+			err := conn.reconnect(client)
+			if err != nil {
+				fmt.Printf("VPE: cannot reconnect to server `%s`: %v\n", conn.Name(), err)
+			}
+		}
+	}
+}
+
+// reconnect replaces the `failed` client with a new one,
+// dialed using the same rotation of backup hosts used by `Open`.
+// If the client has already been replaced by another goroutine,
+// it does nothing. The new client is dialed without holding
+// `clientLock`, so that other users of the connection are not
+// blocked while the server is unreachable.
+func (conn *SSHConnection) reconnect(failed *ssh.Client) error {
+	// dial rotates backup hosts, so only
+	// a reconnection at a time is allowed.
+	conn.reconnectLock.Lock()
+	defer conn.reconnectLock.Unlock()
+
+	conn.clientLock.Lock()
+	current := conn.client
+	conn.clientLock.Unlock()
+	if current != failed {
+		return nil
+	}
+	if conn.isClosed() {
+		return errors.New("connection closed")
+	}
+
+	failed.Close()
+	client, err := conn.dial()
+	if err != nil {
+		return err
+	}
+
+	conn.clientLock.Lock()
+	defer conn.clientLock.Unlock()
+	if conn.isClosed() {
+		client.Close()
+		return errors.New("connection closed")
+	}
+	if conn.client != failed {
+		client.Close()
+		return nil
+	}
+	conn.client = client
+	return nil
+}
+
+// isClosed returns whether the connection has been closed.
+func (conn *SSHConnection) isClosed() bool {
+	select {
+	case <-conn.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// isServerError returns whether `err` has been
+// returned by a server that is still reachable.
+func isServerError(err error) bool {
+	var statusErr *sftp.StatusError
+	return errors.As(err, &statusErr) ||
+		errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, os.ErrPermission)
+}
+
+// retryOnce calls `fn` and, if it fails because the
+// connection dropped, reestablishes the connection and calls
+// `fn` once more. It must be used only for idempotent operations,
+// and `fn` must get the ssh client from the connection at each call.
+func (conn *SSHConnection) retryOnce(fn func() error) error {
+	client := conn.SSHClient()
+	err := fn()
+	if err == nil || isServerError(err) || isAlive(client, connectionCheckTimeout) {
+		return err
+	}
+
+	if reconnErr := conn.reconnect(client); reconnErr != nil {
+		return fmt.Errorf("%w (reconnection failed: %v)", err, reconnErr)
+	}
+
+	return fn()
+}
+
+// newSession opens a new session on the connection.
+// Since no command is run yet, opening a session is
+// retried when the connection dropped.
+func (conn *SSHConnection) newSession() (*ssh.Session, error) {
+	var session *ssh.Session
+	err := conn.retryOnce(func() error {
+		var err error
+		session, err = conn.SSHClient().NewSession()
+		return err
+	})
+	return session, err
+}
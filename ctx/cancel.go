@@ -0,0 +1,158 @@
+package ctx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/meteocima/virtual-server/connection"
+)
+
+// NewWithContext returns a new Context whose
+// operations are aborted when `parent` is cancelled
+// or its deadline expires. Running processes
+// started by `Run` or `Exec` are killed, transfers are
+// interrupted, and `Err` is set to an error that wraps
+// the one returned by `parent.Err()`.
+func NewWithContext(parent context.Context, stdin io.Reader, stdout io.Writer, stderr io.Writer) *Context {
+	goctx, cancel := context.WithCancel(parent)
+	return &Context{
+		ID:          "ANON",
+		stdin:       stdin,
+		stdout:      stdout,
+		stderr:      stderr,
+		level:       LevelDebug,
+		runningLock: &sync.Mutex{},
+		goctx:       goctx,
+		cancel:      cancel,
+	}
+}
+
+// GoContext returns the `context.Context`
+// that controls cancellation of this Context.
+func (ctx *Context) GoContext() context.Context {
+	if ctx.goctx == nil {
+		return context.Background()
+	}
+	return ctx.goctx
+}
+
+// Cancel aborts all operations running on
+// the Context, and makes all subsequent ones fail.
+func (ctx *Context) Cancel() {
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+}
+
+// Done returns a channel that is closed
+// when the Context is cancelled.
+func (ctx *Context) Done() <-chan struct{} {
+	return ctx.GoContext().Done()
+}
+
+// aborted returns whether the Context already failed.
+// When the Context has been cancelled, `Err` is set
+// to the cancellation error.
+func (ctx *Context) aborted() bool {
+	if ctx.Err == nil && ctx.goctx != nil && ctx.goctx.Err() != nil {
+		ctx.Err = fmt.Errorf("operation aborted: %w", ctx.goctx.Err())
+	}
+	return ctx.Err != nil
+}
+
+// awaitResult is the outcome of
+// a function run by `await`.
+type awaitResult struct {
+	value interface{}
+	err   error
+}
+
+// await runs `fn` in a new goroutine and waits
+// for it to complete, or for the Context to be cancelled,
+// whichever happens first, returning the value and error
+// of `fn`. Since `fn` keeps running after a cancellation,
+// it must return its outcome instead of assigning
+// variables shared with the caller.
+func (ctx *Context) await(fn func() (interface{}, error)) (interface{}, error) {
+	if ctx.goctx == nil {
+		return fn()
+	}
+
+	// buffered, so that the goroutine can complete
+	// even when nobody receives its result anymore.
+	result := make(chan awaitResult, 1)
+	go func() {
+		value, err := fn()
+		result <- awaitResult{value: value, err: err}
+	}()
+
+	select {
+	case res := <-result:
+		return res.value, res.err
+	case <-ctx.goctx.Done():
+		return nil, ctx.goctx.Err()
+	}
+}
+
+// killOnCancel kills `proc` if the Context
+// is cancelled before the process completes.
+func (ctx *Context) killOnCancel(proc connection.Process) {
+	if ctx.goctx == nil {
+		return
+	}
+
+	completed := make(chan struct{})
+	go func() {
+		proc.Wait()
+		close(completed)
+	}()
+
+	go func() {
+		select {
+		case <-completed:
+		case <-ctx.goctx.Done():
+			err := proc.Kill()
+			if err != nil {
+				ctx.LogWarning("cannot kill process on cancellation: %s", err.Error())
+			}
+		}
+	}()
+}
+
+// cancellableReader is an io.ReadCloser
+// that fails reading once a context.Context is done.
+type cancellableReader struct {
+	goctx  context.Context
+	reader io.ReadCloser
+}
+
+func (r cancellableReader) Read(p []byte) (int, error) {
+	if err := r.goctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+func (r cancellableReader) Close() error {
+	return r.reader.Close()
+}
+
+// cancellableWriter is an io.WriteCloser
+// that fails writing once a context.Context is done.
+type cancellableWriter struct {
+	goctx  context.Context
+	writer io.WriteCloser
+}
+
+func (w cancellableWriter) Write(p []byte) (int, error) {
+	if err := w.goctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.writer.Write(p)
+}
+
+func (w cancellableWriter) Close() error {
+	return w.writer.Close()
+}
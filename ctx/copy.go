@@ -0,0 +1,334 @@
+package ctx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// copyFile streams the content of `from` file
+// to `to` file using the given connections,
+// and then apply to the destination the mode and
+// modification time of the source file.
+//
+// The function does not touch the Context state,
+// so it can be safely called from multiple goroutines.
+// The copy is interrupted when `goctx` is cancelled.
+func copyFile(goctx context.Context, fromConn, toConn connection.Connection, from, to vpath.VirtualPath) error {
+	infos, errs := fromConn.Stat(from)
+	info := <-infos
+	err := <-errs
+	if err != nil {
+		return fmt.Errorf("fromConn.Stat: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("`%s` is a directory", from.String())
+	}
+
+	reader, err := fromConn.OpenReader(from)
+	if err != nil {
+		return fmt.Errorf("fromConn.OpenReader: %w", err)
+	}
+	defer reader.Close()
+
+	writer, err := toConn.OpenWriter(to)
+	if err != nil {
+		return fmt.Errorf("toConn.OpenWriter: %w", err)
+	}
+
+	_, err = io.Copy(writer, cancellableReader{goctx, reader})
+	if err != nil {
+		writer.Close()
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("writer.Close: %w", err)
+	}
+
+	err = toConn.Chmod(to, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("toConn.Chmod: %w", err)
+	}
+
+	err = toConn.Chtimes(to, time.Now(), info.ModTime())
+	if err != nil {
+		return fmt.Errorf("toConn.Chtimes: %w", err)
+	}
+
+	return nil
+}
+
+// copyLink creates `to` as a symbolic link with the
+// same target of the link `from`, replacing the
+// file at `to`, unless it's already the same link.
+func copyLink(fromConn, toConn connection.Connection, from, to vpath.VirtualPath) error {
+	target, err := fromConn.ReadLink(from)
+	if err != nil {
+		return fmt.Errorf("fromConn.ReadLink: %w", err)
+	}
+
+	infos, errs := toConn.Lstat(to)
+	info := <-infos
+	err = <-errs
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("toConn.Lstat: %w", err)
+	}
+	if info != nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			existing, err := toConn.ReadLink(to)
+			if err == nil && existing == target {
+				return nil
+			}
+		}
+		err = toConn.RmFile(to)
+		if err != nil {
+			return fmt.Errorf("toConn.RmFile: %w", err)
+		}
+	}
+
+	err = toConn.Link(vpath.New(to.Host, target), to)
+	if err != nil {
+		return fmt.Errorf("toConn.Link: %w", err)
+	}
+	return nil
+}
+
+// CopyTreeOptions contains options that
+// change how `Context.CopyTree` works.
+type CopyTreeOptions struct {
+	// Parallelism is the maximum number of files
+	// copied concurrently. A value of 0 means
+	// `DefaultCopyTreeParallelism`.
+	Parallelism int
+
+	// SkipUnchanged, if set, skips the copy of
+	// files that already exist on destination with
+	// the same size and modification time of
+	// the source, in the same way `rsync` does.
+	SkipUnchanged bool
+}
+
+// DefaultCopyTreeParallelism is the number
+// of files copied concurrently by `CopyTree`
+// when `CopyTreeOptions.Parallelism` is 0.
+const DefaultCopyTreeParallelism = 4
+
+type copyJob struct {
+	from vpath.VirtualPath
+	to   vpath.VirtualPath
+	info *connection.VirtualFileInfo
+}
+
+// treeCopier holds the state of a single
+// `CopyTree` operation.
+type treeCopier struct {
+	goctx    context.Context
+	fromConn connection.Connection
+	toConn   connection.Connection
+	options  CopyTreeOptions
+	jobs     chan copyJob
+
+	errLock  sync.Mutex
+	firstErr error
+}
+
+func (cp *treeCopier) setFailed(err error) {
+	cp.errLock.Lock()
+	defer cp.errLock.Unlock()
+	if cp.firstErr == nil {
+		cp.firstErr = err
+	}
+}
+
+func (cp *treeCopier) failed() bool {
+	cp.errLock.Lock()
+	defer cp.errLock.Unlock()
+	return cp.firstErr != nil
+}
+
+// statAll returns file infos of all
+// given paths, indexed by path.
+func statAll(conn connection.Connection, paths ...vpath.VirtualPath) (map[string]*connection.VirtualFileInfo, error) {
+	return collectInfos(conn.Stat(paths...))
+}
+
+// lstatAll returns file infos of all given paths,
+// indexed by path, without following symbolic links.
+func lstatAll(conn connection.Connection, paths ...vpath.VirtualPath) (map[string]*connection.VirtualFileInfo, error) {
+	return collectInfos(conn.Lstat(paths...))
+}
+
+func collectInfos(infos chan *connection.VirtualFileInfo, errs chan error) (map[string]*connection.VirtualFileInfo, error) {
+	res := map[string]*connection.VirtualFileInfo{}
+	for info := range infos {
+		res[info.Path.Path] = info
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// isUnchanged returns whether `to` file exists
+// with same size and modification time of `from`.
+func (cp *treeCopier) isUnchanged(job copyJob) bool {
+	infos, err := statAll(cp.toConn, job.to)
+	if err != nil {
+		return false
+	}
+	target, ok := infos[job.to.Path]
+	if !ok || target.IsDir() {
+		return false
+	}
+	return target.Size() == job.info.Size() &&
+		target.ModTime().Unix() == job.info.ModTime().Unix()
+}
+
+func (cp *treeCopier) copyWorker(done *sync.WaitGroup) {
+	defer done.Done()
+	for job := range cp.jobs {
+		if cp.failed() {
+			continue
+		}
+		if job.info.Mode()&os.ModeSymlink != 0 {
+			err := copyLink(cp.fromConn, cp.toConn, job.from, job.to)
+			if err != nil {
+				cp.setFailed(fmt.Errorf("copy `%s`: %w", job.from.String(), err))
+			}
+			continue
+		}
+		if cp.options.SkipUnchanged && cp.isUnchanged(job) {
+			continue
+		}
+		err := copyFile(cp.goctx, cp.fromConn, cp.toConn, job.from, job.to)
+		if err != nil {
+			cp.setFailed(fmt.Errorf("copy `%s`: %w", job.from.String(), err))
+		}
+	}
+}
+
+// walk recreates `dir` directory on destination,
+// and recursively schedules the copy of all of its files.
+func (cp *treeCopier) walk(dir, target vpath.VirtualPath) {
+	if cp.failed() {
+		return
+	}
+	if err := cp.goctx.Err(); err != nil {
+		cp.setFailed(err)
+		return
+	}
+
+	err := cp.toConn.MkDir(target)
+	if err != nil {
+		cp.setFailed(fmt.Errorf("toConn.MkDir: %w", err))
+		return
+	}
+
+	entries, err := cp.fromConn.ReadDir(dir)
+	if err != nil {
+		cp.setFailed(fmt.Errorf("fromConn.ReadDir: %w", err))
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	// symbolic links are not followed, so that
+	// links to a parent directory don't loop forever.
+	infos, err := lstatAll(cp.fromConn, entries...)
+	if err != nil {
+		cp.setFailed(fmt.Errorf("fromConn.Lstat: %w", err))
+		return
+	}
+
+	for _, entry := range entries {
+		info := infos[entry.Path]
+		entryTarget := target.Join(entry.Filename())
+		if info.IsDir() {
+			cp.walk(entry, entryTarget)
+			continue
+		}
+		cp.jobs <- copyJob{from: entry, to: entryTarget, info: info}
+	}
+}
+
+// CopyTree recursively copies the directory `from`
+// to the virtual path `to`, possibly on a different host.
+// Directories are created on destination as they are found,
+// while files are copied with a bounded parallelism.
+// Symbolic links found in the tree are copied as links,
+// with the same target.
+// If `from` is a regular file, it's copied as
+// `Copy` would do. `options` can be nil.
+func (ctx *Context) CopyTree(from, to vpath.VirtualPath, options *CopyTreeOptions) {
+	if ctx.aborted() {
+		return
+	}
+	defer ctx.setRunningFunction("CopyTree from `%s` to `%s`", from.String(), to.String())()
+	if ctx.planned(PlanStep{Op: PlanCopyTree, Paths: vpath.VirtualPathList{from, to}}) {
+		return
+	}
+
+	if options == nil {
+		options = &CopyTreeOptions{}
+	}
+
+	fromConn, err := connection.FindHost(from.Host)
+	if err != nil {
+		ctx.ContextFailed("connection.FindHost", err)
+		return
+	}
+	toConn, err := connection.FindHost(to.Host)
+	if err != nil {
+		ctx.ContextFailed("connection.FindHost", err)
+		return
+	}
+
+	cp := treeCopier{
+		goctx:    ctx.GoContext(),
+		fromConn: fromConn,
+		toConn:   toConn,
+		options:  *options,
+		jobs:     make(chan copyJob),
+	}
+
+	roots, err := statAll(fromConn, from)
+	if err != nil {
+		ctx.ContextFailed("fromConn.Stat", err)
+		return
+	}
+
+	parallelism := options.Parallelism
+	if parallelism <= 0 {
+		parallelism = DefaultCopyTreeParallelism
+	}
+
+	workersDone := sync.WaitGroup{}
+	workersDone.Add(parallelism)
+	for i := 0; i < parallelism; i++ {
+		go cp.copyWorker(&workersDone)
+	}
+
+	root := roots[from.Path]
+	if root.IsDir() {
+		cp.walk(from, to)
+	} else {
+		cp.jobs <- copyJob{from: from, to: to, info: root}
+	}
+
+	close(cp.jobs)
+	workersDone.Wait()
+
+	if cp.firstErr != nil {
+		ctx.ContextFailed("treeCopier", cp.firstErr)
+	}
+}
@@ -1,11 +1,11 @@
 package ctx
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"strings"
 	"sync"
 	"time"
@@ -16,7 +16,10 @@ import (
 
 // Context abstract a set of operations
 // on one or multiple FileSystem instances
-// that fails or succeed as a whole
+// that fails or succeed as a whole.
+// When its journal is enabled, the operations
+// of a failed Context can be reversed
+// with `Rollback`.
 type Context struct {
 	Err             error
 	runningFunction string
@@ -32,6 +35,12 @@ type Context struct {
 	running      bool
 	runningLock  *sync.Mutex
 	level        LogLevel
+
+	goctx  context.Context
+	cancel context.CancelFunc
+
+	journal *journal
+	plan    *Plan
 }
 
 var useDateInLogs bool
@@ -40,9 +49,14 @@ func UseDateInLogs() {
 	useDateInLogs = true
 }
 
-// Clone ...
+// Clone returns a new Context with the same
+// streams of the original one. The clone is
+// cancelled when the original Context is, and
+// shares its Plan when it's in dry-run mode.
 func (ctx *Context) Clone() *Context {
-	return New(ctx.stdin, ctx.stdout, ctx.stderr)
+	clone := NewWithContext(ctx.GoContext(), ctx.stdin, ctx.stdout, ctx.stderr)
+	clone.plan = ctx.plan
+	return clone
 }
 
 // GetStdOut ...
@@ -77,17 +91,7 @@ func (ctx *Context) SetStdErr(v io.Writer) {
 
 // New ...
 func New(stdin io.Reader, stdout io.Writer, stderr io.Writer) *Context {
-	ctx := Context{
-		ID:     "ANON",
-		stdin:  stdin,
-		stdout: stdout,
-		stderr: stderr,
-		level:  LevelDebug,
-		//logCompleted: make(chan struct{}),
-		runningLock: &sync.Mutex{},
-	}
-	//ctx.startLogWriter()
-	return &ctx
+	return NewWithContext(context.Background(), stdin, stdout, stderr)
 }
 
 // ContextFailed ...
@@ -113,7 +117,7 @@ func (ctx *Context) setRunningFunction(msg string, args ...interface{}) func() {
 
 // IsFile ...
 func (ctx *Context) IsFile(file vpath.VirtualPath) bool {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return false
 	}
 	defer ctx.setRunningFunction("IsFile `%s`", file.String())()
@@ -124,9 +128,12 @@ func (ctx *Context) IsFile(file vpath.VirtualPath) bool {
 		return false
 	}
 
-	infos, errs := conn.Stat(file)
-	info := <-infos
-	err = <-errs
+	value, err := ctx.await(func() (interface{}, error) {
+		infos, errs := conn.Stat(file)
+		info := <-infos
+		return info, <-errs
+	})
+	info, _ := value.(*connection.VirtualFileInfo)
 	if os.IsNotExist(err) {
 		return false
 	}
@@ -144,7 +151,7 @@ func (ctx *Context) IsFile(file vpath.VirtualPath) bool {
 
 // Glob ...
 func (ctx *Context) Glob(pattern vpath.VirtualPath) vpath.VirtualPathList {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return nil
 	}
 	defer ctx.setRunningFunction("Glob `%s`", pattern.String())()
@@ -155,20 +162,22 @@ func (ctx *Context) Glob(pattern vpath.VirtualPath) vpath.VirtualPathList {
 		return nil
 	}
 
-	files, err := conn.Glob(pattern)
+	value, err := ctx.await(func() (interface{}, error) {
+		return conn.Glob(pattern)
+	})
 
 	if err != nil {
 		ctx.ContextFailed("connection.Glob", err)
 		return nil
 	}
 
-	return files
+	return value.(vpath.VirtualPathList)
 
 }
 
 // Stat ...
 func (ctx *Context) Stat(files ...vpath.VirtualPath) chan *connection.VirtualFileInfo {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return nil
 	}
 	defer ctx.setRunningFunction("Stat `%v`", files)()
@@ -187,37 +196,61 @@ func (ctx *Context) Stat(files ...vpath.VirtualPath) chan *connection.VirtualFil
 		connections[file.Host] = append(hostFiles, file)
 	}
 
-	results := make(chan *connection.VirtualFileInfo)
-
-	for host, files := range connections {
+	hosts := map[string]connection.Connection{}
+	for host := range connections {
 		conn, err := connection.FindHost(host)
 		if err != nil {
 			ctx.ContextFailed("connection.FindHost", err)
 			return nil
 		}
+		hosts[host] = conn
+	}
 
-		infos, errs := conn.Stat(files...)
+	results := make(chan *connection.VirtualFileInfo)
+	allHostsDone := sync.WaitGroup{}
+	allHostsDone.Add(len(hosts))
+
+	// errors are reported before `results` is closed, so
+	// that callers can check them after reading all results.
+	runningFunction := ctx.runningFunction
+	errLock := &sync.Mutex{}
+	for host, conn := range hosts {
+		infos, errs := conn.Stat(connections[host]...)
 		go func() {
+			defer allHostsDone.Done()
+		sendInfos:
 			for i := range infos {
-				results <- i
+				select {
+				case results <- i:
+				case <-ctx.Done():
+					// drain remaining infos, so that
+					// stat goroutines can terminate.
+					for range infos {
+					}
+					break sendInfos
+				}
 			}
-			close(results)
-		}()
-		go func() {
+
 			err := <-errs
 			if err != nil {
-				ctx.ContextFailed("connection.Stat", err)
+				errLock.Lock()
+				ctx.SetContextFailed("%s: connection.Stat: %w", runningFunction, err)
+				errLock.Unlock()
 			}
 		}()
-
 	}
 
+	go func() {
+		allHostsDone.Wait()
+		close(results)
+	}()
+
 	return results
 }
 
 // ExistsUnchangedFrom ...
 func (ctx *Context) ExistsUnchangedFrom(file vpath.VirtualPath, from time.Duration) bool {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return false
 	}
 	defer ctx.setRunningFunction("Exists `%s`", file.String())()
@@ -228,9 +261,12 @@ func (ctx *Context) ExistsUnchangedFrom(file vpath.VirtualPath, from time.Durati
 		return false
 	}
 
-	infos, errs := conn.Stat(file)
-	info := <-infos
-	err = <-errs
+	value, err := ctx.await(func() (interface{}, error) {
+		infos, errs := conn.Stat(file)
+		info := <-infos
+		return info, <-errs
+	})
+	info, _ := value.(*connection.VirtualFileInfo)
 
 	if os.IsNotExist(err) {
 		return false
@@ -247,7 +283,7 @@ func (ctx *Context) ExistsUnchangedFrom(file vpath.VirtualPath, from time.Durati
 
 // Exists ...
 func (ctx *Context) Exists(file vpath.VirtualPath) bool {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return false
 	}
 	defer ctx.setRunningFunction("Exists `%s`", file.String())()
@@ -258,9 +294,11 @@ func (ctx *Context) Exists(file vpath.VirtualPath) bool {
 		return false
 	}
 
-	infos, errs := conn.Stat(file)
-	<-infos
-	err = <-errs
+	_, err = ctx.await(func() (interface{}, error) {
+		infos, errs := conn.Stat(file)
+		<-infos
+		return nil, <-errs
+	})
 
 	if os.IsNotExist(err) {
 		return false
@@ -276,7 +314,7 @@ func (ctx *Context) Exists(file vpath.VirtualPath) bool {
 
 // ReadDir ...
 func (ctx *Context) ReadDir(dir vpath.VirtualPath) vpath.VirtualPathList {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return vpath.VirtualPathList{}
 	}
 	defer ctx.setRunningFunction("ReadDir `%s`", dir.String())()
@@ -287,21 +325,28 @@ func (ctx *Context) ReadDir(dir vpath.VirtualPath) vpath.VirtualPathList {
 		return nil
 	}
 
-	var files vpath.VirtualPathList
-	files, err = conn.ReadDir(dir)
+	value, err := ctx.await(func() (interface{}, error) {
+		return conn.ReadDir(dir)
+	})
 	if err != nil {
 		ctx.ContextFailed("connection.ReadDir", err)
 		return nil
 	}
-	return files
+	return value.(vpath.VirtualPathList)
 }
 
-// Copy ...
+// Copy copies a file to another virtual path,
+// possibly on a different host. The content is streamed
+// through the connections of the two hosts, and the mode
+// and modification time of the source file are preserved.
 func (ctx *Context) Copy(from, to vpath.VirtualPath) {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return
 	}
 	defer ctx.setRunningFunction("Copy from `%s` to `%s`", from.String(), to.String())()
+	if ctx.planned(PlanStep{Op: PlanCopy, Paths: vpath.VirtualPathList{from, to}}) {
+		return
+	}
 
 	fromConn, err := connection.FindHost(from.Host)
 	if err != nil {
@@ -314,34 +359,57 @@ func (ctx *Context) Copy(from, to vpath.VirtualPath) {
 		return
 	}
 
-	fromS := fromConn.SSHPath(from)
-	toS := toConn.SSHPath(to)
+	err = ctx.journalFile(toConn, to)
+	if err != nil {
+		ctx.ContextFailed("journalFile", err)
+		return
+	}
 
-	fmt.Printf("SCP COPY %s -> %s\n", fromS, toS)
-	cmd := exec.Command("scp", fromS, toS)
-	res, err := cmd.CombinedOutput()
+	err = copyFile(ctx.GoContext(), fromConn, toConn, from, to)
 	if err != nil {
-		fmt.Fprintf(ctx.stdout, "scp failed: %s\nCommand output:\n%s\n", err, string(res))
-		ctx.Err = err
+		ctx.ContextFailed("copyFile", err)
 	}
 }
 
 // Move ...
 func (ctx *Context) Move(from, to vpath.VirtualPath) {
-	if ctx.Err != nil {
+	if ctx.aborted() {
+		return
+	}
+	if ctx.planned(PlanStep{Op: PlanMove, Paths: vpath.VirtualPathList{from, to}}) {
 		return
 	}
 
 	ctx.Copy(from, to)
+	if ctx.aborted() || ctx.journal == nil {
+		ctx.RmFile(from)
+		return
+	}
+
+	// the source is saved before its
+	// removal, to be restored on rollback.
+	conn, err := connection.FindHost(from.Host)
+	if err != nil {
+		ctx.ContextFailed("connection.FindHost", err)
+		return
+	}
+	err = ctx.journalFile(conn, from)
+	if err != nil {
+		ctx.ContextFailed("journalFile", err)
+		return
+	}
 	ctx.RmFile(from)
 }
 
 // OpenWriter ...
 func (ctx *Context) OpenWriter(file vpath.VirtualPath) io.WriteCloser {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return nil
 	}
 	defer ctx.setRunningFunction("OpenWriter to `%s`", file.String())()
+	if writer := ctx.plannedWriter(PlanWrite, file); writer != nil {
+		return writer
+	}
 
 	toConn, err := connection.FindHost(file.Host)
 	if err != nil {
@@ -349,21 +417,30 @@ func (ctx *Context) OpenWriter(file vpath.VirtualPath) io.WriteCloser {
 		return nil
 	}
 
+	err = ctx.journalFile(toConn, file)
+	if err != nil {
+		ctx.ContextFailed("journalFile", err)
+		return nil
+	}
+
 	writer, err := toConn.OpenWriter(file)
 	if err != nil {
 		ctx.ContextFailed("toConn.OpenWriter", err)
 		return nil
 	}
 
-	return writer
+	return cancellableWriter{ctx.GoContext(), writer}
 }
 
 // OpenAppendWriter ...
 func (ctx *Context) OpenAppendWriter(file vpath.VirtualPath) io.WriteCloser {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return nil
 	}
 	defer ctx.setRunningFunction("OpenAppendWriter to `%s`", file.String())()
+	if writer := ctx.plannedWriter(PlanAppend, file); writer != nil {
+		return writer
+	}
 
 	toConn, err := connection.FindHost(file.Host)
 	if err != nil {
@@ -377,15 +454,18 @@ func (ctx *Context) OpenAppendWriter(file vpath.VirtualPath) io.WriteCloser {
 		return nil
 	}
 
-	return writer
+	return cancellableWriter{ctx.GoContext(), writer}
 }
 
 // WriteString ...
 func (ctx *Context) WriteString(file vpath.VirtualPath, content string) {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return
 	}
 	defer ctx.setRunningFunction("WriteString to `%s`", file.String())()
+	if ctx.planned(PlanStep{Op: PlanWrite, Paths: vpath.VirtualPathList{file}, Content: content}) {
+		return
+	}
 
 	toConn, err := connection.FindHost(file.Host)
 	if err != nil {
@@ -393,6 +473,12 @@ func (ctx *Context) WriteString(file vpath.VirtualPath, content string) {
 		return
 	}
 
+	err = ctx.journalFile(toConn, file)
+	if err != nil {
+		ctx.ContextFailed("journalFile", err)
+		return
+	}
+
 	writer, err := toConn.OpenWriter(file)
 	if err != nil {
 		ctx.ContextFailed("toConn.OpenWriter", err)
@@ -401,7 +487,7 @@ func (ctx *Context) WriteString(file vpath.VirtualPath, content string) {
 
 	defer writer.Close()
 
-	_, err = writer.Write([]byte(content))
+	_, err = cancellableWriter{ctx.GoContext(), writer}.Write([]byte(content))
 	if err != nil {
 		ctx.ContextFailed("writer.Write", err)
 		return
@@ -411,7 +497,7 @@ func (ctx *Context) WriteString(file vpath.VirtualPath, content string) {
 
 // OpenReader ...
 func (ctx *Context) OpenReader(file vpath.VirtualPath) io.ReadCloser {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return nil
 	}
 	defer ctx.setRunningFunction("OpenReader from `%s`", file.String())()
@@ -428,13 +514,13 @@ func (ctx *Context) OpenReader(file vpath.VirtualPath) io.ReadCloser {
 		return nil
 	}
 
-	return reader
+	return cancellableReader{ctx.GoContext(), reader}
 
 }
 
 // ReadString ...
 func (ctx *Context) ReadString(file vpath.VirtualPath) string {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return ""
 	}
 	defer ctx.setRunningFunction("ReadString from `%s`", file.String())()
@@ -455,7 +541,7 @@ func (ctx *Context) ReadString(file vpath.VirtualPath) string {
 
 	//bufReader := bufio.NewReader(reader)
 
-	buf, err := ioutil.ReadAll(reader)
+	buf, err := ioutil.ReadAll(cancellableReader{ctx.GoContext(), reader})
 	if err != nil {
 		ctx.ContextFailed("ioutil.ReadAll", err)
 		return ""
@@ -465,10 +551,13 @@ func (ctx *Context) ReadString(file vpath.VirtualPath) string {
 
 // Link ...
 func (ctx *Context) Link(from, to vpath.VirtualPath) {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return
 	}
 	defer ctx.setRunningFunction("Link from %s to %s", from.String(), to.String())()
+	if ctx.planned(PlanStep{Op: PlanLink, Paths: vpath.VirtualPathList{from, to}}) {
+		return
+	}
 
 	conn, err := connection.FindHost(from.Host)
 	if err != nil {
@@ -478,15 +567,22 @@ func (ctx *Context) Link(from, to vpath.VirtualPath) {
 	err = conn.Link(from, to)
 	if err != nil {
 		ctx.ContextFailed("conn.Link", err)
+		return
+	}
+	if ctx.journal != nil {
+		ctx.journal.add(journalEntry{op: opCreateFile, conn: conn, file: to})
 	}
 }
 
 // MkDir ...
 func (ctx *Context) MkDir(dir vpath.VirtualPath) {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return
 	}
 	defer ctx.setRunningFunction("MkDir %s", dir.String())()
+	if ctx.planned(PlanStep{Op: PlanMkDir, Paths: vpath.VirtualPathList{dir}}) {
+		return
+	}
 
 	conn, err := connection.FindHost(dir.Host)
 	if err != nil {
@@ -494,6 +590,12 @@ func (ctx *Context) MkDir(dir vpath.VirtualPath) {
 		return
 	}
 
+	err = ctx.journalDir(conn, dir)
+	if err != nil {
+		ctx.ContextFailed("journalDir", err)
+		return
+	}
+
 	err = conn.MkDir(dir)
 	if err != nil {
 		ctx.ContextFailed("conn.MkDir", err)
@@ -502,10 +604,13 @@ func (ctx *Context) MkDir(dir vpath.VirtualPath) {
 
 // RmDir ...
 func (ctx *Context) RmDir(dir vpath.VirtualPath) {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return
 	}
 	defer ctx.setRunningFunction("RmDir %s", dir.String())()
+	if ctx.planned(PlanStep{Op: PlanRmDir, Paths: vpath.VirtualPathList{dir}}) {
+		return
+	}
 
 	conn, err := connection.FindHost(dir.Host)
 	if err != nil {
@@ -521,10 +626,13 @@ func (ctx *Context) RmDir(dir vpath.VirtualPath) {
 
 // RmFile ...
 func (ctx *Context) RmFile(file vpath.VirtualPath) {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return
 	}
 	defer ctx.setRunningFunction("RmFile %s", file.String())()
+	if ctx.planned(PlanStep{Op: PlanRmFile, Paths: vpath.VirtualPathList{file}}) {
+		return
+	}
 
 	conn, err := connection.FindHost(file.Host)
 	if err != nil {
@@ -537,38 +645,15 @@ func (ctx *Context) RmFile(file vpath.VirtualPath) {
 	}
 }
 
-// Exec ...
-func (ctx *Context) Exec(command vpath.VirtualPath, args []string, options *connection.RunOptions) {
-	if options == nil {
-		options = &connection.RunOptions{}
-	}
-
-	/*devNull, err := os.Open(os.DevNull)
-	if err != nil {
-		ctx.ContextFailed("os.Open(os.DevNull)", err)
-	}*/
-
-	options.Stdout = ctx.stdout
-	options.Stderr = ctx.stderr
-	options.Stdin = ctx.stdin
-
-	ctx.LogInfo("START %s %s", command.String(), strings.Join(args, " "))
-	p := ctx.Run(command, args, *options)
-	if p != nil {
-		p.Wait()
-	}
-
-	if ctx.Err == nil {
-		ctx.LogInfo("COMPLETED OK %s", command.String())
-	}
-}
-
 // Run ...
 func (ctx *Context) Run(command vpath.VirtualPath, args []string, options connection.RunOptions) connection.Process {
-	if ctx.Err != nil {
+	if ctx.aborted() {
 		return nil
 	}
 	defer ctx.setRunningFunction("Run %s %s", command.String(), strings.Join(args, " "))()
+	if ctx.planned(runStep(command, args, options)) {
+		return plannedProcess{}
+	}
 
 	//////fmt.Println("find host ", command.Host)
 	conn, err := connection.FindHost(command.Host)
@@ -587,6 +672,8 @@ func (ctx *Context) Run(command vpath.VirtualPath, args []string, options connec
 		return nil
 	}
 
+	ctx.killOnCancel(proc)
+
 	return proc
 }
 
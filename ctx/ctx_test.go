@@ -1,9 +1,19 @@
 package ctx
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/meteocima/virtual-server/config"
 	"github.com/meteocima/virtual-server/connection"
@@ -14,25 +24,40 @@ import (
 
 const sOut = "THIS IS A TEST COMMAND\nTHIS IS AN ERROR COMMAND\n"
 
+// useTestServer starts an in-process ssh server, configured
+// as host `name`, and returns the directory that contains the
+// fixture files on it.
+func useTestServer(t *testing.T, name string) vpath.VirtualPath {
+	srv := testutil.NewSSHServer(t)
+	testutil.CopyFixtures(t, srv.Dir)
+	config.Hosts[name] = srv.Host(name)
+	// connections are cached by FindHost,
+	// so they are closed with the server.
+	t.Cleanup(func() { connection.CloseAll() })
+	return vpath.New(name, srv.Dir)
+}
+
 func TestNew(t *testing.T) {
 	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
 	assert.NoError(t, err)
-	drihmFixt := vpath.New("drihm", "/var/fixtures/")
+	drihmFixt := useTestServer(t, "drihm")
+	localFixt := vpath.Local(t.TempDir())
+	testutil.CopyFixtures(t, localFixt.Path)
 	ctx := Context{}
 	t.Run("Copy", func(t *testing.T) {
 		ctx.Copy(
 			drihmFixt.Join("ciao.txt"),
-			vpath.Local("/tmp/hi"),
+			localFixt.Join("hi"),
 		)
 		assert.NoError(t, ctx.Err)
-		actual := ctx.ReadString(vpath.Local("/tmp/hi"))
+		actual := ctx.ReadString(localFixt.Join("hi"))
 		assert.Equal(t, "ciao\n", actual)
 
 		ctx.RmFile(drihmFixt.Join("added"))
 		ctx.Err = nil
 
 		ctx.Copy(
-			vpath.Local("/tmp/hi"),
+			localFixt.Join("hi"),
 			drihmFixt.Join("added"),
 		)
 		assert.NoError(t, ctx.Err)
@@ -68,9 +93,9 @@ func TestNew(t *testing.T) {
 	})
 
 	t.Run("Run", func(t *testing.T) {
-		testcmd := vpath.Local("/var/fixtures/testcmd")
+		testcmd := localFixt.Join("testcmd")
 		combOut, outWriter := io.Pipe()
-		process := ctx.Run(testcmd, []string{"/var/fixtures/"}, connection.RunOptions{
+		process := ctx.Run(testcmd, []string{localFixt.Path}, connection.RunOptions{
 			Stdout: outWriter,
 			Stderr: outWriter,
 		})
@@ -94,7 +119,7 @@ func TestNew(t *testing.T) {
 	t.Run("ReadDir", func(t *testing.T) {
 		files := ctx.ReadDir(drihmFixt.Join("new-dir"))
 		assert.Equal(t, 4, len(files))
-		assert.Equal(t, "drihm:/var/fixtures/new-dir/file1.txt", files[0].String())
+		assert.Equal(t, drihmFixt.Join("new-dir/file1.txt").String(), files[0].String())
 		assert.NoError(t, ctx.Err)
 	})
 
@@ -149,17 +174,16 @@ func TestNew(t *testing.T) {
 	t.Run("Move", func(t *testing.T) {
 		file := drihmFixt.Join("tbmoved")
 		ctx.WriteString(file, "something")
-		/*
-			ctx.Move(
-				file,
-				vpath.Local("/tmp/tbmoved"),
-			)*/
+		ctx.Move(
+			file,
+			localFixt.Join("tbmoved"),
+		)
 		assert.NoError(t, ctx.Err)
 
-		actual := ctx.ReadString(vpath.Local("/tmp/tbmoved"))
+		actual := ctx.ReadString(localFixt.Join("tbmoved"))
 		assert.Equal(t, "something", actual)
 
-		ctx.RmFile(vpath.Local("/tmp/tbmoved"))
+		ctx.RmFile(localFixt.Join("tbmoved"))
 		assert.False(t, ctx.Exists(file))
 		assert.NoError(t, ctx.Err)
 	})
@@ -170,3 +194,427 @@ func TestNew(t *testing.T) {
 	})
 
 }
+
+func TestCopyPreservesModeAndModTime(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "source.sh")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("echo ciao\n"), os.FileMode(0750)))
+	mtime := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(src, mtime, mtime))
+
+	ctx := New(os.Stdin, ioutil.Discard, ioutil.Discard)
+	ctx.Copy(vpath.Local(src), vpath.Local("%s/target.sh", dir))
+	assert.NoError(t, ctx.Err)
+
+	info, err := os.Stat(filepath.Join(dir, "target.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	assert.True(t, mtime.Equal(info.ModTime()))
+	assert.Equal(t, "echo ciao\n", ctx.ReadString(vpath.Local("%s/target.sh", dir)))
+
+	ctx.Copy(vpath.Local("%s/missing", dir), vpath.Local("%s/target2", dir))
+	assert.Error(t, ctx.Err)
+	assert.True(t, errors.Is(ctx.Err, os.ErrNotExist))
+}
+
+func TestCopyTree(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeFile := func(path, content string) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), os.FileMode(0755)))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), os.FileMode(0644)))
+	}
+	writeFile(filepath.Join(src, "a.txt"), "a")
+	writeFile(filepath.Join(src, "sub", "b.txt"), "b")
+	writeFile(filepath.Join(src, "sub", "deeper", "c.txt"), "c")
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "empty"), os.FileMode(0755)))
+
+	ctx := New(os.Stdin, ioutil.Discard, ioutil.Discard)
+	dst := vpath.Local("%s/dst", dir)
+
+	t.Run("copies all files", func(t *testing.T) {
+		ctx.CopyTree(vpath.Local(src), dst, &CopyTreeOptions{Parallelism: 2})
+		assert.NoError(t, ctx.Err)
+		assert.Equal(t, "a", ctx.ReadString(dst.Join("a.txt")))
+		assert.Equal(t, "b", ctx.ReadString(dst.Join("sub/b.txt")))
+		assert.Equal(t, "c", ctx.ReadString(dst.Join("sub/deeper/c.txt")))
+		assert.True(t, ctx.Exists(dst.Join("empty")))
+	})
+
+	t.Run("skips unchanged files", func(t *testing.T) {
+		// same size and mtime of the source: must not be overwritten
+		target := filepath.Join(dir, "dst", "a.txt")
+		assert.NoError(t, ioutil.WriteFile(target, []byte("X"), os.FileMode(0644)))
+		info, err := os.Stat(filepath.Join(src, "a.txt"))
+		assert.NoError(t, err)
+		assert.NoError(t, os.Chtimes(target, info.ModTime(), info.ModTime()))
+
+		writeFile(filepath.Join(src, "sub", "b.txt"), "changed")
+
+		ctx.CopyTree(vpath.Local(src), dst, &CopyTreeOptions{SkipUnchanged: true})
+		assert.NoError(t, ctx.Err)
+		assert.Equal(t, "X", ctx.ReadString(dst.Join("a.txt")))
+		assert.Equal(t, "changed", ctx.ReadString(dst.Join("sub/b.txt")))
+	})
+
+	t.Run("copies symbolic links as links", func(t *testing.T) {
+		links := filepath.Join(dir, "links")
+		writeFile(filepath.Join(links, "a.txt"), "a")
+		assert.NoError(t, os.Symlink("a.txt", filepath.Join(links, "to-file")))
+		assert.NoError(t, os.Symlink("..", filepath.Join(links, "to-parent")))
+
+		mem := connection.AddMemoryHost("memory")
+		t.Cleanup(func() {
+			delete(config.Hosts, "memory")
+			connection.CloseAll()
+		})
+
+		for _, dst := range []vpath.VirtualPath{vpath.Local("%s/links-dst", dir), vpath.New("memory", "/links")} {
+			ctx.CopyTree(vpath.Local(links), dst, nil)
+			assert.NoError(t, ctx.Err)
+			assert.Equal(t, "a", ctx.ReadString(dst.Join("to-file")))
+			conn, err := connection.FindHost(dst.Host)
+			assert.NoError(t, err)
+			target, err := conn.ReadLink(dst.Join("to-parent"))
+			assert.NoError(t, err)
+			assert.Equal(t, "..", target)
+		}
+		content, err := mem.ReadFile("/links/a.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "a", content)
+
+		// copying again replaces nothing.
+		ctx.CopyTree(vpath.Local(links), vpath.Local("%s/links-dst", dir), nil)
+		assert.NoError(t, ctx.Err)
+	})
+
+	t.Run("fails on missing source", func(t *testing.T) {
+		ctx.CopyTree(vpath.Local("%s/missing", dir), dst, nil)
+		assert.Error(t, ctx.Err)
+		ctx.Err = nil
+	})
+}
+
+func TestMemoryHost(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+
+	mem := connection.AddMemoryHost("memory")
+	t.Cleanup(func() {
+		delete(config.Hosts, "memory")
+		connection.CloseAll()
+	})
+	mem.AddCommand("/bin/wc", func(call *connection.MemoryCall) int {
+		content, err := call.Conn.ReadFile(call.Args[0])
+		if err != nil {
+			fmt.Fprintln(call.Stderr, err.Error())
+			return 1
+		}
+		fmt.Fprintf(call.Stdout, "%d\n", len(content))
+		return 0
+	})
+
+	dir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "input.txt"), []byte("ciao\n"), os.FileMode(0644)))
+
+	var out bytes.Buffer
+	ctx := New(os.Stdin, &out, ioutil.Discard)
+	ctx.MkDir(vpath.New("memory", "/work"))
+	ctx.Copy(vpath.Local("%s/input.txt", dir), vpath.New("memory", "/work/input.txt"))
+	ctx.Exec(vpath.New("memory", "/bin/wc"), []string{"/work/input.txt"}, nil)
+	assert.NoError(t, ctx.Err)
+	assert.Contains(t, out.String(), "5\n")
+	assert.Equal(t, vpath.VirtualPathList{vpath.New("memory", "/work/input.txt")}, ctx.ReadDir(vpath.New("memory", "/work")))
+}
+
+func TestExec(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+
+	sh := vpath.Local("/bin/sh")
+
+	t.Run("fails on non-zero exit code", func(t *testing.T) {
+		var stderr bytes.Buffer
+		ctx := New(os.Stdin, ioutil.Discard, &stderr)
+		ctx.Exec(sh, []string{"-c", "echo first >&2; echo crashed >&2; exit 3"}, nil)
+
+		var exitErr *ExitError
+		assert.True(t, errors.As(ctx.Err, &exitErr))
+		assert.Equal(t, sh, exitErr.Command)
+		assert.Equal(t, 3, exitErr.Code)
+		assert.Equal(t, "first\ncrashed", exitErr.StderrTail)
+		assert.Contains(t, stderr.String(), "first\ncrashed\n")
+		assert.Contains(t, ctx.Err.Error(), "exited with code 3")
+	})
+
+	t.Run("allowed exit codes", func(t *testing.T) {
+		ctx := New(os.Stdin, ioutil.Discard, ioutil.Discard)
+		ctx.Exec(sh, []string{"-c", "exit 1"}, nil, 1)
+		assert.NoError(t, ctx.Err)
+	})
+
+	t.Run("ExecOutput", func(t *testing.T) {
+		var stdout bytes.Buffer
+		ctx := New(os.Stdin, &stdout, ioutil.Discard)
+		out, errOut := ctx.ExecOutput(sh, []string{"-c", "echo out; echo err >&2"}, nil)
+		assert.NoError(t, ctx.Err)
+		assert.Equal(t, "out\n", out)
+		assert.Equal(t, "err\n", errOut)
+		assert.NotContains(t, stdout.String(), "out\n")
+	})
+}
+
+func TestTailBuffer(t *testing.T) {
+	tail := newTailBuffer(10)
+	tail.Write([]byte("first\nsecond\n"))
+	tail.Write([]byte("third\n"))
+	assert.Equal(t, "third", tail.String())
+
+	tail = newTailBuffer(10)
+	tail.Write([]byte("a\nb\n"))
+	assert.Equal(t, "a\nb", tail.String())
+}
+
+func TestCancel(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+
+	t.Run("operations fail on a cancelled context", func(t *testing.T) {
+		goctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ctx := NewWithContext(goctx, os.Stdin, ioutil.Discard, ioutil.Discard)
+		assert.False(t, ctx.Exists(vpath.Local("/tmp")))
+		assert.True(t, errors.Is(ctx.Err, context.Canceled))
+	})
+
+	t.Run("running processes are killed", func(t *testing.T) {
+		ctx := New(os.Stdin, ioutil.Discard, ioutil.Discard)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			ctx.Cancel()
+		}()
+		start := time.Now()
+		ctx.Exec(vpath.Local("sleep"), []string{"30"}, nil)
+		assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+		assert.True(t, errors.Is(ctx.Err, context.Canceled))
+	})
+
+	t.Run("clones are cancelled with their parent", func(t *testing.T) {
+		ctx := New(os.Stdin, ioutil.Discard, ioutil.Discard)
+		clone := ctx.Clone()
+		ctx.Cancel()
+		clone.Glob(vpath.Local("/tmp/*"))
+		assert.True(t, errors.Is(clone.Err, context.Canceled))
+	})
+
+	t.Run("await doesn't wait for cancelled operations", func(t *testing.T) {
+		ctx := New(os.Stdin, ioutil.Discard, ioutil.Discard)
+		ctx.Cancel()
+		release := make(chan struct{})
+		defer close(release)
+		value, err := ctx.await(func() (interface{}, error) {
+			<-release
+			return "completed", nil
+		})
+		assert.Nil(t, value)
+		assert.True(t, errors.Is(err, context.Canceled))
+	})
+
+	t.Run("deadlines abort operations", func(t *testing.T) {
+		goctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		ctx := NewWithContext(goctx, os.Stdin, ioutil.Discard, ioutil.Discard)
+		ctx.Exec(vpath.Local("sleep"), []string{"30"}, nil)
+		assert.True(t, errors.Is(ctx.Err, context.DeadlineExceeded))
+	})
+}
+
+func TestJournal(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+	dir := vpath.Local(t.TempDir())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir.Path, "existing.txt"), []byte("old"), os.FileMode(0640)))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir.Path, "moved.txt"), []byte("moved"), os.FileMode(0644)))
+
+	listAll := func() []string {
+		files := []string{}
+		err := filepath.Walk(dir.Path, func(path string, info os.FileInfo, err error) error {
+			rel, _ := filepath.Rel(dir.Path, path)
+			files = append(files, rel)
+			return err
+		})
+		assert.NoError(t, err)
+		return files
+	}
+	initial := listAll()
+
+	run := func() *Context {
+		ctx := New(os.Stdin, ioutil.Discard, ioutil.Discard)
+		ctx.EnableJournal()
+		assert.True(t, ctx.JournalEnabled())
+		ctx.MkDir(dir.Join("a/b"))
+		ctx.WriteString(dir.Join("a/b/new.txt"), "new")
+		ctx.WriteString(dir.Join("existing.txt"), "overwritten")
+		ctx.Link(dir.Join("existing.txt"), dir.Join("link"))
+		ctx.Move(dir.Join("moved.txt"), dir.Join("a/moved.txt"))
+		w := ctx.OpenWriter(dir.Join("a/written.txt"))
+		if assert.NotNil(t, w) {
+			fmt.Fprint(w, "written")
+			assert.NoError(t, w.Close())
+		}
+		assert.NoError(t, ctx.Err)
+		return ctx
+	}
+
+	t.Run("Rollback does nothing without errors", func(t *testing.T) {
+		ctx := New(os.Stdin, ioutil.Discard, ioutil.Discard)
+		ctx.EnableJournal()
+		ctx.WriteString(dir.Join("tmp.txt"), "tmp")
+		assert.NoError(t, ctx.Rollback())
+		assert.True(t, ctx.Exists(dir.Join("tmp.txt")))
+		ctx.RmFile(dir.Join("tmp.txt"))
+		assert.NoError(t, ctx.Err)
+	})
+
+	t.Run("Rollback reverses all operations", func(t *testing.T) {
+		ctx := run()
+		ctx.SetContextFailed("failed")
+		assert.NoError(t, ctx.Rollback())
+
+		assert.Equal(t, initial, listAll())
+		content, err := ioutil.ReadFile(filepath.Join(dir.Path, "existing.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "old", string(content))
+		info, err := os.Stat(filepath.Join(dir.Path, "existing.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+		content, err = ioutil.ReadFile(filepath.Join(dir.Path, "moved.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "moved", string(content))
+	})
+
+	t.Run("Rollback keeps files not recorded", func(t *testing.T) {
+		ctx := New(os.Stdin, ioutil.Discard, ioutil.Discard)
+		ctx.EnableJournal()
+		ctx.MkDir(dir.Join("out"))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir.Path, "out", "kept.txt"), []byte("kept"), os.FileMode(0644)))
+		ctx.SetContextFailed("failed")
+		assert.Error(t, ctx.Rollback())
+
+		content, err := ioutil.ReadFile(filepath.Join(dir.Path, "out", "kept.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "kept", string(content))
+		assert.NoError(t, os.RemoveAll(filepath.Join(dir.Path, "out")))
+	})
+
+	t.Run("Commit removes backups", func(t *testing.T) {
+		ctx := run()
+		assert.NoError(t, ctx.Commit())
+		assert.Equal(t, []string{".", "a", "a/b", "a/b/new.txt", "a/moved.txt", "a/written.txt", "existing.txt", "link"}, listAll())
+
+		// committed operations are not reversed.
+		ctx.SetContextFailed("failed")
+		assert.NoError(t, ctx.Rollback())
+		content, err := ioutil.ReadFile(filepath.Join(dir.Path, "existing.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "overwritten", string(content))
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+	dir := vpath.Local(t.TempDir())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir.Path, "existing.txt"), []byte("old"), os.FileMode(0644)))
+	out := dir.Join("out")
+
+	var logs bytes.Buffer
+	ctx := New(os.Stdin, &logs, ioutil.Discard)
+	ctx.EnableDryRun()
+	assert.True(t, ctx.DryRun())
+
+	// read-only operations access the hosts.
+	assert.True(t, ctx.Exists(dir.Join("existing.txt")))
+	assert.False(t, ctx.Exists(out))
+
+	ctx.MkDir(out)
+	ctx.WriteString(out.Join("a.txt"), "it's")
+	ctx.Copy(out.Join("a.txt"), out.Join("b.txt"))
+	ctx.Move(out.Join("b.txt"), out.Join("c.txt"))
+	ctx.Link(out.Join("a.txt"), out.Join("link"))
+	w := ctx.Clone().OpenWriter(out.Join("d.txt"))
+	fmt.Fprint(w, "written")
+	assert.NoError(t, w.Close())
+	stdout, _ := ctx.ExecOutput(vpath.Local("/bin/sh"), []string{"-c", "echo $VALUE > e.txt"}, &connection.RunOptions{
+		Cwd: out,
+		Env: []string{"VALUE=from env"},
+	})
+	assert.Equal(t, "", stdout)
+	ctx.RmFile(dir.Join("existing.txt"))
+	assert.NoError(t, ctx.Err)
+
+	files, err := ioutil.ReadDir(dir.Path)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Contains(t, logs.String(), "DRY RUN: mkdir "+out.String())
+
+	steps := ctx.Plan().Steps()
+	ops := []PlanOp{}
+	for _, step := range steps {
+		ops = append(ops, step.Op)
+	}
+	assert.Equal(t, []PlanOp{PlanMkDir, PlanWrite, PlanCopy, PlanMove, PlanLink, PlanWrite, PlanRun, PlanRmFile}, ops)
+	assert.Equal(t, "written", steps[5].Content)
+
+	var encoded bytes.Buffer
+	assert.NoError(t, ctx.Plan().WriteJSON(&encoded))
+	var decoded []PlanStep
+	assert.NoError(t, json.Unmarshal(encoded.Bytes(), &decoded))
+	assert.Equal(t, steps, decoded)
+
+	t.Run("the shell script performs the plan", func(t *testing.T) {
+		var script bytes.Buffer
+		assert.NoError(t, ctx.Plan().WriteShellScript(&script))
+		cmd := exec.Command("/bin/sh", "-c", script.String())
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+
+		read := func(name string) string {
+			content, err := ioutil.ReadFile(filepath.Join(out.Path, name))
+			assert.NoError(t, err)
+			return string(content)
+		}
+		assert.Equal(t, "it's", read("a.txt"))
+		assert.Equal(t, "it's", read("c.txt"))
+		assert.Equal(t, "it's", read("link"))
+		assert.Equal(t, "written", read("d.txt"))
+		assert.Equal(t, "from env\n", read("e.txt"))
+		assert.NoFileExists(t, filepath.Join(out.Path, "b.txt"))
+		assert.NoFileExists(t, filepath.Join(dir.Path, "existing.txt"))
+	})
+
+	t.Run("the shell script builds the environment of the run", func(t *testing.T) {
+		os.Setenv("VS_PLAN_INHERITED", "inherited")
+		os.Setenv("VS_PLAN_UNSET", "unset")
+		defer os.Unsetenv("VS_PLAN_INHERITED")
+		defer os.Unsetenv("VS_PLAN_UNSET")
+
+		run := func(options connection.RunOptions) string {
+			step := runStep(vpath.Local("/bin/sh"), []string{"-c", "echo ${VALUE-}:${VS_PLAN_INHERITED-}:${VS_PLAN_UNSET-}"}, options)
+			output, err := exec.Command("/bin/sh", "-c", step.shellCommand()).CombinedOutput()
+			assert.NoError(t, err, string(output))
+			return strings.TrimSpace(string(output))
+		}
+		assert.Equal(t, "value:inherited:unset", run(connection.RunOptions{Env: []string{"VALUE=value"}}))
+		assert.Equal(t, "value:inherited:", run(connection.RunOptions{Env: []string{"VALUE=value"}, UnsetEnv: []string{"VS_PLAN_UNSET"}}))
+		assert.Equal(t, "value::", run(connection.RunOptions{Env: []string{"VALUE=value"}, EnvMode: connection.EnvReplace}))
+		assert.Equal(t, "::", run(connection.RunOptions{Env: []string{"VALUE=value"}, EnvMode: connection.EnvReplace, UnsetEnv: []string{"VALUE"}}))
+		assert.Equal(t, ":inherited:", run(connection.RunOptions{Env: []string{"VALUE=value"}, EnvMode: connection.EnvInherit, UnsetEnv: []string{"VS_PLAN_UNSET"}}))
+	})
+}
@@ -0,0 +1,137 @@
+package ctx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// ExitError is the error of a command
+// that exited with a not allowed code.
+type ExitError struct {
+	Command vpath.VirtualPath
+	Args    []string
+	Code    int
+	// StderrTail contains the last lines
+	// written by the command on stderr.
+	StderrTail string
+}
+
+func (err *ExitError) Error() string {
+	msg := fmt.Sprintf("`%s` exited with code %d", strings.Join(append([]string{err.Command.String()}, err.Args...), " "), err.Code)
+	if err.StderrTail != "" {
+		msg += ", stderr:\n" + err.StderrTail
+	}
+	return msg
+}
+
+// stderrTailSize is the maximum number of
+// bytes of stderr kept in `ExitError`s.
+const stderrTailSize = 2048
+
+// tailBuffer is an io.Writer that keeps
+// the last `size` bytes written to it.
+type tailBuffer struct {
+	size      int
+	buf       []byte
+	truncated bool
+	lock      *sync.Mutex
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{size: size, lock: &sync.Mutex{}}
+}
+
+func (tail *tailBuffer) Write(p []byte) (int, error) {
+	tail.lock.Lock()
+	defer tail.lock.Unlock()
+	tail.buf = append(tail.buf, p...)
+	if len(tail.buf) > tail.size {
+		tail.buf = append([]byte{}, tail.buf[len(tail.buf)-tail.size:]...)
+		tail.truncated = true
+	}
+	return len(p), nil
+}
+
+// String returns the content of the buffer, without the
+// first line when it has been partially discarded.
+func (tail *tailBuffer) String() string {
+	tail.lock.Lock()
+	defer tail.lock.Unlock()
+	content := tail.buf
+	if tail.truncated {
+		if newline := bytes.IndexByte(content, '\n'); newline != -1 && newline < len(content)-1 {
+			content = content[newline+1:]
+		}
+	}
+	return strings.TrimRight(string(content), "\n")
+}
+
+// Exec runs `command` with the streams of the Context and waits
+// for it to complete. The Context fails with an `*ExitError` when
+// the command exits with a code other than 0 and `allowedExitCodes`.
+func (ctx *Context) Exec(command vpath.VirtualPath, args []string, options *connection.RunOptions, allowedExitCodes ...int) {
+	ctx.exec(command, args, options, ctx.stdout, ctx.stderr, allowedExitCodes)
+}
+
+// ExecOutput runs `command` as Exec does, and returns its stdout
+// and stderr instead of writing them to the streams of the Context.
+// It's meant for commands with a small output.
+func (ctx *Context) ExecOutput(command vpath.VirtualPath, args []string, options *connection.RunOptions, allowedExitCodes ...int) (string, string) {
+	var stdout, stderr bytes.Buffer
+	ctx.exec(command, args, options, &stdout, &stderr, allowedExitCodes)
+	return stdout.String(), stderr.String()
+}
+
+func (ctx *Context) exec(command vpath.VirtualPath, args []string, options *connection.RunOptions, stdout, stderr io.Writer, allowedExitCodes []int) {
+	runOptions := connection.RunOptions{}
+	if options != nil {
+		runOptions = *options
+	}
+
+	tail := newTailBuffer(stderrTailSize)
+	runOptions.Stdout = stdout
+	runOptions.Stderr = io.MultiWriter(stderr, tail)
+	runOptions.Stdin = ctx.stdin
+
+	ctx.LogInfo("START %s %s", command.String(), strings.Join(args, " "))
+	p := ctx.Run(command, args, runOptions)
+	if p == nil {
+		return
+	}
+
+	code, err := p.Wait()
+	if ctx.aborted() {
+		return
+	}
+	if err != nil {
+		ctx.SetContextFailed("Exec %s: process.Wait: %w", command.String(), err)
+		return
+	}
+	if code != 0 && !containsCode(allowedExitCodes, code) {
+		ctx.SetContextFailed("Exec %s: %w", command.String(), &ExitError{
+			Command:    command,
+			Args:       args,
+			Code:       code,
+			StderrTail: tail.String(),
+		})
+		ctx.LogError("FAILED %s: exit code %d", command.String(), code)
+		return
+	}
+
+	ctx.LogInfo("COMPLETED OK %s", command.String())
+}
+
+func containsCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package ctx
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// journalOp is the kind of an undoable operation.
+type journalOp int
+
+const (
+	// opCreateDir records a directory
+	// that didn't exist before the operation.
+	opCreateDir journalOp = iota
+	// opCreateFile records a file or link
+	// that didn't exist before the operation.
+	opCreateFile
+	// opReplaceFile records a file that
+	// has been overwritten or removed,
+	// whose content is saved in a backup.
+	opReplaceFile
+)
+
+type journalEntry struct {
+	op     journalOp
+	conn   connection.Connection
+	file   vpath.VirtualPath
+	backup vpath.VirtualPath
+}
+
+// journal records the operations done on a
+// Context, so that they can be reversed.
+type journal struct {
+	entries []journalEntry
+	backups int
+	lock    *sync.Mutex
+}
+
+func (j *journal) add(entry journalEntry) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.entries = append(j.entries, entry)
+}
+
+// backupPath returns a new path, in the same
+// directory of `file`, where to save its content.
+func (j *journal) backupPath(file vpath.VirtualPath) vpath.VirtualPath {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.backups++
+	dir, name := path.Split(file.Path)
+	return vpath.New(file.Host, "%s.%s.rollback-%d-%d", dir, name, time.Now().UnixNano(), j.backups)
+}
+
+// EnableJournal starts recording the operations done
+// by `MkDir`, `WriteString`, `OpenWriter`, `Link`, `Copy`
+// and `Move`, so that they can be reversed by `Rollback`.
+// Files that these operations overwrite or remove are
+// first copied to backups in the same directory,
+// that are removed by `Commit` or `Rollback`.
+func (ctx *Context) EnableJournal() {
+	if ctx.journal == nil {
+		ctx.journal = &journal{lock: &sync.Mutex{}}
+	}
+}
+
+// JournalEnabled returns whether the
+// operations of the Context are recorded.
+func (ctx *Context) JournalEnabled() bool {
+	return ctx.journal != nil
+}
+
+// fileExists returns whether `file` exists on `conn`.
+func fileExists(conn connection.Connection, file vpath.VirtualPath) (bool, error) {
+	infos, errs := conn.Stat(file)
+	<-infos
+	err := <-errs
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// journalDir records the creation of `dir` and of
+// all its ancestors that don't exist yet.
+func (ctx *Context) journalDir(conn connection.Connection, dir vpath.VirtualPath) error {
+	if ctx.journal == nil {
+		return nil
+	}
+	missing := []vpath.VirtualPath{}
+	for current := dir; current.Path != "/" && current.Path != "." && current.Path != ""; current = current.Dir() {
+		exists, err := fileExists(conn, current)
+		if err != nil {
+			return err
+		}
+		if exists {
+			break
+		}
+		missing = append(missing, current)
+	}
+	// parents are created before children.
+	for i := len(missing) - 1; i >= 0; i-- {
+		ctx.journal.add(journalEntry{op: opCreateDir, conn: conn, file: missing[i]})
+	}
+	return nil
+}
+
+// journalFile records that `file` is about to be
+// written or removed, saving its content if it exists.
+func (ctx *Context) journalFile(conn connection.Connection, file vpath.VirtualPath) error {
+	if ctx.journal == nil {
+		return nil
+	}
+	exists, err := fileExists(conn, file)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		ctx.journal.add(journalEntry{op: opCreateFile, conn: conn, file: file})
+		return nil
+	}
+
+	backup := ctx.journal.backupPath(file)
+	err = copyFile(ctx.GoContext(), conn, conn, file, backup)
+	if err != nil {
+		return fmt.Errorf("backup of `%s`: %w", file.String(), err)
+	}
+	ctx.journal.add(journalEntry{op: opReplaceFile, conn: conn, file: file, backup: backup})
+	return nil
+}
+
+// undo reverses the operation recorded by `entry`.
+// Files and directories already removed are ignored.
+// Created directories are removed only when empty, so
+// that files not recorded in the journal are kept.
+func (entry journalEntry) undo() error {
+	switch entry.op {
+	case opCreateDir:
+		exists, err := fileExists(entry.conn, entry.file)
+		if err != nil || !exists {
+			return err
+		}
+		// RmDir is recursive on some connections,
+		// while RmFile removes only empty directories.
+		return entry.conn.RmFile(entry.file)
+	case opCreateFile:
+		exists, err := fileExists(entry.conn, entry.file)
+		if err != nil || !exists {
+			return err
+		}
+		return entry.conn.RmFile(entry.file)
+	default:
+		// the backup is copied, because the
+		// connections have no rename operation.
+		err := copyFile(context.Background(), entry.conn, entry.conn, entry.backup, entry.file)
+		if err != nil {
+			return err
+		}
+		return entry.conn.RmFile(entry.backup)
+	}
+}
+
+// Rollback reverses, from the last to the first, the
+// operations recorded since `EnableJournal` or the
+// last `Commit`, if the Context failed. It does
+// nothing if `Err` is not set. Created directories that
+// contain files not recorded in the journal are kept, and
+// reported as errors. Rollback tries to undo all
+// operations, also when some of them fail, and returns
+// the first error encountered. The journal is empty
+// when it returns.
+func (ctx *Context) Rollback() error {
+	if ctx.journal == nil || ctx.Err == nil {
+		return nil
+	}
+
+	ctx.journal.lock.Lock()
+	entries := ctx.journal.entries
+	ctx.journal.entries = nil
+	ctx.journal.lock.Unlock()
+
+	var firstErr error
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		err := entry.undo()
+		if err != nil {
+			ctx.LogWarning("Rollback: cannot restore `%s`: %s", entry.file.String(), err.Error())
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Rollback `%s`: %w", entry.file.String(), err)
+			}
+			continue
+		}
+		ctx.LogDetail("Rollback: restored `%s`", entry.file.String())
+	}
+	return firstErr
+}
+
+// Commit empties the journal, removing the
+// backups of overwritten and removed files. The
+// operations done until now cannot be reversed anymore.
+func (ctx *Context) Commit() error {
+	if ctx.journal == nil {
+		return nil
+	}
+
+	ctx.journal.lock.Lock()
+	entries := ctx.journal.entries
+	ctx.journal.entries = nil
+	ctx.journal.lock.Unlock()
+
+	var firstErr error
+	for _, entry := range entries {
+		if entry.op != opReplaceFile {
+			continue
+		}
+		err := entry.conn.RmFile(entry.backup)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Commit: %w", err)
+		}
+	}
+	return firstErr
+}
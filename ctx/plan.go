@@ -0,0 +1,323 @@
+package ctx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// PlanOp is the kind of an operation
+// recorded in a dry-run Plan.
+type PlanOp string
+
+const (
+	// PlanCopy copies Paths[0] to Paths[1].
+	PlanCopy PlanOp = "copy"
+	// PlanCopyTree recursively copies
+	// Paths[0] to Paths[1].
+	PlanCopyTree PlanOp = "copy-tree"
+	// PlanMove moves Paths[0] to Paths[1].
+	PlanMove PlanOp = "move"
+	// PlanMkDir creates the directory Paths[0],
+	// together with its missing parents.
+	PlanMkDir PlanOp = "mkdir"
+	// PlanRmDir removes the directory Paths[0].
+	PlanRmDir PlanOp = "rmdir"
+	// PlanRmFile removes the file Paths[0].
+	PlanRmFile PlanOp = "rmfile"
+	// PlanLink creates Paths[1] as a
+	// symbolic link to Paths[0].
+	PlanLink PlanOp = "link"
+	// PlanWrite writes Content to Paths[0].
+	PlanWrite PlanOp = "write"
+	// PlanAppend appends Content to Paths[0].
+	PlanAppend PlanOp = "append"
+	// PlanRun runs the command Paths[0] with Args,
+	// in the work directory Cwd with Env variables,
+	// and without UnsetEnv variables. When EnvReplace
+	// is set, no other variable is inherited.
+	PlanRun PlanOp = "run"
+)
+
+// PlanStep is an operation that a
+// Context in dry-run mode didn't perform.
+type PlanStep struct {
+	Op         PlanOp                `json:"op"`
+	Paths      vpath.VirtualPathList `json:"paths"`
+	Args       []string              `json:"args,omitempty"`
+	Cwd        string                `json:"cwd,omitempty"`
+	Env        []string              `json:"env,omitempty"`
+	UnsetEnv   []string              `json:"unset-env,omitempty"`
+	EnvReplace bool                  `json:"env-replace,omitempty"`
+	Shell      bool                  `json:"shell,omitempty"`
+	Content    string                `json:"content,omitempty"`
+}
+
+func (step PlanStep) String() string {
+	words := []string{string(step.Op)}
+	for _, p := range step.Paths {
+		words = append(words, p.String())
+	}
+	words = append(words, step.Args...)
+	return strings.Join(words, " ")
+}
+
+// Plan contains the operations that a Context
+// in dry-run mode would have performed, in order.
+type Plan struct {
+	steps []PlanStep
+	lock  *sync.Mutex
+}
+
+// Steps returns the operations recorded until now.
+func (plan *Plan) Steps() []PlanStep {
+	plan.lock.Lock()
+	defer plan.lock.Unlock()
+	return append([]PlanStep{}, plan.steps...)
+}
+
+func (plan *Plan) add(step PlanStep) int {
+	plan.lock.Lock()
+	defer plan.lock.Unlock()
+	plan.steps = append(plan.steps, step)
+	return len(plan.steps) - 1
+}
+
+func (plan *Plan) setContent(index int, content string) {
+	plan.lock.Lock()
+	defer plan.lock.Unlock()
+	plan.steps[index].Content = content
+}
+
+// WriteJSON writes the steps of the
+// plan to `w` as an indented JSON array.
+func (plan *Plan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(plan.Steps())
+	if err != nil {
+		return fmt.Errorf("Plan.WriteJSON: %w", err)
+	}
+	return nil
+}
+
+// WriteShellScript writes to `w` a POSIX shell script that
+// performs the steps of the plan. Operations on hosts other
+// than localhost are run through `ssh`, and files are copied
+// between hosts with `scp`, using host names as ssh destinations.
+// The default environment of hosts is not included.
+func (plan *Plan) WriteShellScript(w io.Writer) error {
+	var script bytes.Buffer
+	script.WriteString("#!/bin/sh\nset -e\n")
+	for _, step := range plan.Steps() {
+		fmt.Fprintf(&script, "\n# %s\n%s\n", step.Op, step.shellCommand())
+	}
+	_, err := w.Write(script.Bytes())
+	if err != nil {
+		return fmt.Errorf("Plan.WriteShellScript: %w", err)
+	}
+	return nil
+}
+
+// onHost returns `command` run on `host`.
+func onHost(host string, command string) string {
+	if host == "localhost" || host == "" {
+		return command
+	}
+	return fmt.Sprintf("ssh %s %s", connection.ShellQuote(host), connection.ShellQuote(command))
+}
+
+// scpPath returns the argument of `scp` for `p`.
+func scpPath(p vpath.VirtualPath) string {
+	if p.Host == "localhost" || p.Host == "" {
+		return connection.ShellQuote(p.Path)
+	}
+	return connection.ShellQuote(p.Host + ":" + p.Path)
+}
+
+// copyCommand returns the shell command
+// that copies `from` to `to`.
+func copyCommand(from, to vpath.VirtualPath, recursive bool) string {
+	if from.Host == to.Host {
+		flags := "-p"
+		if recursive {
+			flags = "-pR"
+		}
+		return onHost(from.Host, fmt.Sprintf("cp %s %s %s", flags, connection.ShellQuote(from.Path), connection.ShellQuote(to.Path)))
+	}
+	flags := "-3 -p"
+	if recursive {
+		flags = "-3 -pr"
+	}
+	return fmt.Sprintf("scp %s %s %s", flags, scpPath(from), scpPath(to))
+}
+
+func (step PlanStep) shellCommand() string {
+	quoted := make([]string, len(step.Paths))
+	for i, p := range step.Paths {
+		quoted[i] = connection.ShellQuote(p.Path)
+	}
+	host := step.Paths[0].Host
+
+	switch step.Op {
+	case PlanCopy:
+		return copyCommand(step.Paths[0], step.Paths[1], false)
+	case PlanCopyTree:
+		return copyCommand(step.Paths[0], step.Paths[1], true)
+	case PlanMove:
+		return copyCommand(step.Paths[0], step.Paths[1], false) + "\n" + onHost(host, "rm "+quoted[0])
+	case PlanMkDir:
+		return onHost(host, "mkdir -p "+quoted[0])
+	case PlanRmDir:
+		return onHost(host, "rm -r "+quoted[0])
+	case PlanRmFile:
+		return onHost(host, "rm "+quoted[0])
+	case PlanLink:
+		return onHost(host, fmt.Sprintf("ln -s %s %s", quoted[0], quoted[1]))
+	case PlanWrite:
+		return onHost(host, fmt.Sprintf("printf '%%s' %s > %s", connection.ShellQuote(step.Content), quoted[0]))
+	case PlanAppend:
+		return onHost(host, fmt.Sprintf("printf '%%s' %s >> %s", connection.ShellQuote(step.Content), quoted[0]))
+	default:
+		words := append([]string{step.Paths[0].Path}, step.Args...)
+		if !step.Shell {
+			for i, word := range words {
+				words[i] = connection.ShellQuote(word)
+			}
+		}
+		command := strings.Join(words, " ")
+		if env := step.envArgs(); len(env) > 0 {
+			if step.Shell {
+				command = "/bin/sh -c " + connection.ShellQuote(command)
+			}
+			command = fmt.Sprintf("env %s %s", strings.Join(env, " "), command)
+		}
+		if step.Cwd != "" {
+			command = fmt.Sprintf("cd %s && %s", connection.ShellQuote(step.Cwd), command)
+		}
+		return onHost(host, "("+command+")")
+	}
+}
+
+// envArgs returns the arguments of `env` that
+// build the environment of a run step, as
+// `connection.EnvReplace` and `RunOptions.UnsetEnv` do.
+func (step PlanStep) envArgs() []string {
+	unset := map[string]bool{}
+	for _, name := range step.UnsetEnv {
+		unset[name] = true
+	}
+
+	args := []string{}
+	if step.EnvReplace {
+		args = append(args, "-i")
+	} else {
+		for _, name := range step.UnsetEnv {
+			args = append(args, "-u", connection.ShellQuote(name))
+		}
+	}
+	for _, variable := range step.Env {
+		if !unset[strings.SplitN(variable, "=", 2)[0]] {
+			args = append(args, connection.ShellQuote(variable))
+		}
+	}
+	return args
+}
+
+// EnableDryRun makes the Context record in a Plan the
+// operations that change files or run processes, instead of
+// performing them. Operations that read files, such as
+// `Exists`, `ReadDir`, `Glob` and `Stat`, still access the hosts.
+// Writers returned by `OpenWriter` and `OpenAppendWriter` record
+// the content written to them, and processes started by `Run`
+// and `Exec` complete immediately with exit code 0,
+// without any output.
+//
+// Clones of the Context record their operations in the same Plan.
+func (ctx *Context) EnableDryRun() {
+	if ctx.plan == nil {
+		ctx.plan = &Plan{lock: &sync.Mutex{}}
+	}
+}
+
+// DryRun returns whether the Context is in dry-run mode.
+func (ctx *Context) DryRun() bool {
+	return ctx.plan != nil
+}
+
+// Plan returns the operations recorded in dry-run
+// mode, or nil if the Context is not in dry-run mode.
+func (ctx *Context) Plan() *Plan {
+	return ctx.plan
+}
+
+// planned records `step` in the plan and returns
+// true when the Context is in dry-run mode.
+func (ctx *Context) planned(step PlanStep) bool {
+	if ctx.plan == nil {
+		return false
+	}
+	ctx.plan.add(step)
+	ctx.LogInfo("DRY RUN: %s", step.String())
+	return true
+}
+
+// plannedWriter is the writer returned by `OpenWriter`
+// in dry-run mode, that records the content written
+// to it in the step at `index` of `plan`.
+type plannedWriter struct {
+	plan    *Plan
+	index   int
+	content *bytes.Buffer
+}
+
+func (w plannedWriter) Write(p []byte) (int, error) {
+	return w.content.Write(p)
+}
+
+func (w plannedWriter) Close() error {
+	w.plan.setContent(w.index, w.content.String())
+	return nil
+}
+
+// plannedWriter returns the writer for
+// `file` in dry-run mode, or nil.
+func (ctx *Context) plannedWriter(op PlanOp, file vpath.VirtualPath) io.WriteCloser {
+	if ctx.plan == nil {
+		return nil
+	}
+	step := PlanStep{Op: op, Paths: vpath.VirtualPathList{file}}
+	ctx.LogInfo("DRY RUN: %s", step.String())
+	return plannedWriter{plan: ctx.plan, index: ctx.plan.add(step), content: &bytes.Buffer{}}
+}
+
+// plannedProcess is the Process returned
+// by `Run` in dry-run mode.
+type plannedProcess struct{}
+
+func (plannedProcess) Wait() (int, error) { return 0, nil }
+func (plannedProcess) Kill() error        { return nil }
+
+// runStep returns the step that
+// records the run of `command`.
+func runStep(command vpath.VirtualPath, args []string, options connection.RunOptions) PlanStep {
+	step := PlanStep{
+		Op:       PlanRun,
+		Paths:    vpath.VirtualPathList{command},
+		Args:     args,
+		Cwd:      options.Cwd.Path,
+		UnsetEnv: options.UnsetEnv,
+		Shell:    options.Shell,
+	}
+	if options.EnvMode != connection.EnvInherit {
+		step.Env = options.Env
+	}
+	step.EnvReplace = options.EnvMode == connection.EnvReplace
+	return step
+}
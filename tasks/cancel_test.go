@@ -0,0 +1,88 @@
+package tasks
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/testutil"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancel(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+	Stdout = ioutil.Discard
+	Stderr = os.Stdout
+
+	t.Run("a scheduled task is cancelled immediately", func(t *testing.T) {
+		ran := false
+		tsk := New("TEST", func(vs *ctx.Context) error {
+			ran = true
+			return nil
+		})
+		tsk.Cancel()
+		assert.NoError(t, MustBeEqual(tsk.Status(), Cancelled))
+
+		tsk.Run()
+		tsk.AwaitDone()
+		assert.False(t, ran)
+		assert.NoError(t, MustBeEqual(tsk.Status(), Cancelled))
+	})
+
+	t.Run("a running task kills its processes", func(t *testing.T) {
+		started := make(chan struct{})
+		tsk := New("TEST", func(vs *ctx.Context) error {
+			close(started)
+			vs.Exec(vpath.Local("sleep"), []string{"30"}, nil)
+			return nil
+		})
+		start := time.Now()
+		tsk.Run()
+		<-started
+		time.Sleep(100 * time.Millisecond)
+		tsk.Cancel()
+		tsk.AwaitDone()
+
+		assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+		assert.NoError(t, MustBeEqual(tsk.Status(), Cancelled))
+	})
+
+	t.Run("cancelling a parent cascades to children", func(t *testing.T) {
+		started := make(chan struct{})
+		children := []*Task{
+			New("CHILD1", func(vs *ctx.Context) error {
+				close(started)
+				<-vs.Done()
+				return nil
+			}),
+			New("CHILD2", func(vs *ctx.Context) error { return nil }),
+			New("CHILD3", func(vs *ctx.Context) error { return nil }),
+		}
+
+		var parent *ParentTask
+		parent = NewParent("PARENT", func(vs *ctx.Context) error {
+			for _, child := range children {
+				parent.AppendChildren(child)
+				parent.RunChild(child)
+			}
+			return nil
+		})
+		parent.SetMaxParallelism(1)
+		parent.Run()
+		<-started
+
+		parent.Cancel()
+		parent.AwaitDone()
+
+		assert.NoError(t, MustBeEqual(parent.Status(), Cancelled))
+		for _, child := range children {
+			assert.NoError(t, MustBeEqual(child.Status(), Cancelled))
+		}
+		assert.False(t, parent.hasWaitingChildren())
+	})
+}
@@ -0,0 +1,137 @@
+package tasks
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SortDependencies sorts `count` items so that each one
+// follows all its dependencies, and returns their indexes
+// in that order. `deps` returns the indexes of the dependencies
+// of an item, and `name` its name, used to describe cycles.
+// It fails if dependencies form a cycle.
+func SortDependencies(count int, deps func(i int) []int, name func(i int) string) ([]int, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make([]int, count)
+	result := []int{}
+
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependencies form a cycle: %s -> %s", strings.Join(path, " -> "), name(i))
+		}
+
+		state[i] = visiting
+		for _, dep := range deps(i) {
+			err := visit(dep, append(path, name(i)))
+			if err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		result = append(result, i)
+		return nil
+	}
+
+	for i := 0; i < count; i++ {
+		err := visit(i, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// sortedChildren returns the children of the parent sorted
+// so that each child follows all its dependencies. It
+// fails if a child depends on a task that is not a child
+// of the parent, or if dependencies contain a cycle.
+func (tsk *ParentTask) sortedChildren() ([]TaskI, error) {
+	tsk.lckChildren.Lock()
+	children := append([]TaskI{}, tsk.childrenOrder...)
+	tsk.lckChildren.Unlock()
+	index := map[TaskI]int{}
+	for i, child := range children {
+		index[child] = i
+	}
+
+	deps := make([][]int, len(children))
+	for i, child := range children {
+		for _, dep := range child.Dependencies() {
+			depIndex, isChild := index[dep]
+			if !isChild {
+				return nil, fmt.Errorf("task `%s` depends on `%s`, that is not a child of `%s`", child.TaskID(), dep.TaskID(), tsk.ID)
+			}
+			deps[i] = append(deps[i], depIndex)
+		}
+	}
+
+	order, err := SortDependencies(
+		len(children),
+		func(i int) []int { return deps[i] },
+		func(i int) string { return children[i].TaskID() },
+	)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]TaskI, len(order))
+	for i, childIndex := range order {
+		result[i] = children[childIndex]
+	}
+	return result, nil
+}
+
+// RunDAG runs all children of the parent, each one as soon
+// as all the tasks it depends on have succeeded or have been
+// skipped. Children whose dependencies failed or have been
+// cancelled are cancelled without running. Children are run
+// with `RunChild`, so they respect max parallelism and
+// the fail fast option.
+//
+// RunDAG checks dependencies before running any child: if a
+// child depends on a task that is not a child of the parent,
+// or if dependencies form a cycle, all children are cancelled
+// and an error is returned. Otherwise, RunDAG returns
+// immediately, and the parent completes when all
+// children have completed.
+func (tsk *ParentTask) RunDAG() error {
+	ordered, err := tsk.sortedChildren()
+	if err != nil {
+		tsk.lckChildren.Lock()
+		children := append([]TaskI{}, tsk.childrenOrder...)
+		tsk.lckChildren.Unlock()
+		for _, child := range children {
+			child.Cancel()
+		}
+		return fmt.Errorf("RunDAG `%s`: %w", tsk.ID, err)
+	}
+
+	for _, child := range ordered {
+		go tsk.runWhenReady(child)
+	}
+	return nil
+}
+
+// runWhenReady runs `child` once all of its dependencies
+// completed, or cancels it if any of them didn't succeed.
+func (tsk *ParentTask) runWhenReady(child TaskI) {
+	deps := child.Dependencies()
+	for _, dep := range deps {
+		dep.AwaitDone()
+	}
+
+	for _, dep := range deps {
+		if !dep.Status().IsSuccess() {
+			child.Cancel()
+			return
+		}
+	}
+
+	tsk.RunChild(child)
+}
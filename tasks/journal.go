@@ -0,0 +1,215 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// journalRecord is a line of a Journal file. Each record
+// contains a status transition of a task, or a file it produced.
+type journalRecord struct {
+	Time   time.Time `json:"time"`
+	Task   string    `json:"task"`
+	Status string    `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	File   *TaskFile `json:"file,omitempty"`
+}
+
+// statusName returns the name of
+// `status` as saved in journals.
+func statusName(status *TaskStatus) string {
+	switch status {
+	case DoneOk:
+		return "DoneOk"
+	case Scheduled, Running, Retrying, Skipped, Cancelled:
+		return status.String()
+	default:
+		if status.IsFailure() {
+			return "Failed"
+		}
+		return status.String()
+	}
+}
+
+// Journal is a file where tasks record their status
+// transitions and the files they produce, one JSON object
+// per line, so that a run that crashed can be resumed.
+// Tasks are identified by their ID, that must be unique
+// and the same in all runs.
+type Journal struct {
+	file *os.File
+	// synchronizes writes to `file`
+	lock *sync.Mutex
+
+	// tasks completed successfully in a
+	// previous run, with the files they produced.
+	completed map[string][]TaskFile
+}
+
+// OpenJournal opens the journal file at `path`, creating it
+// if it doesn't exist. When `resume` is false, the content
+// of the file is discarded. When `resume` is true, tasks that
+// completed successfully in the previous runs recorded in the
+// file are not run again: they complete immediately with
+// `DoneOk` status, emitting again the `FileProduced` events
+// they emitted with `ProduceFile`.
+func OpenJournal(path string, resume bool) (*Journal, error) {
+	flags := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, os.FileMode(0644))
+	if err != nil {
+		return nil, fmt.Errorf("OpenJournal `%s`: os.OpenFile: %w", path, err)
+	}
+
+	journal := &Journal{
+		file:      file,
+		lock:      &sync.Mutex{},
+		completed: map[string][]TaskFile{},
+	}
+	if resume {
+		err = journal.resume()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("OpenJournal `%s`: %w", path, err)
+		}
+	}
+	return journal, nil
+}
+
+// resume loads the records of the journal file,
+// and removes its last line if it's not complete,
+// so that new records can be appended.
+func (journal *Journal) resume() error {
+	content, err := ioutil.ReadAll(journal.file)
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadAll: %w", err)
+	}
+	size, err := journal.load(content)
+	if err != nil {
+		return err
+	}
+	if size < len(content) {
+		err = journal.file.Truncate(int64(size))
+		if err != nil {
+			return fmt.Errorf("file.Truncate: %w", err)
+		}
+	}
+	return nil
+}
+
+// load reads the tasks completed successfully from the
+// records in `content`, and returns the size of its valid
+// records. A task is completed if it has not run again after
+// its last `DoneOk` record. A last line that is not complete,
+// because the process crashed while writing it, is ignored.
+func (journal *Journal) load(content []byte) (int, error) {
+	done := map[string]bool{}
+	files := map[string][]TaskFile{}
+
+	size := 0
+	for size < len(content) {
+		end := bytes.IndexByte(content[size:], '\n')
+		if end == -1 {
+			// records are written together with
+			// their newline, so the line is not complete.
+			break
+		}
+
+		var record journalRecord
+		err := json.Unmarshal(content[size:size+end], &record)
+		if err != nil {
+			return 0, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		size += end + 1
+
+		if record.File != nil {
+			files[record.Task] = append(files[record.Task], *record.File)
+			continue
+		}
+		switch record.Status {
+		case statusName(DoneOk):
+			done[record.Task] = true
+		case statusName(Running):
+			// files produced by previous
+			// attempts are discarded.
+			done[record.Task] = false
+			delete(files, record.Task)
+		}
+	}
+
+	for task, isDone := range done {
+		if isDone {
+			journal.completed[task] = files[task]
+		}
+	}
+	return size, nil
+}
+
+// write appends `record` to the journal file, and
+// flushes it to disk before returning.
+func (journal *Journal) write(record journalRecord) error {
+	record.Time = time.Now()
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	_, err = journal.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("file.Write: %w", err)
+	}
+	return journal.file.Sync()
+}
+
+func (journal *Journal) recordStatus(taskID string, status *TaskStatus) error {
+	record := journalRecord{Task: taskID, Status: statusName(status)}
+	if status.IsFailure() {
+		record.Error = status.Err.Error()
+	}
+	return journal.write(record)
+}
+
+func (journal *Journal) recordFile(taskID string, file TaskFile) error {
+	return journal.write(journalRecord{Task: taskID, File: &file})
+}
+
+// Completed returns whether the task with `taskID` completed
+// successfully in a previous run, and the files it produced.
+func (journal *Journal) Completed(taskID string) (bool, []TaskFile) {
+	files, ok := journal.completed[taskID]
+	return ok, files
+}
+
+// Close closes the journal file.
+func (journal *Journal) Close() error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	return journal.file.Close()
+}
+
+var currentJournal *Journal
+var currentJournalLock = &sync.Mutex{}
+
+// UseJournal makes all tasks record their status transitions
+// and produced files to `journal`. A nil `journal` stops
+// the recording.
+func UseJournal(journal *Journal) {
+	currentJournalLock.Lock()
+	defer currentJournalLock.Unlock()
+	currentJournal = journal
+}
+
+func getJournal() *Journal {
+	currentJournalLock.Lock()
+	defer currentJournalLock.Unlock()
+	return currentJournal
+}
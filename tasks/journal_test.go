@@ -0,0 +1,125 @@
+package tasks
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/event"
+	"github.com/meteocima/virtual-server/testutil"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+	Stdout = ioutil.Discard
+	Stderr = os.Stdout
+	journalFile := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	runs := map[string]int{}
+	newTasks := func(failing bool) (*Task, *Task, chan TaskFile) {
+		produced := make(chan TaskFile, 2)
+		var download *Task
+		download = New("JOURNAL-DOWNLOAD", func(vs *ctx.Context) error {
+			runs[download.ID]++
+			download.ProduceFile(TaskFile{Path: vpath.Local("/data/gfs.grb"), Meta: "gfs"})
+			return nil
+		})
+		download.FileProduced.Listen(func(ev *event.Event) {
+			produced <- ev.Payload.(TaskFile)
+		})
+		var simulation *Task
+		simulation = New("JOURNAL-SIMULATION", func(vs *ctx.Context) error {
+			runs[simulation.ID]++
+			if failing {
+				return errors.New("simulation crashed")
+			}
+			return nil
+		})
+		return download, simulation, produced
+	}
+	runAll := func(tsks ...*Task) {
+		for _, tsk := range tsks {
+			tsk.Run()
+			tsk.AwaitDone()
+		}
+	}
+
+	t.Run("tasks record their status transitions", func(t *testing.T) {
+		journal, err := OpenJournal(journalFile, false)
+		require.NoError(t, err)
+		UseJournal(journal)
+		defer UseJournal(nil)
+
+		download, simulation, produced := newTasks(true)
+		runAll(download, simulation)
+		assert.Equal(t, TaskFile{Path: vpath.Local("/data/gfs.grb"), Meta: "gfs"}, <-produced)
+		assert.NoError(t, journal.Close())
+
+		content, err := ioutil.ReadFile(journalFile)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		assert.Len(t, lines, 7)
+		assert.Contains(t, lines[0], `"task":"JOURNAL-DOWNLOAD","status":"Scheduled"`)
+		assert.Contains(t, string(content), `"task":"JOURNAL-DOWNLOAD","file":{"Path":"localhost:/data/gfs.grb","Meta":"gfs"}`)
+		assert.Contains(t, string(content), `"task":"JOURNAL-DOWNLOAD","status":"DoneOk"`)
+		assert.Contains(t, string(content), `"task":"JOURNAL-SIMULATION","status":"Failed","error":"simulation crashed"`)
+	})
+
+	t.Run("resumed runs skip completed tasks", func(t *testing.T) {
+		// simulate a crash while writing a record.
+		f, err := os.OpenFile(journalFile, os.O_APPEND|os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"time":"2020-12-25T00:00:00Z","task":"JOURN`)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		journal, err := OpenJournal(journalFile, true)
+		require.NoError(t, err)
+		UseJournal(journal)
+		defer UseJournal(nil)
+
+		completed, files := journal.Completed("JOURNAL-DOWNLOAD")
+		assert.True(t, completed)
+		assert.Equal(t, []TaskFile{{Path: vpath.Local("/data/gfs.grb"), Meta: "gfs"}}, files)
+		completed, _ = journal.Completed("JOURNAL-SIMULATION")
+		assert.False(t, completed)
+
+		download, simulation, produced := newTasks(false)
+		runAll(download, simulation)
+		assert.Equal(t, TaskFile{Path: vpath.Local("/data/gfs.grb"), Meta: "gfs"}, <-produced)
+		assert.Equal(t, DoneOk, download.Status())
+		assert.Equal(t, DoneOk, simulation.Status())
+		assert.Equal(t, map[string]int{"JOURNAL-DOWNLOAD": 1, "JOURNAL-SIMULATION": 2}, runs)
+		assert.NoError(t, journal.Close())
+
+		// the incomplete record has been removed.
+		journal, err = OpenJournal(journalFile, true)
+		require.NoError(t, err)
+		completed, _ = journal.Completed("JOURNAL-SIMULATION")
+		assert.True(t, completed)
+		assert.NoError(t, journal.Close())
+	})
+
+	t.Run("corrupted journals are not resumed", func(t *testing.T) {
+		corrupted := filepath.Join(t.TempDir(), "journal.jsonl")
+		require.NoError(t, ioutil.WriteFile(corrupted, []byte("{\"task\":\"A\",\"sta\n{\"task\":\"A\",\"status\":\"DoneOk\"}\n"), 0644))
+		_, err := OpenJournal(corrupted, true)
+		assert.Error(t, err)
+
+		journal, err := OpenJournal(corrupted, false)
+		require.NoError(t, err)
+		assert.NoError(t, journal.Close())
+		info, err := os.Stat(corrupted)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), info.Size())
+	})
+}
@@ -24,7 +24,9 @@ import (
 // after any children had failed.
 //
 // It's the parent task responsibility to run children when
-// appropriate, using `RunChild` method.
+// appropriate, using `RunChild` method, or to run all of them
+// respecting the dependencies declared with `DependsOn`,
+// using `RunDAG` method.
 //
 // Number of children tasks that can runs concurrently can be
 // limited using `SetMaxParallelism` method.
@@ -46,6 +48,8 @@ type ParentTask struct {
 	// set of children task. each children could be a Task or another ParentTask
 	// so the variable store TaskI interfaces.
 	children map[TaskI]struct{}
+	// children in the order they were appended
+	childrenOrder []TaskI
 	// set of task that are waiting for execution. When a task is tentatively run using
 	// RunChild, if it cannot immediately run because it would overflow max parallelism,
 	// it's stored here and later retrieved when enough running task completed in order
@@ -57,6 +61,7 @@ type ParentTask struct {
 	failfast            bool
 	failed              *abool.AtomicBool
 	someChildrenStarted *abool.AtomicBool
+	cancelled           *abool.AtomicBool
 
 	// synchronizes `waitingChildren` members access
 	sem *sync.Mutex
@@ -75,6 +80,8 @@ type TaskI interface {
 	SetCompleted(err error)
 	AwaitDone()
 	TaskID() string
+	Cancel()
+	Dependencies() []TaskI
 }
 
 func (tsk *ParentTask) setFailed(value bool) {
@@ -85,24 +92,51 @@ func (tsk *ParentTask) getFailed() bool {
 	return tsk.failed.IsSet()
 }
 
-func (tsk *ParentTask) popWaitingChild() TaskI {
+// acquireSlotOrWait takes a slot in `runningChild` for
+// `child` and returns true, or stores the child in the
+// waiting queue when all slots are taken. Both happen
+// under `sem`, together with `releaseSlot`, so that a
+// queued child is always seen by the next released slot.
+func (tsk *ParentTask) acquireSlotOrWait(child TaskI) bool {
 	tsk.sem.Lock()
 	defer tsk.sem.Unlock()
+	select {
+	case tsk.runningChild <- struct{}{}:
+		return true
+	default:
+		tsk.waitingChildren = append(tsk.waitingChildren, child)
+		return false
+	}
+}
+
+// releaseSlot frees a slot in `runningChild`, and returns
+// the first waiting child, if any, removing it from the queue.
+func (tsk *ParentTask) releaseSlot() TaskI {
+	tsk.sem.Lock()
+	defer tsk.sem.Unlock()
+	<-tsk.runningChild
+	if len(tsk.waitingChildren) == 0 {
+		return nil
+	}
 	next := tsk.waitingChildren[0]
 	tsk.waitingChildren = tsk.waitingChildren[1:]
 	return next
 }
 
-func (tsk *ParentTask) pushWaitingChild(child TaskI) {
+func (tsk *ParentTask) setWaitingChild(value []TaskI) {
 	tsk.sem.Lock()
 	defer tsk.sem.Unlock()
-	tsk.waitingChildren = append(tsk.waitingChildren, child)
+	tsk.waitingChildren = value
 }
 
-func (tsk *ParentTask) setWaitingChild(value []TaskI) {
+// drainWaitingChildren empties the waiting
+// children queue and returns its content.
+func (tsk *ParentTask) drainWaitingChildren() []TaskI {
 	tsk.sem.Lock()
 	defer tsk.sem.Unlock()
-	tsk.waitingChildren = value
+	waiting := tsk.waitingChildren
+	tsk.waitingChildren = []TaskI{}
+	return waiting
 }
 
 func (tsk *ParentTask) hasWaitingChildren() bool {
@@ -124,6 +158,7 @@ func (tsk *ParentTask) AppendChildren(children ...TaskI) {
 			panic(fmt.Sprintf("Task %s already appended", child.TaskID()))
 		}
 		tsk.children[child] = struct{}{}
+		tsk.childrenOrder = append(tsk.childrenOrder, child)
 	}
 }
 
@@ -143,6 +178,13 @@ func (tsk *ParentTask) TaskID() string {
 func (tsk *ParentTask) RunChild(child TaskI) {
 	tsk.someChildrenStarted.Set()
 
+	if tsk.cancelled.IsSet() {
+		// the parent has been cancelled, so
+		// children are cancelled as well.
+		child.Cancel()
+		return
+	}
+
 	if tsk.runningChild == nil {
 		// no max parallelism, so just run the task.
 
@@ -170,43 +212,37 @@ func (tsk *ParentTask) RunChild(child TaskI) {
 		return
 	}
 
-	select {
-	case tsk.runningChild <- struct{}{}:
-		// tsk.runningChild accepted the child in cache,
-		// that means max parallelism is respected, and the
-		// child is consuming 1 slot in runningChild chan cache.
-		go func() {
-			child.AwaitDone()
-			// task has done, free 1 slot in runningChild chan cache.
-			<-tsk.runningChild
-
-			// when failfast option is set, set the whole task has failed.
-			if tsk.failfast && child.Status().IsFailure() {
-				tsk.setFailed(true)
-			}
+	if !tsk.acquireSlotOrWait(child) {
+		// max parallelism reached. The child
+		// has been stored in waiting store, in
+		// order to be picked later for execution.
+		return
+	}
 
-			if tsk.hasWaitingChildren() {
-				// there is at least one waiting child task,
-				// pick and run it.
-				tsk.RunChild(tsk.popWaitingChild())
-			}
-		}()
+	// the child is consuming 1 slot in runningChild
+	// chan cache, so max parallelism is respected.
+	go func() {
+		child.AwaitDone()
 
-		if tsk.getFailed() {
-			// another child already failed, and failfast option is set.
-			child.SetCompleted(errors.New("tasks cancelled by parent"))
-			return
+		// when failfast option is set, set the whole task has failed.
+		if tsk.failfast && child.Status().IsFailure() {
+			tsk.setFailed(true)
 		}
 
-		child.Run()
+		// task has done, free 1 slot in runningChild chan cache,
+		// and run the first waiting child task, if any.
+		if next := tsk.releaseSlot(); next != nil {
+			tsk.RunChild(next)
+		}
+	}()
 
-	default:
-		// max parallelism reached. Store
-		// child task in waiting store, in
-		// order to be picked later for execution.
-		tsk.pushWaitingChild(child)
+	if tsk.getFailed() {
+		// another child already failed, and failfast option is set.
+		child.SetCompleted(errors.New("tasks cancelled by parent"))
+		return
 	}
 
+	child.Run()
 }
 
 // SetMaxParallelism sets the maximum allowed number of
@@ -224,6 +260,31 @@ func (tsk *ParentTask) SetMaxParallelism(count uint) {
 	tsk.runningChild = make(chan struct{}, count)
 }
 
+// Cancel cancels the parent task and all of its
+// children. Children that are waiting to run because of
+// max parallelism are removed from the queue and
+// cancelled as well, and children scheduled later with
+// `RunChild` are immediately cancelled.
+func (tsk *ParentTask) Cancel() {
+	tsk.cancelled.Set()
+	tsk.Task.Cancel()
+
+	for _, child := range tsk.drainWaitingChildren() {
+		child.Cancel()
+	}
+
+	tsk.lckChildren.Lock()
+	children := make([]TaskI, 0, len(tsk.children))
+	for child := range tsk.children {
+		children = append(children, child)
+	}
+	tsk.lckChildren.Unlock()
+
+	for _, child := range children {
+		child.Cancel()
+	}
+}
+
 // SetFailFast makes the parent fails
 // on first child failure.
 func (tsk *ParentTask) SetFailFast() {
@@ -240,6 +301,7 @@ func NewParent(ID string, runner TaskRunner) *ParentTask {
 		children:            map[TaskI]struct{}{},
 		failed:              abool.New(),
 		someChildrenStarted: abool.New(),
+		cancelled:           abool.New(),
 	}
 
 	tsk.Task = New(ID, wrapRunner(runner, &tsk))
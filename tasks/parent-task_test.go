@@ -3,6 +3,7 @@ package tasks
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
@@ -309,3 +310,151 @@ func TestParentTask(t *testing.T) {
 	})
 
 }
+
+func TestRunDAG(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+	Stdout = os.Stdout
+	Stderr = os.Stdout
+
+	emit := func(results chan string, ID string, err error) *Task {
+		return New(ID, func(vs *ctx.Context) error {
+			results <- ID
+			return err
+		})
+	}
+
+	t.Run("children run after their dependencies", func(t *testing.T) {
+		results := make(chan string, 4)
+		last := emit(results, "DAG-LAST", nil)
+		left := emit(results, "DAG-LEFT", nil)
+		right := emit(results, "DAG-RIGHT", nil)
+		first := emit(results, "DAG-FIRST", nil)
+		last.DependsOn(left, right)
+		left.DependsOn(first)
+		right.DependsOn(first)
+
+		var parent *ParentTask
+		parent = NewParent("DAG-PARENT", func(vs *ctx.Context) error {
+			parent.AppendChildren(last, left, right, first)
+			return parent.RunDAG()
+		})
+		parent.SetMaxParallelism(1)
+		parent.Run()
+		parent.AwaitDone()
+
+		order := readResults(t, results, 4)
+		assert.Equal(t, "DAG-FIRST", order[0])
+		assert.ElementsMatch(t, []string{"DAG-LEFT", "DAG-RIGHT"}, order[1:3])
+		assert.Equal(t, "DAG-LAST", order[3])
+		assert.Equal(t, DoneOk, parent.Status())
+		for _, child := range []*Task{first, left, right, last} {
+			assert.Equal(t, DoneOk, child.Status())
+		}
+	})
+
+	t.Run("dependents of a failed child are cancelled", func(t *testing.T) {
+		results := make(chan string, 4)
+		broken := emit(results, "DAG-BROKEN", errors.New("broken"))
+		after := emit(results, "DAG-AFTER", nil)
+		afterAfter := emit(results, "DAG-AFTER-AFTER", nil)
+		independent := emit(results, "DAG-INDEPENDENT", nil)
+		after.DependsOn(broken)
+		afterAfter.DependsOn(after)
+
+		var parent *ParentTask
+		parent = NewParent("DAG-PARENT", func(vs *ctx.Context) error {
+			parent.AppendChildren(broken, after, afterAfter, independent)
+			return parent.RunDAG()
+		})
+		parent.Run()
+		parent.AwaitDone()
+
+		assert.ElementsMatch(t, []string{"DAG-BROKEN", "DAG-INDEPENDENT"}, readResults(t, results, 2))
+		assert.True(t, broken.Status().IsFailure())
+		assert.Equal(t, Cancelled, after.Status())
+		assert.Equal(t, Cancelled, afterAfter.Status())
+		assert.Equal(t, DoneOk, independent.Status())
+	})
+
+	t.Run("cycles are detected before running", func(t *testing.T) {
+		results := make(chan string, 3)
+		a := emit(results, "DAG-A", nil)
+		b := emit(results, "DAG-B", nil)
+		c := emit(results, "DAG-C", nil)
+		a.DependsOn(c)
+		b.DependsOn(a)
+		c.DependsOn(b)
+
+		var parent *ParentTask
+		parent = NewParent("DAG-PARENT", func(vs *ctx.Context) error {
+			parent.AppendChildren(a, b, c)
+			return parent.RunDAG()
+		})
+		parent.Run()
+		parent.AwaitDone()
+
+		require.True(t, parent.Status().IsFailure())
+		assert.Equal(t, "RunDAG `DAG-PARENT`: dependencies form a cycle: DAG-A -> DAG-C -> DAG-B -> DAG-A", parent.Status().Err.Error())
+		assert.Equal(t, 0, len(results))
+		for _, child := range []*Task{a, b, c} {
+			assert.Equal(t, Cancelled, child.Status())
+		}
+	})
+
+	t.Run("children are not lost with max parallelism", func(t *testing.T) {
+		Stdout = ioutil.Discard
+		Stderr = ioutil.Discard
+		defer func() {
+			Stdout = os.Stdout
+			Stderr = os.Stdout
+		}()
+
+		for i := 0; i < 500; i++ {
+			results := make(chan string, 3)
+			a := emit(results, "DAG-STRESS-A", nil)
+			b := emit(results, "DAG-STRESS-B", nil)
+			c := emit(results, "DAG-STRESS-C", nil)
+			b.DependsOn(a)
+
+			var parent *ParentTask
+			parent = NewParent("DAG-STRESS", func(vs *ctx.Context) error {
+				parent.AppendChildren(a, b, c)
+				return parent.RunDAG()
+			})
+			parent.SetMaxParallelism(1)
+			parent.Run()
+
+			done := make(chan struct{})
+			go func() {
+				parent.AwaitDone()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("iteration %d: parent never completed", i)
+			}
+			assert.Equal(t, DoneOk, parent.Status())
+			assert.ElementsMatch(t, []string{"DAG-STRESS-A", "DAG-STRESS-B", "DAG-STRESS-C"}, readResults(t, results, 3))
+		}
+	})
+
+	t.Run("dependencies must be children of the parent", func(t *testing.T) {
+		results := make(chan string, 1)
+		child := emit(results, "DAG-CHILD", nil)
+		child.DependsOn(New("DAG-STRANGER", func(vs *ctx.Context) error { return nil }))
+
+		var parent *ParentTask
+		parent = NewParent("DAG-PARENT", func(vs *ctx.Context) error {
+			parent.AppendChildren(child)
+			return parent.RunDAG()
+		})
+		parent.Run()
+		parent.AwaitDone()
+
+		require.True(t, parent.Status().IsFailure())
+		assert.Contains(t, parent.Status().Err.Error(), "task `DAG-CHILD` depends on `DAG-STRANGER`, that is not a child of `DAG-PARENT`")
+		assert.Equal(t, Cancelled, child.Status())
+	})
+}
@@ -0,0 +1,84 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how a task that
+// fails is run again.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times
+	// the task runs, including the first one.
+	// Values lower than 2 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the time waited
+	// before the first retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff limits the time waited between
+	// two attempts. 0 means no limit.
+	MaxBackoff time.Duration
+
+	// Multiplier is the factor by which the backoff
+	// grows after each retry. Values lower than 1
+	// mean 2, the default.
+	Multiplier float64
+
+	// Jitter is the fraction of the backoff that is
+	// randomized, between 0 and 1: with a jitter of 0.2,
+	// a backoff of 10s becomes a random time between 8s
+	// and 12s. It avoids that tasks failed together
+	// retry together.
+	Jitter float64
+
+	// Retryable returns whether a failure with `err` should
+	// be retried. When nil, all errors are retried. Tasks
+	// that have been cancelled are never retried.
+	Retryable func(err error) bool
+}
+
+// backoff returns the time to wait
+// before the attempt number `attempt`,
+// that must be greater than 1.
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	backoff := float64(policy.InitialBackoff)
+	for i := 2; i < attempt; i++ {
+		backoff *= multiplier
+		if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+			break
+		}
+	}
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+
+	if policy.Jitter > 0 {
+		jitter := policy.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		backoff += backoff * jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(backoff)
+}
+
+// shouldRetry returns whether a task that failed with
+// `err` at attempt number `attempt` must run again.
+func (policy *RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if policy == nil || err == nil || attempt >= policy.MaxAttempts {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	return policy.Retryable == nil || policy.Retryable(err)
+}
@@ -24,6 +24,10 @@ func (st *TaskStatus) String() string {
 		return "Cancelled"
 	case Running:
 		return "Running"
+	case Retrying:
+		return "Retrying"
+	case Skipped:
+		return "Skipped"
 	case Scheduled:
 		return "Scheduled"
 	default:
@@ -40,6 +44,10 @@ var Scheduled = &TaskStatus{}
 // DoneOk is the status of a task successfully executed
 var DoneOk = &TaskStatus{}
 
+// Skipped is the status of a task that didn't
+// run because its outputs were up to date.
+var Skipped = &TaskStatus{}
+
 // Failed returns the status of a task that failed with an error
 func Failed(err error) *TaskStatus {
 	return &TaskStatus{err}
@@ -50,11 +58,24 @@ func (st *TaskStatus) IsFailure() bool {
 	return st.Err != nil
 }
 
+// IsSuccess returns whether the task status represents
+// a success, either because the task completed or
+// because it was skipped.
+func (st *TaskStatus) IsSuccess() bool {
+	return st == DoneOk || st == Skipped
+}
+
 // Running is the status of a running task
 var Running = &TaskStatus{}
 
+// Retrying is the status of a task that failed,
+// and is waiting to run again because of its
+// `RetryPolicy`.
+var Retrying = &TaskStatus{}
+
 // Cancelled is the status of a task that won't run, because
-// one of it's prerequisites has failed
+// one of it's prerequisites has failed, or that has been
+// stopped using its `Cancel` method.
 var Cancelled = &TaskStatus{}
 
 /*
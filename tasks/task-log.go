@@ -0,0 +1,206 @@
+package tasks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// LogFiles is the template of the path of the log file
+// of each task, in `host:path` form. `{id}` in the template
+// is replaced by the ID of the task. A task log file receives
+// the log lines of the task `ctx.Context` and the output of the
+// processes it runs. When empty, tasks write to `Stdout` and
+// `Stderr` instead.
+var LogFiles string
+
+// TeeLogs makes tasks with a log file write their lines to
+// `Stdout` and `Stderr` too, each one prefixed by the task ID.
+var TeeLogs bool
+
+// LogFile returns the path of the log
+// file of the task, as built from `LogFiles`.
+func (tsk *Task) LogFile() vpath.VirtualPath {
+	return vpath.FromS(strings.ReplaceAll(LogFiles, "{id}", tsk.ID))
+}
+
+// openLog opens the log file of the task, if
+// `LogFiles` is set, and makes it the task
+// stdout and stderr. When the file cannot be
+// opened, the task writes to `Stdout` and `Stderr`.
+func (tsk *Task) openLog() {
+	tsk.stdout = Stdout
+	tsk.stderr = Stderr
+	if LogFiles == "" {
+		return
+	}
+
+	logFile := tsk.LogFile()
+	// the log is not bound to the task context,
+	// so that it's still written when the task
+	// is cancelled. Failures are reported below.
+	vs := ctx.New(os.Stdin, ioutil.Discard, ioutil.Discard)
+	vs.ID = tsk.ID
+	vs.MkDir(logFile.Dir())
+	file := vs.OpenWriter(logFile)
+	vs.Close()
+	if vs.Err != nil {
+		if Stderr != nil {
+			fmt.Fprintf(Stderr, "WARNING: %s: cannot open log file: %s\n", tsk.ID, vs.Err.Error())
+		}
+		return
+	}
+
+	// stdout and stderr of processes are
+	// written concurrently to the same file.
+	locked := &lockedWriteCloser{WriteCloser: file, lock: &sync.Mutex{}}
+	if !TeeLogs {
+		tsk.log = locked
+		tsk.stdout = locked
+		tsk.stderr = locked
+		return
+	}
+
+	prefix := []byte("[" + tsk.ID + "] ")
+	log := &teeLog{WriteCloser: locked}
+	var teeStdout, teeStderr []io.Writer
+	if Stdout != nil {
+		tee := &prefixWriter{w: Stdout, prefix: prefix, lock: &sync.Mutex{}}
+		log.tees = append(log.tees, tee)
+		teeStdout = append(teeStdout, tee)
+	}
+	if Stderr != nil {
+		tee := &prefixWriter{w: Stderr, prefix: prefix, lock: &sync.Mutex{}}
+		log.tees = append(log.tees, tee)
+		teeStderr = append(teeStderr, tee)
+	}
+	tsk.log = log
+	tsk.stdout = NewMultiWriteCloser(locked, teeStdout...)
+	tsk.stderr = NewMultiWriteCloser(locked, teeStderr...)
+}
+
+// closeLog closes the log file of the task, if any.
+func (tsk *Task) closeLog() {
+	if tsk.log == nil {
+		return
+	}
+	err := tsk.log.Close()
+	if err != nil && Stderr != nil {
+		fmt.Fprintf(Stderr, "WARNING: %s: cannot close log file: %s\n", tsk.ID, err.Error())
+	}
+	tsk.log = nil
+}
+
+// lockedWriteCloser is an io.WriteCloser
+// that can be written concurrently.
+type lockedWriteCloser struct {
+	io.WriteCloser
+	lock *sync.Mutex
+}
+
+func (lwc *lockedWriteCloser) Write(p []byte) (int, error) {
+	lwc.lock.Lock()
+	defer lwc.lock.Unlock()
+	return lwc.WriteCloser.Write(p)
+}
+
+func (lwc *lockedWriteCloser) Close() error {
+	lwc.lock.Lock()
+	defer lwc.lock.Unlock()
+	return lwc.WriteCloser.Close()
+}
+
+// teeLock serializes the writes of all
+// tasks to `Stdout` and `Stderr`.
+var teeLock = &sync.Mutex{}
+
+// teeLog is the log file of a task whose lines
+// are tee'd to `Stdout` and `Stderr`. Closing it
+// writes the last unterminated lines too.
+type teeLog struct {
+	io.WriteCloser
+	tees []*prefixWriter
+}
+
+func (log *teeLog) Close() error {
+	var flushErr error
+	for _, tee := range log.tees {
+		if err := tee.flush(); err != nil && flushErr == nil {
+			flushErr = err
+		}
+	}
+	err := log.WriteCloser.Close()
+	if err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// prefixWriter writes to `w` all lines written
+// to it, each one preceded by `prefix`. Lines are
+// written only when complete, with a single `Write`
+// under `teeLock`, so that lines of different
+// tasks never mix.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	// unterminated line, written
+	// when completed or flushed
+	pending []byte
+	lock    *sync.Mutex
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+
+	pw.pending = append(pw.pending, p...)
+	end := bytes.LastIndexByte(pw.pending, '\n')
+	if end == -1 {
+		return len(p), nil
+	}
+	err := pw.writeLines(pw.pending[:end+1])
+	pw.pending = append(pw.pending[:0], pw.pending[end+1:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes the unterminated line, if any,
+// ending it with a newline.
+func (pw *prefixWriter) flush() error {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+
+	if len(pw.pending) == 0 {
+		return nil
+	}
+	err := pw.writeLines(append(pw.pending, '\n'))
+	pw.pending = nil
+	return err
+}
+
+// writeLines writes `lines`, that must end with
+// a newline, prefixing each one with `prefix`.
+func (pw *prefixWriter) writeLines(lines []byte) error {
+	var buf bytes.Buffer
+	for len(lines) > 0 {
+		end := bytes.IndexByte(lines, '\n')
+		buf.Write(pw.prefix)
+		buf.Write(lines[:end+1])
+		lines = lines[end+1:]
+	}
+
+	teeLock.Lock()
+	defer teeLock.Unlock()
+	_, err := pw.w.Write(buf.Bytes())
+	return err
+}
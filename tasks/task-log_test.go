@@ -0,0 +1,143 @@
+package tasks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/testutil"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFiles(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	LogFiles = "localhost:" + filepath.Join(dir, "logs", "{id}.log")
+	defer func() {
+		LogFiles = ""
+		TeeLogs = false
+	}()
+
+	runTask := func(ID string) (string, string) {
+		stdout := bytes.Buffer{}
+		Stdout = &stdout
+		Stderr = &stdout
+		tsk := New(ID, func(vs *ctx.Context) error {
+			vs.Exec(vpath.Local("/bin/sh"), []string{"-c", "echo out; echo err >&2"}, nil)
+			return nil
+		})
+		tsk.Description = "A task with a log file."
+		assert.Equal(t, vpath.Local(filepath.Join(dir, "logs", ID+".log")), tsk.LogFile())
+		tsk.Run()
+		tsk.AwaitDone()
+		assert.Equal(t, DoneOk, tsk.Status())
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, "logs", ID+".log"))
+		require.NoError(t, err)
+		return string(content), stdout.String()
+	}
+
+	t.Run("tasks write to their log file", func(t *testing.T) {
+		log, stdout := runTask("LOG-FILE")
+		assert.Contains(t, log, "INFO: LOG-FILE: START: A task with a log file.\n")
+		assert.Contains(t, log, "out\n")
+		assert.Contains(t, log, "err\n")
+		assert.Contains(t, log, "INFO: LOG-FILE: DONE\n")
+		assert.Equal(t, "", stdout)
+	})
+
+	t.Run("logs are tee'd to global streams", func(t *testing.T) {
+		TeeLogs = true
+		log, stdout := runTask("LOG-TEE")
+		assert.Contains(t, log, "out\n")
+		lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+		assert.Equal(t, strings.Count(log, "\n"), len(lines))
+		for _, line := range lines {
+			assert.True(t, strings.HasPrefix(line, "[LOG-TEE] "), line)
+		}
+		assert.Contains(t, stdout, "[LOG-TEE] out\n")
+		assert.Contains(t, stdout, "[LOG-TEE] INFO: LOG-TEE: DONE\n")
+	})
+
+	t.Run("lines of concurrent tasks don't mix", func(t *testing.T) {
+		TeeLogs = true
+		stdout := bytes.Buffer{}
+		Stdout = &stdout
+		Stderr = &stdout
+
+		// each line is written in two chunks.
+		script := `for i in 1 2 3 4 5 6 7 8 9 10; do printf "$0 "; printf "line\n"; done`
+		IDs := []string{"LOG-A", "LOG-B", "LOG-C"}
+		children := []*Task{}
+		for _, ID := range IDs {
+			ID := ID
+			children = append(children, New(ID, func(vs *ctx.Context) error {
+				vs.Exec(vpath.Local("/bin/sh"), []string{"-c", script, ID}, nil)
+				return nil
+			}))
+		}
+		for _, child := range children {
+			child.Run()
+		}
+		for _, child := range children {
+			child.AwaitDone()
+			assert.Equal(t, DoneOk, child.Status())
+		}
+
+		for _, line := range strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n") {
+			ID := strings.TrimPrefix(strings.SplitN(line, "] ", 2)[0], "[")
+			assert.Contains(t, IDs, ID, line)
+			if !strings.Contains(line, ": ") {
+				assert.Equal(t, "["+ID+"] "+ID+" line", line)
+			}
+		}
+		for _, ID := range IDs {
+			assert.Equal(t, 10, strings.Count(stdout.String(), "["+ID+"] "+ID+" line\n"))
+		}
+	})
+
+	t.Run("tasks whose log cannot be opened write to global streams", func(t *testing.T) {
+		TeeLogs = false
+		LogFiles = "localhost:/dev/null/{id}.log"
+		stdout := bytes.Buffer{}
+		Stdout = &stdout
+		Stderr = &stdout
+		tsk := New("LOG-BROKEN", func(vs *ctx.Context) error {
+			vs.LogInfo("ciao")
+			return nil
+		})
+		tsk.Run()
+		tsk.AwaitDone()
+		assert.Equal(t, DoneOk, tsk.Status())
+		assert.Contains(t, stdout.String(), "WARNING: LOG-BROKEN: cannot open log file")
+		assert.Contains(t, stdout.String(), "INFO: LOG-BROKEN: ciao\n")
+		Stdout = os.Stdout
+		Stderr = os.Stdout
+	})
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	pw := &prefixWriter{w: &out, prefix: []byte("[T] "), lock: &sync.Mutex{}}
+	for _, chunk := range []string{"a\nb", "c", "\nd"} {
+		n, err := pw.Write([]byte(chunk))
+		assert.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	assert.Equal(t, "[T] a\n[T] bc\n", out.String())
+
+	// unterminated lines are written when flushed.
+	assert.NoError(t, pw.flush())
+	assert.Equal(t, "[T] a\n[T] bc\n[T] d\n", out.String())
+	assert.NoError(t, pw.flush())
+	assert.Equal(t, "[T] a\n[T] bc\n[T] d\n", out.String())
+}
@@ -1,10 +1,13 @@
 package tasks
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/meteocima/virtual-server/ctx"
@@ -37,6 +40,34 @@ type Task struct {
 	stderr      io.Writer //Closer
 	Description string
 	runner      TaskRunner
+
+	// Inputs are the files read by the task, and Outputs
+	// the ones it writes. When all outputs exist and none
+	// is older than any input, the task is up to date, and
+	// it completes with `Skipped` status without running.
+	// A task without outputs always runs.
+	Inputs  vpath.VirtualPathList
+	Outputs vpath.VirtualPathList
+
+	// log file of the task, when `LogFiles` is set
+	log io.WriteCloser
+
+	goctx  context.Context
+	cancel context.CancelFunc
+	// synchronizes `started` access
+	startLock *sync.Mutex
+	// set when the task is run or cancelled
+	started bool
+
+	// tasks that must succeed before
+	// this one runs in `ParentTask.RunDAG`
+	dependencies []TaskI
+	// synchronizes `dependencies` access
+	depsLock *sync.Mutex
+
+	retryPolicy *RetryPolicy
+	// number of times the task has run
+	attempts int32
 }
 
 // TaskRunner ...
@@ -100,43 +131,172 @@ func (tsk *Task) SetStatus(newStatus *TaskStatus) {
 	}
 
 	tsk.status = newStatus
+	tsk.recordStatus(newStatus)
 	tsk.StatusChanged.Invoke(newStatus)
 }
 
+// recordStatus writes `status` to the current Journal, if any.
+func (tsk *Task) recordStatus(status *TaskStatus) {
+	journal := getJournal()
+	if journal == nil {
+		return
+	}
+	err := journal.recordStatus(tsk.ID, status)
+	if err != nil && Stderr != nil {
+		fmt.Fprintf(Stderr, "WARNING: %s: cannot write status to journal: %s\n", tsk.ID, err.Error())
+	}
+}
+
+// ProduceFile emits a `FileProduced` event for `file`, and
+// writes it to the current Journal, if any, so that the event is
+// emitted again when a resumed run skips the task.
+func (tsk *Task) ProduceFile(file TaskFile) {
+	if journal := getJournal(); journal != nil {
+		err := journal.recordFile(tsk.ID, file)
+		if err != nil && Stderr != nil {
+			fmt.Fprintf(Stderr, "WARNING: %s: cannot write produced file to journal: %s\n", tsk.ID, err.Error())
+		}
+	}
+	tsk.FileProduced.Invoke(file)
+}
+
+// resumed completes the task without running it if it
+// completed successfully in the run recorded in the
+// current Journal, and returns whether it did.
+func (tsk *Task) resumed() bool {
+	journal := getJournal()
+	if journal == nil {
+		return false
+	}
+	completed, files := journal.Completed(tsk.ID)
+	if !completed {
+		return false
+	}
+
+	if Stdout != nil {
+		fmt.Fprintf(Stdout, "INFO: %s: ALREADY DONE: %s\n", tsk.ID, tsk.Description)
+	}
+	for _, file := range files {
+		tsk.FileProduced.Invoke(file)
+	}
+	tsk.SetCompleted(nil)
+	return true
+}
+
 // Status ...
 func (tsk *Task) Status() *TaskStatus {
 	return tsk.status
 }
 
-// Run ...
+// Run starts the task runner in a new goroutine.
+// Running a task already started or cancelled
+// is a no-op.
 func (tsk *Task) Run() {
-	go func() {
-
-		tsk.stdout = Stdout
-		tsk.stderr = Stderr
-		vs := ctx.New(os.Stdin, tsk.stdout, tsk.stderr)
-		vs.ID = tsk.ID
-		vs.LogInfo("START: %s", tsk.Description)
+	tsk.startLock.Lock()
+	if tsk.started {
+		tsk.startLock.Unlock()
+		return
+	}
+	tsk.started = true
+	tsk.startLock.Unlock()
 
-		tsk.SetStatus(Running)
-		err := tsk.runner(vs)
-		if err == nil && vs.Err != nil {
-			err = vs.Err
+	go func() {
+		if tsk.resumed() {
+			return
 		}
 
-		if err != nil {
-			vs.LogError(err.Error())
-		} else {
-			vs.LogInfo("DONE")
+		tsk.openLog()
+		if tsk.skipped() {
+			return
 		}
 
-		vs.Close()
-		//stderr.Close()
+		var err error
+		for attempt := 1; ; attempt++ {
+			err = tsk.runAttempt(attempt)
+			if !tsk.retryPolicy.shouldRetry(attempt, err) {
+				break
+			}
+
+			tsk.SetStatus(Retrying)
+			select {
+			case <-time.After(tsk.retryPolicy.backoff(attempt + 1)):
+			case <-tsk.goctx.Done():
+			}
+			if tsk.goctx.Err() != nil {
+				err = fmt.Errorf("task cancelled: %w", tsk.goctx.Err())
+				break
+			}
+		}
 
 		tsk.SetCompleted(err)
 	}()
 }
 
+// runAttempt runs the task runner with
+// a new `ctx.Context`, and returns its error.
+func (tsk *Task) runAttempt(attempt int) error {
+	atomic.StoreInt32(&tsk.attempts, int32(attempt))
+
+	vs := ctx.NewWithContext(tsk.goctx, os.Stdin, tsk.stdout, tsk.stderr)
+	vs.ID = tsk.ID
+	if attempt == 1 {
+		vs.LogInfo("START: %s", tsk.Description)
+	} else {
+		vs.LogInfo("RETRY %d/%d: %s", attempt, tsk.retryPolicy.MaxAttempts, tsk.Description)
+	}
+
+	tsk.SetStatus(Running)
+	err := tsk.runner(vs)
+	if err == nil && vs.Err != nil {
+		err = vs.Err
+	}
+	if tsk.goctx.Err() != nil {
+		err = fmt.Errorf("task cancelled: %w", tsk.goctx.Err())
+	}
+
+	if err != nil {
+		vs.LogError(err.Error())
+	} else {
+		vs.LogInfo("DONE")
+	}
+
+	vs.Close()
+	return err
+}
+
+// SetRetryPolicy makes the task run again, as described by
+// `policy`, when it fails. Each attempt runs with a new
+// `ctx.Context`, and the task has `Retrying` status while
+// it waits for the next attempt. It must be called
+// before the task runs.
+func (tsk *Task) SetRetryPolicy(policy RetryPolicy) {
+	tsk.retryPolicy = &policy
+}
+
+// Attempts returns the number of times the task has
+// run until now, including the running attempt.
+func (tsk *Task) Attempts() int {
+	return int(atomic.LoadInt32(&tsk.attempts))
+}
+
+// Cancel stops the task. A task not yet started
+// immediately completes with `Cancelled` status.
+// A running task has its `ctx.Context` cancelled,
+// so that its running processes are killed and all
+// subsequent operations fail: it completes with `Cancelled`
+// status when its runner returns.
+func (tsk *Task) Cancel() {
+	tsk.startLock.Lock()
+	tsk.cancel()
+	notStarted := !tsk.started && tsk.Status() == Scheduled
+	tsk.started = true
+	tsk.startLock.Unlock()
+
+	if notStarted {
+		tsk.SetCompleted(fmt.Errorf("task cancelled: %w", context.Canceled))
+	}
+}
+
 // AwaitDone ...
 func (tsk *Task) AwaitDone() {
 	tsk.Done.AwaitOne()
@@ -147,15 +307,41 @@ func (tsk *Task) TaskID() string {
 	return tsk.ID
 }
 
+// DependsOn declares that the task must run only after
+// all `deps` have succeeded. Dependencies are honored by
+// `ParentTask.RunDAG`, and must be declared before it's called.
+func (tsk *Task) DependsOn(deps ...TaskI) {
+	tsk.depsLock.Lock()
+	defer tsk.depsLock.Unlock()
+	tsk.dependencies = append(tsk.dependencies, deps...)
+}
+
+// Dependencies returns the tasks that must
+// succeed before this one runs.
+func (tsk *Task) Dependencies() []TaskI {
+	tsk.depsLock.Lock()
+	defer tsk.depsLock.Unlock()
+	return append([]TaskI{}, tsk.dependencies...)
+}
+
 // SetCompleted ...
 func (tsk *Task) SetCompleted(err error) {
-	if err != nil {
+	if errors.Is(err, context.Canceled) {
+		tsk.SetStatus(Cancelled)
+	} else if err != nil {
 		tsk.Failed.Invoke(err)
 		tsk.SetStatus(Failed(err))
 	} else {
 		tsk.Succeeded.Invoke(nil)
 		tsk.SetStatus(DoneOk)
 	}
+	tsk.closeCompleted(err)
+}
+
+// closeCompleted closes the log file of a completed
+// task, emits the `Done` event, and closes its emitters.
+func (tsk *Task) closeCompleted(err error) {
+	tsk.closeLog()
 	//fmt.Printf("Invoke Done %v\n", tsk.Done)
 	tsk.Done.Invoke(err)
 
@@ -171,23 +357,16 @@ func (tsk *Task) SetCompleted(err error) {
 	registry.RemoveTask(tsk.ID)
 }
 
-/*
-func openTaskLog(path string) io.WriteCloser {
-	logFile, err := os.OpenFile(path, os.O_RDWR|os.O_TRUNC|os.O_CREATE, os.FileMode(0644))
-	if err != nil {
-		panic(err)
-	}
-	return logFile
-}
-*/
-
 // New ...
 func New(ID string, runner TaskRunner) *Task {
 	t := Task{
-		status: Scheduled,
-		ID:     ID,
-		runner: runner,
+		status:    Scheduled,
+		ID:        ID,
+		runner:    runner,
+		startLock: &sync.Mutex{},
+		depsLock:  &sync.Mutex{},
 	}
+	t.goctx, t.cancel = context.WithCancel(context.Background())
 
 	event.InitSource(
 		&t,
@@ -200,5 +379,6 @@ func New(ID string, runner TaskRunner) *Task {
 	)
 
 	registry.AddTask(&t)
+	t.recordStatus(Scheduled)
 	return &t
 }
@@ -2,16 +2,20 @@ package tasks
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/meteocima/virtual-server/config"
 	"github.com/meteocima/virtual-server/ctx"
 	"github.com/meteocima/virtual-server/testutil"
 	"github.com/meteocima/virtual-server/vpath"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTask(t *testing.T) {
@@ -115,3 +119,204 @@ func TestTask(t *testing.T) {
 
 	tests.Wait()
 }
+
+func TestRetry(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+	Stdout = ioutil.Discard
+	Stderr = os.Stdout
+
+	collectStatuses := func(tsk *Task) chan []*TaskStatus {
+		result := make(chan []*TaskStatus, 1)
+		events := tsk.StatusChanged.AwaitAny()
+		go func() {
+			statuses := []*TaskStatus{}
+			for ev := range events {
+				statuses = append(statuses, ev.Payload.(*TaskStatus))
+			}
+			result <- statuses
+		}()
+		return result
+	}
+
+	t.Run("a failed task runs again with a new context", func(t *testing.T) {
+		var tsk *Task
+		tsk = New("TEST-RETRY", func(vs *ctx.Context) error {
+			assert.NoError(t, vs.Err)
+			if tsk.Attempts() < 3 {
+				vs.SetContextFailed("attempt %d failed", tsk.Attempts())
+			}
+			return nil
+		})
+		tsk.SetRetryPolicy(RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond})
+		statuses := collectStatuses(tsk)
+
+		tsk.Run()
+		tsk.AwaitDone()
+		assert.Equal(t, DoneOk, tsk.Status())
+		assert.Equal(t, 3, tsk.Attempts())
+		assert.Equal(t, []*TaskStatus{Running, Retrying, Running, Retrying, Running, DoneOk}, <-statuses)
+	})
+
+	t.Run("a task fails when attempts are exhausted", func(t *testing.T) {
+		tsk := New("TEST-RETRY", func(vs *ctx.Context) error {
+			return errors.New("always failing")
+		})
+		tsk.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+
+		tsk.Run()
+		tsk.AwaitDone()
+		require.True(t, tsk.Status().IsFailure())
+		assert.Equal(t, "always failing", tsk.Status().Err.Error())
+		assert.Equal(t, 3, tsk.Attempts())
+	})
+
+	t.Run("errors not retryable fail immediately", func(t *testing.T) {
+		permanent := errors.New("permanent")
+		tsk := New("TEST-RETRY", func(vs *ctx.Context) error {
+			return permanent
+		})
+		tsk.SetRetryPolicy(RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			Retryable: func(err error) bool {
+				return !errors.Is(err, permanent)
+			},
+		})
+
+		tsk.Run()
+		tsk.AwaitDone()
+		assert.True(t, tsk.Status().IsFailure())
+		assert.Equal(t, 1, tsk.Attempts())
+	})
+
+	t.Run("a task cancelled while retrying is not run again", func(t *testing.T) {
+		tsk := New("TEST-RETRY", func(vs *ctx.Context) error {
+			return errors.New("failing")
+		})
+		tsk.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour})
+		retrying := make(chan struct{})
+		events := tsk.StatusChanged.AwaitAny()
+		go func() {
+			// events must be consumed until
+			// the emitter is closed.
+			for ev := range events {
+				if ev.Payload == Retrying {
+					close(retrying)
+				}
+			}
+		}()
+
+		tsk.Run()
+		<-retrying
+		tsk.Cancel()
+		tsk.AwaitDone()
+		assert.Equal(t, Cancelled, tsk.Status())
+		assert.Equal(t, 1, tsk.Attempts())
+	})
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, policy.backoff(2))
+	assert.Equal(t, 2*time.Second, policy.backoff(3))
+	assert.Equal(t, 4*time.Second, policy.backoff(4))
+	assert.Equal(t, 5*time.Second, policy.backoff(5))
+	assert.Equal(t, 5*time.Second, policy.backoff(50))
+
+	policy = RetryPolicy{InitialBackoff: 10 * time.Second, Multiplier: 3, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(3)
+		assert.GreaterOrEqual(t, int64(backoff), int64(24*time.Second))
+		assert.LessOrEqual(t, int64(backoff), int64(36*time.Second))
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	assert.NoError(t, err)
+	Stdout = os.Stdout
+	Stderr = os.Stdout
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	output := filepath.Join(dir, "output.txt")
+	touch := func(path string, modTime time.Time) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(path), 0644))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	runs := 0
+	runTask := func() *Task {
+		tsk := New("UP-TO-DATE", func(vs *ctx.Context) error {
+			runs++
+			return nil
+		})
+		tsk.Inputs = vpath.VirtualPathList{vpath.Local(input)}
+		tsk.Outputs = vpath.VirtualPathList{vpath.Local(output)}
+		tsk.Run()
+		tsk.AwaitDone()
+		return tsk
+	}
+
+	now := time.Now()
+	touch(input, now.Add(-time.Hour))
+
+	t.Run("tasks with missing outputs run", func(t *testing.T) {
+		runs = 0
+		assert.Equal(t, DoneOk, runTask().Status())
+		assert.Equal(t, 1, runs)
+	})
+
+	t.Run("tasks with outputs newer than inputs are skipped", func(t *testing.T) {
+		runs = 0
+		touch(output, now)
+		assert.Equal(t, Skipped, runTask().Status())
+		assert.Equal(t, 0, runs)
+	})
+
+	t.Run("tasks with outputs older than inputs run", func(t *testing.T) {
+		runs = 0
+		touch(input, now.Add(time.Minute))
+		assert.Equal(t, DoneOk, runTask().Status())
+		assert.Equal(t, 1, runs)
+	})
+
+	t.Run("tasks without outputs always run", func(t *testing.T) {
+		runs = 0
+		tsk := New("UP-TO-DATE-NO-OUTPUTS", func(vs *ctx.Context) error {
+			runs++
+			return nil
+		})
+		tsk.Inputs = vpath.VirtualPathList{vpath.Local(input)}
+		tsk.Run()
+		tsk.AwaitDone()
+		assert.Equal(t, DoneOk, tsk.Status())
+		assert.Equal(t, 1, runs)
+	})
+
+	t.Run("dependents of skipped tasks run", func(t *testing.T) {
+		touch(output, now.Add(time.Hour))
+		skipped := New("UP-TO-DATE-SKIPPED", func(vs *ctx.Context) error {
+			return errors.New("should not run")
+		})
+		skipped.Inputs = vpath.VirtualPathList{vpath.Local(input)}
+		skipped.Outputs = vpath.VirtualPathList{vpath.Local(output)}
+		dependent := New("UP-TO-DATE-DEPENDENT", func(vs *ctx.Context) error {
+			return nil
+		})
+		dependent.DependsOn(skipped)
+
+		var parent *ParentTask
+		parent = NewParent("UP-TO-DATE-PARENT", func(vs *ctx.Context) error {
+			parent.AppendChildren(skipped, dependent)
+			return parent.RunDAG()
+		})
+		parent.Run()
+		parent.AwaitDone()
+
+		assert.Equal(t, DoneOk, parent.Status())
+		assert.Equal(t, Skipped, skipped.Status())
+		assert.Equal(t, DoneOk, dependent.Status())
+	})
+}
@@ -0,0 +1,75 @@
+package tasks
+
+import (
+	"os"
+	"time"
+
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// upToDate returns whether all outputs of the task exist
+// and none of them is older than any of its inputs. Files
+// are checked with `ctx.Context.Stat`, so inputs and
+// outputs can be on different hosts.
+func (tsk *Task) upToDate(vs *ctx.Context) bool {
+	if len(tsk.Outputs) == 0 {
+		return false
+	}
+
+	paths := append(append(vpath.VirtualPathList{}, tsk.Inputs...), tsk.Outputs...)
+	isOutput := map[string]bool{}
+	for _, output := range tsk.Outputs {
+		isOutput[output.String()] = true
+	}
+
+	infos := vs.Stat(paths...)
+	if infos == nil {
+		return false
+	}
+
+	found := map[string]bool{}
+	var newestInput, oldestOutput time.Time
+	for info := range infos {
+		path := info.Path.String()
+		found[path] = true
+		modTime := info.ModTime()
+		if isOutput[path] {
+			if oldestOutput.IsZero() || modTime.Before(oldestOutput) {
+				oldestOutput = modTime
+			}
+		} else if modTime.After(newestInput) {
+			newestInput = modTime
+		}
+	}
+
+	for _, path := range paths {
+		if !found[path.String()] {
+			// missing inputs are reported
+			// by the task when it runs.
+			return false
+		}
+	}
+	return !newestInput.After(oldestOutput)
+}
+
+// skipped completes the task with `Skipped` status
+// if its outputs are up to date, and returns whether it did.
+func (tsk *Task) skipped() bool {
+	if len(tsk.Outputs) == 0 {
+		return false
+	}
+
+	vs := ctx.NewWithContext(tsk.goctx, os.Stdin, tsk.stdout, tsk.stderr)
+	vs.ID = tsk.ID
+	defer vs.Close()
+	if !tsk.upToDate(vs) {
+		return false
+	}
+
+	vs.LogInfo("SKIPPED: %s: outputs are up to date", tsk.Description)
+	tsk.Succeeded.Invoke(nil)
+	tsk.SetStatus(Skipped)
+	tsk.closeCompleted(nil)
+	return true
+}
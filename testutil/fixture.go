@@ -1,8 +1,11 @@
 package testutil
 
 import (
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
+	"testing"
 )
 
 // FixtureDir return directory of fixtures
@@ -15,3 +18,31 @@ func FixtureDir(filePath string) string {
 	}
 	return result
 }
+
+// CopyFixtures copies the files of the fake host
+// fixtures (`fixtures/fakehost/var-fixtures`)
+// to `dir`, preserving their permissions.
+func CopyFixtures(t testing.TB, dir string) {
+	source := FixtureDir("fakehost/var-fixtures")
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, content, info.Mode().Perm())
+	})
+	if err != nil {
+		t.Fatalf("cannot copy fixtures: %v", err)
+	}
+}
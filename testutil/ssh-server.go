@@ -0,0 +1,403 @@
+package testutil
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHServer is an in-process SSH server, used to
+// test SSH connections without an external server.
+//
+// The server accepts a single user, authenticated
+// with a key generated when the server is created,
+// runs commands on the local machine using `/bin/sh -c`
+// and serves the local file system through the sftp
+// subsystem. It also allows port forwarding, so it can be
+// used as a jump host.
+type SSHServer struct {
+	// Dir is a temporary directory that is
+	// the work directory of commands run by
+	// the server. Tests should create their
+	// files here.
+	Dir string
+	// Port is the TCP port on which
+	// the server listens on 127.0.0.1
+	Port int
+
+	user           string
+	keyPath        string
+	knownHostsPath string
+	listener       net.Listener
+	config         *ssh.ServerConfig
+
+	// synchronizes `conns` access
+	lock  *sync.Mutex
+	conns map[*ssh.ServerConn]struct{}
+}
+
+// NewSSHServer starts an SSHServer, that is
+// stopped when the test completes.
+func NewSSHServer(t testing.TB) *SSHServer {
+	srv, err := startSSHServer(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot start ssh server: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func startSSHServer(dir string, keysDir string) (*SSHServer, error) {
+	srv := &SSHServer{
+		Dir:            dir,
+		keyPath:        filepath.Join(keysDir, "id_ecdsa"),
+		knownHostsPath: filepath.Join(keysDir, "known_hosts"),
+		lock:           &sync.Mutex{},
+		conns:          map[*ssh.ServerConn]struct{}{},
+	}
+
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	srv.user = currentUser.Username
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey, err := writeClientKey(srv.keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == srv.user && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", meta.User())
+		},
+	}
+	srv.config.AddHostKey(hostSigner)
+
+	srv.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv.Port = srv.listener.Addr().(*net.TCPAddr).Port
+
+	knownHost := knownhosts.Line([]string{knownhosts.Normalize(srv.listener.Addr().String())}, hostSigner.PublicKey())
+	err = ioutil.WriteFile(srv.knownHostsPath, []byte(knownHost+"\n"), os.FileMode(0600))
+	if err != nil {
+		srv.listener.Close()
+		return nil, err
+	}
+
+	go srv.serve()
+
+	return srv, nil
+}
+
+// writeClientKey generates the key used by clients
+// to authenticate, and saves it to `keyPath`.
+func writeClientKey(keyPath string) (ssh.PublicKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	err = ioutil.WriteFile(keyPath, content, os.FileMode(0600))
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewPublicKey(&key.PublicKey)
+}
+
+// Host returns the configuration of an
+// host that connects to the server.
+func (srv *SSHServer) Host(name string) *config.Host {
+	return &config.Host{
+		Type:          config.HostTypeSSH,
+		Name:          name,
+		Host:          "127.0.0.1",
+		BackupHosts:   []string{},
+		Port:          srv.Port,
+		User:          srv.user,
+		Key:           srv.keyPath,
+		KnownHosts:    srv.knownHostsPath,
+		HostKeyPolicy: config.HostKeyStrict,
+		AuthMethods:   []config.AuthMethod{config.AuthKey},
+	}
+}
+
+// DropConnections closes all client
+// connections, simulating a network failure.
+func (srv *SSHServer) DropConnections() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the server, and
+// closes all client connections.
+func (srv *SSHServer) Close() {
+	srv.listener.Close()
+	srv.DropConnections()
+}
+
+func (srv *SSHServer) serve() {
+	for {
+		netConn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		go srv.handleConn(netConn)
+	}
+}
+
+func (srv *SSHServer) handleConn(netConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, srv.config)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+
+	srv.lock.Lock()
+	srv.conns[conn] = struct{}{}
+	srv.lock.Unlock()
+
+	defer func() {
+		srv.lock.Lock()
+		delete(srv.conns, conn)
+		srv.lock.Unlock()
+	}()
+
+	// global requests, such as keepalives,
+	// are replied with a failure.
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "session":
+			go srv.handleSession(newChan)
+		case "direct-tcpip":
+			go handleDirectTCPIP(newChan)
+		default:
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// signals maps ssh signal names to
+// the corresponding os signals.
+var signals = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT,
+	"ALRM": syscall.SIGALRM,
+	"FPE":  syscall.SIGFPE,
+	"HUP":  syscall.SIGHUP,
+	"ILL":  syscall.SIGILL,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, value := range signals {
+		if value == sig {
+			return name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+func (srv *SSHServer) handleSession(newChan ssh.NewChannel) {
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+
+	env := []string{}
+	var process *os.Process
+	started := make(chan *os.Process, 1)
+
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var payload struct{ Name, Value string }
+			err := ssh.Unmarshal(req.Payload, &payload)
+			env = append(env, payload.Name+"="+payload.Value)
+			req.Reply(err == nil, nil)
+
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go srv.exec(channel, payload.Command, env, started)
+
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go serveSFTP(channel)
+
+		case "signal":
+			var payload struct{ Signal string }
+			err := ssh.Unmarshal(req.Payload, &payload)
+			if process == nil {
+				select {
+				case process = <-started:
+				default:
+				}
+			}
+			sig, known := signals[payload.Signal]
+			if err == nil && known && process != nil {
+				process.Signal(sig)
+			}
+			if req.WantReply {
+				req.Reply(err == nil && known && process != nil, nil)
+			}
+
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// exec runs `command` in a new session, like sshd
+// does, so that the whole process group can be signalled.
+func (srv *SSHServer) exec(channel ssh.Channel, command string, env []string, started chan *os.Process) {
+	defer channel.Close()
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = srv.Dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		fmt.Fprintln(channel.Stderr(), err.Error())
+		sendExitStatus(channel, 127)
+		return
+	}
+	started <- cmd.Process
+
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	cmd.Wait()
+
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{Signal: signalName(status.Signal())}))
+		return
+	}
+	sendExitStatus(channel, cmd.ProcessState.ExitCode())
+}
+
+func sendExitStatus(channel ssh.Channel, code int) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+}
+
+func serveSFTP(channel ssh.Channel) {
+	defer channel.Close()
+	server, err := sftp.NewServer(channel)
+	if err != nil {
+		return
+	}
+	server.Serve()
+	server.Close()
+}
+
+// handleDirectTCPIP forwards a connection
+// opened by a client that uses the server
+// as jump host.
+func handleDirectTCPIP(newChan ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(target, channel)
+		target.Close()
+	}()
+	io.Copy(channel, target)
+	channel.Close()
+}
@@ -35,6 +35,12 @@ func (vPath *VirtualPath) UnmarshalText(data []byte) error {
 	return nil
 }
 
+// MarshalText encodes the virtual path
+// in its `host:path` string form.
+func (vPath VirtualPath) MarshalText() ([]byte, error) {
+	return []byte(vPath.String()), nil
+}
+
 /*
 // Stdin is a placeholder VirtualPath which represents the `stdin` stream of a process.
 var Stdin = &VirtualPath{
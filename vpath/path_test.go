@@ -1,6 +1,7 @@
 package vpath
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -131,3 +132,13 @@ func TestFromS(t *testing.T) {
 	assert.Equal(t, "localhost", p5.Host)
 	assert.Equal(t, ".", p5.Path)
 }
+
+func TestMarshalText(t *testing.T) {
+	encoded, err := json.Marshal([]VirtualPath{New("drihm", "/tmp"), {Path: "/var"}})
+	assert.NoError(t, err)
+	assert.Equal(t, `["drihm:/tmp","localhost:/var"]`, string(encoded))
+
+	var decoded []VirtualPath
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, []VirtualPath{New("drihm", "/tmp"), Local("/var")}, decoded)
+}
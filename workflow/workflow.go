@@ -0,0 +1,281 @@
+// Package workflow allows to describe a tree
+// of tasks in a `toml` file, and to load it as
+// a `tasks.ParentTask` using `workflow.Load`.
+//
+// Each task runs a command, identified by a virtual
+// path, and starts only when all the tasks it depends
+// on have succeeded. When a dependency fails or is cancelled,
+// the dependent tasks don't run. Tasks whose outputs are
+// newer than all their inputs are skipped.
+//
+// ## Example
+//
+// __main.go__
+//
+// ```go
+//   import "github.com/meteocima/virtual-server/workflow"
+//
+//   func main() {
+//     parent, err := workflow.Load("./workflow.toml")
+//     if err != nil {
+//       log.Fatal(err.Error())
+//     }
+//     parent.Run()
+//     parent.AwaitDone()
+//   }
+// ```
+//
+// __workflow.toml__
+//
+// ```
+//  id = "wrf-daily"
+//  description = "Daily WRF simulation"
+//  max-parallelism = 2
+//  fail-fast = true
+//
+//  [[tasks]]
+//  id = "download"
+//  command = "localhost:/usr/local/bin/download-gfs"
+//  args = ["2020-12-25"]
+//
+//  [[tasks]]
+//  id = "simulation"
+//  description = "Run WRF"
+//  command = "drihm:/opt/wrf/run.sh"
+//  cwd = "drihm:/var/wrf"
+//  env = ["OMP_NUM_THREADS=4"]
+//  depends-on = ["download"]
+//  inputs = ["drihm:/var/wrf/namelist.input"]
+//  outputs = ["drihm:/var/wrf/wrfout_d01"]
+//
+// ```
+//
+package workflow
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/meteocima/virtual-server/connection"
+	"github.com/meteocima/virtual-server/ctx"
+	"github.com/meteocima/virtual-server/tasks"
+	"github.com/meteocima/virtual-server/vpath"
+)
+
+// Workflow is a tree of tasks, as
+// read from a workflow file.
+type Workflow struct {
+	// ID of the parent task.
+	ID string
+	// Description of the parent task.
+	Description string
+	// Maximum number of tasks that can
+	// run concurrently. 0 means no limit.
+	MaxParallelism uint `toml:"max-parallelism"`
+	// If true, tasks are not started
+	// anymore once a task has failed.
+	FailFast bool `toml:"fail-fast"`
+	// Tasks of the workflow.
+	Tasks []Task
+}
+
+// Task is a single task of a workflow,
+// that runs a command.
+type Task struct {
+	// ID of the task, unique in the workflow.
+	ID string
+	// Description of the task.
+	Description string
+	// Command to run.
+	Command vpath.VirtualPath
+	// Arguments of the command.
+	Args []string
+	// Work directory in which the
+	// command is run.
+	Cwd vpath.VirtualPath
+	// Environment variables of the
+	// command, in `NAME=value` form.
+	Env []string
+	// IDs of the tasks that must
+	// succeed before this one runs.
+	DependsOn []string `toml:"depends-on"`
+	// Files read by the command.
+	Inputs vpath.VirtualPathList
+	// Files written by the command. When all
+	// of them are newer than every input, the
+	// task is skipped.
+	Outputs vpath.VirtualPathList
+}
+
+// Load reads a workflow file and
+// returns its tree of tasks.
+func Load(workflowFile string) (*tasks.ParentTask, error) {
+	wf, err := LoadFile(workflowFile)
+	if err != nil {
+		return nil, err
+	}
+	return wf.Build()
+}
+
+// LoadFile reads and validates
+// a workflow file.
+func LoadFile(workflowFile string) (*Workflow, error) {
+	var wf Workflow
+	md, err := toml.DecodeFile(workflowFile, &wf)
+	if err != nil {
+		return nil, fmt.Errorf("wrong workflow file \"%s\": %w", workflowFile, err)
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("wrong workflow file \"%s\": unknown keys %s", workflowFile, strings.Join(keys, ", "))
+	}
+
+	err = wf.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("wrong workflow file \"%s\": %w", workflowFile, err)
+	}
+
+	return &wf, nil
+}
+
+// Validate checks that all tasks have an unique ID and
+// a command, and that their dependencies exist and don't
+// form cycles.
+func (wf *Workflow) Validate() error {
+	if wf.ID == "" {
+		return fmt.Errorf("workflow id is missing")
+	}
+	if len(wf.Tasks) == 0 {
+		return fmt.Errorf("workflow `%s` has no tasks", wf.ID)
+	}
+
+	byID := map[string]*Task{}
+	for i := range wf.Tasks {
+		task := &wf.Tasks[i]
+		if task.ID == "" {
+			return fmt.Errorf("task #%d has no id", i+1)
+		}
+		if _, exists := byID[task.ID]; exists {
+			return fmt.Errorf("task `%s` is defined more than once", task.ID)
+		}
+		if task.Command.Path == "" {
+			return fmt.Errorf("task `%s` has no command", task.ID)
+		}
+		byID[task.ID] = task
+	}
+
+	for _, task := range wf.Tasks {
+		for _, dep := range task.DependsOn {
+			if _, exists := byID[dep]; !exists {
+				return fmt.Errorf("task `%s` depends on unknown task `%s`", task.ID, dep)
+			}
+		}
+	}
+
+	_, err := wf.sorted()
+	return err
+}
+
+// sorted returns the tasks of the workflow sorted
+// so that each task follows all its dependencies.
+// It fails if dependencies contain a cycle.
+func (wf *Workflow) sorted() ([]*Task, error) {
+	index := map[string]int{}
+	for i, task := range wf.Tasks {
+		index[task.ID] = i
+	}
+
+	order, err := tasks.SortDependencies(
+		len(wf.Tasks),
+		func(i int) []int {
+			deps := make([]int, len(wf.Tasks[i].DependsOn))
+			for j, dep := range wf.Tasks[i].DependsOn {
+				deps[j] = index[dep]
+			}
+			return deps
+		},
+		func(i int) string { return wf.Tasks[i].ID },
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Task, len(order))
+	for i, taskIndex := range order {
+		result[i] = &wf.Tasks[taskIndex]
+	}
+	return result, nil
+}
+
+// runner returns the TaskRunner
+// that executes the task command.
+func (task *Task) runner() tasks.TaskRunner {
+	return func(vs *ctx.Context) error {
+		vs.Exec(task.Command, task.Args, &connection.RunOptions{
+			Cwd: task.Cwd,
+			Env: task.Env,
+		})
+		return vs.Err
+	}
+}
+
+// Build returns a ParentTask that runs all tasks
+// of the workflow. Children are appended to the parent
+// immediately, so the tree can be inspected before it runs.
+// The parent fails when any of its tasks fails.
+func (wf *Workflow) Build() (*tasks.ParentTask, error) {
+	ordered, err := wf.sorted()
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[string]*tasks.Task{}
+	childrenList := make([]tasks.TaskI, len(ordered))
+	for i, task := range ordered {
+		child := tasks.New(task.ID, task.runner())
+		child.Description = task.Description
+		child.Inputs = task.Inputs
+		child.Outputs = task.Outputs
+		for _, dep := range task.DependsOn {
+			child.DependsOn(children[dep])
+		}
+		children[task.ID] = child
+		childrenList[i] = child
+	}
+
+	var parent *tasks.ParentTask
+	parent = tasks.NewParent(wf.ID, func(vs *ctx.Context) error {
+		err := parent.RunDAG()
+		if err != nil {
+			return err
+		}
+
+		// tasks cancelled because a dependency
+		// failed are reported as failed too.
+		failed := []string{}
+		for _, task := range ordered {
+			child := children[task.ID]
+			child.AwaitDone()
+			if !child.Status().IsSuccess() {
+				failed = append(failed, task.ID)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("tasks failed: %s", strings.Join(failed, ", "))
+		}
+		return nil
+	})
+	parent.Description = wf.Description
+	parent.SetMaxParallelism(wf.MaxParallelism)
+	if wf.FailFast {
+		parent.SetFailFast()
+	}
+	parent.AppendChildren(childrenList...)
+
+	return parent, nil
+}
@@ -0,0 +1,132 @@
+package workflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/meteocima/virtual-server/config"
+	"github.com/meteocima/virtual-server/tasks"
+	"github.com/meteocima/virtual-server/testutil"
+	"github.com/meteocima/virtual-server/vpath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFile(t *testing.T) {
+	wf, err := LoadFile(testutil.FixtureDir("workflow.toml"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "daily", wf.ID)
+	assert.Equal(t, "Daily simulation", wf.Description)
+	assert.Equal(t, uint(2), wf.MaxParallelism)
+	assert.True(t, wf.FailFast)
+	require.Equal(t, 3, len(wf.Tasks))
+
+	sim := wf.Tasks[2]
+	assert.Equal(t, "simulation", sim.ID)
+	assert.Equal(t, vpath.New("drihm", "/opt/wrf/run.sh"), sim.Command)
+	assert.Equal(t, []string{"OMP_NUM_THREADS=4"}, sim.Env)
+	assert.Equal(t, []string{"download", "preprocess"}, sim.DependsOn)
+	assert.Equal(t, vpath.VirtualPathList{vpath.New("drihm", "/var/wrf/namelist.input")}, sim.Inputs)
+	assert.Equal(t, vpath.VirtualPathList{vpath.New("drihm", "/var/wrf/wrfout_d01")}, sim.Outputs)
+	assert.Equal(t, vpath.New("localhost", "/tmp"), wf.Tasks[1].Cwd)
+}
+
+func TestLoad(t *testing.T) {
+	parent, err := Load(testutil.FixtureDir("workflow.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, "daily", parent.ID)
+	assert.Equal(t, "Daily simulation", parent.Description)
+	assert.Equal(t, tasks.Scheduled, parent.Status())
+}
+
+func TestValidate(t *testing.T) {
+	_, err := LoadFile(testutil.FixtureDir("workflow-cycle.toml"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dependencies form a cycle: first -> third -> second -> first")
+
+	check := func(content string, expected string) {
+		workflowFile := filepath.Join(t.TempDir(), "workflow.toml")
+		require.NoError(t, ioutil.WriteFile(workflowFile, []byte(content), 0644))
+		_, err := LoadFile(workflowFile)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), expected)
+	}
+
+	check("[[tasks]]\nid = \"a\"\ncommand = \"/bin/true\"\n", "workflow id is missing")
+	check("id = \"wf\"\n", "workflow `wf` has no tasks")
+	check("id = \"wf\"\n[[tasks]]\ncommand = \"/bin/true\"\n", "task #1 has no id")
+	check("id = \"wf\"\n[[tasks]]\nid = \"a\"\n", "task `a` has no command")
+	check("id = \"wf\"\n[[tasks]]\nid = \"a\"\ncommand = \"/bin/true\"\n[[tasks]]\nid = \"a\"\ncommand = \"/bin/true\"\n", "task `a` is defined more than once")
+	check("id = \"wf\"\n[[tasks]]\nid = \"a\"\ncommand = \"/bin/true\"\ndepends-on = [\"b\"]\n", "task `a` depends on unknown task `b`")
+	check("id = \"wf\"\n[[tasks]]\nid = \"a\"\ncommand = \"/bin/true\"\ndepends = [\"b\"]\n", "unknown keys tasks.depends")
+}
+
+func TestRun(t *testing.T) {
+	err := config.Init(testutil.FixtureDir("virt-serv.toml"))
+	require.NoError(t, err)
+	tasks.Stdout = os.Stdout
+	tasks.Stderr = os.Stdout
+
+	dir := t.TempDir()
+	outFile := filepath.Join(dir, "out.txt")
+	appendTask := func(id string, deps ...string) Task {
+		return Task{
+			ID:        id,
+			Command:   vpath.Local("/bin/sh"),
+			Args:      []string{"-c", "echo " + id + " >> " + outFile},
+			DependsOn: deps,
+		}
+	}
+
+	t.Run("tasks run after their dependencies", func(t *testing.T) {
+		wf := Workflow{
+			ID:             "wf-order",
+			MaxParallelism: 1,
+			Tasks: []Task{
+				appendTask("last", "middle", "first"),
+				appendTask("middle", "first"),
+				appendTask("first"),
+			},
+		}
+		parent, err := wf.Build()
+		require.NoError(t, err)
+
+		parent.Run()
+		parent.AwaitDone()
+		assert.Equal(t, tasks.DoneOk, parent.Status())
+
+		content, err := ioutil.ReadFile(outFile)
+		require.NoError(t, err)
+		assert.Equal(t, "first\nmiddle\nlast\n", string(content))
+	})
+
+	t.Run("dependents of a failed task don't run", func(t *testing.T) {
+		os.Remove(outFile)
+
+		failing := appendTask("broken")
+		failing.Command = vpath.Local("/nonexistent")
+		wf := Workflow{
+			ID: "wf-failure",
+			Tasks: []Task{
+				failing,
+				appendTask("after-broken", "broken"),
+				appendTask("independent"),
+			},
+		}
+		parent, err := wf.Build()
+		require.NoError(t, err)
+
+		parent.Run()
+		parent.AwaitDone()
+		require.True(t, parent.Status().IsFailure())
+		assert.Equal(t, "tasks failed: broken, after-broken", parent.Status().Err.Error())
+
+		content, err := ioutil.ReadFile(outFile)
+		require.NoError(t, err)
+		assert.Equal(t, "independent", strings.TrimSpace(string(content)))
+	})
+}